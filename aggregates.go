@@ -4,10 +4,107 @@ package vfilter
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"sort"
 
 	"github.com/Velocidex/ordereddict"
 )
 
+// An aggregate function summarises its args over all the rows in a
+// group (or over the whole result set when there is no GROUP BY).
+//
+// Aggregators do not store any state themselves. Instead, the query
+// keeps a separate state for each group and for each place the
+// aggregate is called from, and passes it to the aggregator for each
+// row. This means two count() columns in the same query, or the same
+// aggregate in a nested query, never see each other's state.
+type AggregatorInterface interface {
+	Info(scope *Scope, type_map *TypeMap) *FunctionInfo
+
+	// The state of a group before any rows are added.
+	Init(scope *Scope) Any
+
+	// Add a row's args to the state and return the new state. The
+	// state may be modified in place.
+	Accumulate(ctx context.Context, scope *Scope, state Any, args *ordereddict.Dict) Any
+
+	// The value of the aggregate for the rows in the state.
+	Result(scope *Scope, state Any) Any
+
+	// Combine the states of two parts of the same group and return
+	// the new state. All the rows in a came before the rows in
+	// b. The states may be modified in place.
+	Merge(scope *Scope, a Any, b Any) Any
+}
+
+// Adapts an aggregator so it may be called like any other function.
+type _AggregateFunction struct {
+	impl AggregatorInterface
+}
+
+// Boxes the state in the scope context so a nil state is not
+// mistaken for a missing one. The aggregator is kept with its state
+// so states may be merged.
+type _AggregateState struct {
+	impl  AggregatorInterface
+	state Any
+}
+
+// When this key is set in the scope context all the rows of the group
+// have already been added to the states (see aggregateParallel() and
+// emitEmptyAggregate()), so aggregates only produce their results and
+// their args are not evaluated.
+const aggregate_final_key = "__aggregate_final"
+
+func (self _AggregateFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	info := self.impl.Info(scope, type_map)
+	info.IsAggregate = true
+	return info
+}
+
+// When called outside a query (e.g. directly from Go) there is no
+// call site to key the state on, so all such calls share a state.
+func (self _AggregateFunction) Call(
+	ctx context.Context,
+	scope *Scope,
+	args *ordereddict.Dict) Any {
+	return self.accumulate(ctx, scope, fmt.Sprintf("%T", self.impl), args)
+}
+
+// Update the state stored in the scope context under key with the
+// args.
+func (self _AggregateFunction) accumulate(
+	ctx context.Context,
+	scope *Scope,
+	key string,
+	args *ordereddict.Dict) Any {
+	key = "__aggregate " + key
+	box := self.state(scope, key)
+	if scope.GetContext(aggregate_final_key) != nil {
+		return self.impl.Result(scope, box.state)
+	}
+
+	box.state = self.impl.Accumulate(ctx, scope, box.state, args)
+	return self.impl.Result(scope, box.state)
+}
+
+// The value of the aggregate once all the rows were added.
+func (self _AggregateFunction) result(scope *Scope, key string) Any {
+	return self.impl.Result(scope, self.state(scope, "__aggregate "+key).state)
+}
+
+// Get the state stored in the scope context under key, initializing
+// it if this is the first call.
+func (self _AggregateFunction) state(scope *Scope, key string) *_AggregateState {
+	box, _ := scope.GetContext(key).(*_AggregateState)
+	if box == nil {
+		box = &_AggregateState{impl: self.impl, state: self.impl.Init(scope)}
+		scope.SetContext(key, box)
+	}
+	return box
+}
+
 type _CountFunctionArgs struct {
 	Items Any `vfilter:"required,field=items"`
 }
@@ -16,134 +113,670 @@ type _CountFunction struct{}
 
 func (self _CountFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
 	return &FunctionInfo{
-		Name:        "count",
-		Doc:         "Counts the items.",
-		ArgType:     type_map.AddType(scope, _CountFunctionArgs{}),
-		IsAggregate: true,
+		Name:    "count",
+		Doc:     "Counts the items.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
 	}
 }
 
-func (self _CountFunction) Call(
+func (self _CountFunction) Init(scope *Scope) Any {
+	return uint64(0)
+}
+
+func (self _CountFunction) Accumulate(
 	ctx context.Context,
 	scope *Scope,
+	state Any,
 	args *ordereddict.Dict) Any {
 	arg := &_CountFunctionArgs{}
 	err := ExtractArgs(scope, args, arg)
 	if err != nil {
-		scope.Log("count: %s", err.Error())
-		return Null{}
+		reportArgError(scope, "count", err)
+		return state
 	}
 
-	count := uint64(0)
-	previous_value_any := scope.GetContext(GetID(self))
-	if previous_value_any != nil {
-		count = previous_value_any.(uint64)
-	}
+	return state.(uint64) + 1
+}
+
+func (self _CountFunction) Result(scope *Scope, state Any) Any {
+	return state
+}
 
-	count += 1
-	scope.SetContext(GetID(self), count)
+func (self _CountFunction) Merge(scope *Scope, a Any, b Any) Any {
+	return a.(uint64) + b.(uint64)
+}
 
-	return count
+// The state of min() and max(). Items are compared using the Lt
+// protocol.
+type _ExtremeState struct {
+	value Any
+	seen  bool
 }
 
 type _MinFunction struct{}
 
 func (self _MinFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
 	return &FunctionInfo{
-		Name:        "min",
-		Doc:         "Finds the smallest item in the aggregate.",
-		ArgType:     type_map.AddType(scope, _CountFunctionArgs{}),
-		IsAggregate: true,
+		Name:    "min",
+		Doc:     "Finds the smallest item in the aggregate.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
 	}
 }
 
-func (self _MinFunction) Call(
+func (self _MinFunction) Init(scope *Scope) Any {
+	return &_ExtremeState{}
+}
+
+func (self _MinFunction) Accumulate(
 	ctx context.Context,
 	scope *Scope,
+	state Any,
 	args *ordereddict.Dict) Any {
 	arg := &_CountFunctionArgs{}
 	err := ExtractArgs(scope, args, arg)
 	if err != nil {
-		scope.Log("min: %s", err.Error())
-		return Null{}
+		reportArgError(scope, "min", err)
+		return state
 	}
 
-	var min_value Any = arg.Items
-	previous_value := scope.GetContext(GetID(self))
-
-	if previous_value != nil && !scope.Lt(min_value, previous_value) {
-		min_value = previous_value
-	}
+	return self.Merge(scope, state, &_ExtremeState{value: arg.Items, seen: true})
+}
 
-	scope.SetContext(GetID(self), min_value)
+func (self _MinFunction) Result(scope *Scope, state Any) Any {
+	return state.(*_ExtremeState).value
+}
 
-	return min_value
+func (self _MinFunction) Merge(scope *Scope, a Any, b Any) Any {
+	a_state := a.(*_ExtremeState)
+	b_state := b.(*_ExtremeState)
+	if !a_state.seen || (b_state.seen && scope.Lt(b_state.value, a_state.value)) {
+		return b_state
+	}
+	return a_state
 }
 
 type _MaxFunction struct{}
 
 func (self _MaxFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
 	return &FunctionInfo{
-		Name:        "max",
-		Doc:         "Finds the largest item in the aggregate.",
-		ArgType:     type_map.AddType(scope, _CountFunctionArgs{}),
-		IsAggregate: true,
+		Name:    "max",
+		Doc:     "Finds the largest item in the aggregate.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
 	}
 }
 
-func (self _MaxFunction) Call(
+func (self _MaxFunction) Init(scope *Scope) Any {
+	return &_ExtremeState{}
+}
+
+func (self _MaxFunction) Accumulate(
 	ctx context.Context,
 	scope *Scope,
+	state Any,
 	args *ordereddict.Dict) Any {
 	arg := &_CountFunctionArgs{}
 	err := ExtractArgs(scope, args, arg)
 	if err != nil {
-		scope.Log("min: %s", err.Error())
-		return Null{}
+		reportArgError(scope, "max", err)
+		return state
 	}
 
-	var max_value Any = arg.Items
-	previous_value := scope.GetContext(GetID(self))
-	if previous_value != nil && scope.Lt(max_value, previous_value) {
-		max_value = previous_value
-	}
+	return self.Merge(scope, state, &_ExtremeState{value: arg.Items, seen: true})
+}
 
-	scope.SetContext(GetID(self), max_value)
+func (self _MaxFunction) Result(scope *Scope, state Any) Any {
+	return state.(*_ExtremeState).value
+}
 
-	return max_value
+func (self _MaxFunction) Merge(scope *Scope, a Any, b Any) Any {
+	a_state := a.(*_ExtremeState)
+	b_state := b.(*_ExtremeState)
+	if !a_state.seen || (b_state.seen && !scope.Lt(b_state.value, a_state.value)) {
+		return b_state
+	}
+	return a_state
 }
 
 type _EnumerateFunction struct{}
 
 func (self _EnumerateFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
 	return &FunctionInfo{
-		Name:        "enumerate",
-		Doc:         "Collect all the items in each group by bin.",
-		ArgType:     type_map.AddType(scope, _CountFunctionArgs{}),
-		IsAggregate: true,
+		Name:    "enumerate",
+		Doc:     "Collect all the items in each group by bin.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
 	}
 }
 
-func (self _EnumerateFunction) Call(
+func (self _EnumerateFunction) Init(scope *Scope) Any {
+	return []Any{}
+}
+
+func (self _EnumerateFunction) Accumulate(
 	ctx context.Context,
 	scope *Scope,
+	state Any,
 	args *ordereddict.Dict) Any {
 	arg := &_CountFunctionArgs{}
 	err := ExtractArgs(scope, args, arg)
 	if err != nil {
-		scope.Log("enumerate: %s", err.Error())
+		reportArgError(scope, "enumerate", err)
+		return state
+	}
+
+	return append(state.([]Any), arg.Items)
+}
+
+func (self _EnumerateFunction) Result(scope *Scope, state Any) Any {
+	return state
+}
+
+func (self _EnumerateFunction) Merge(scope *Scope, a Any, b Any) Any {
+	return append(a.([]Any), b.([]Any)...)
+}
+
+type _SumFunction struct{}
+
+func (self _SumFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "sum",
+		Doc:     "Adds up the items in the aggregate.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
+	}
+}
+
+func (self _SumFunction) Init(scope *Scope) Any {
+	return Null{}
+}
+
+func (self _SumFunction) Accumulate(
+	ctx context.Context,
+	scope *Scope,
+	state Any,
+	args *ordereddict.Dict) Any {
+	arg := &_CountFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		reportArgError(scope, "sum", err)
+		return state
+	}
+
+	return self.Merge(scope, state, arg.Items)
+}
+
+func (self _SumFunction) Result(scope *Scope, state Any) Any {
+	return state
+}
+
+// Null items are skipped.
+func (self _SumFunction) Merge(scope *Scope, a Any, b Any) Any {
+	if is_null_obj(b) {
+		return a
+	}
+
+	if is_null_obj(a) {
+		return b
+	}
+
+	return scope.Add(a, b)
+}
+
+// Running statistics over the numeric items in an aggregate, kept
+// using Welford's algorithm so the variance is numerically stable.
+type _NumericStats struct {
+	count uint64
+	mean  float64
+	m2    float64
+}
+
+func (self *_NumericStats) add(value float64) {
+	self.count++
+	delta := value - self.mean
+	self.mean += delta / float64(self.count)
+	self.m2 += delta * (value - self.mean)
+}
+
+// Combine the stats of two sets of items (Chan et al's parallel
+// algorithm).
+func (self *_NumericStats) merge(other *_NumericStats) {
+	if other.count == 0 {
+		return
+	}
+
+	count := self.count + other.count
+	delta := other.mean - self.mean
+	self.m2 += other.m2 + delta*delta*
+		float64(self.count)*float64(other.count)/float64(count)
+	self.mean += delta * float64(other.count) / float64(count)
+	self.count = count
+}
+
+// The sample variance of the items.
+func (self *_NumericStats) variance() float64 {
+	if self.count < 2 {
+		return 0
+	}
+	return self.m2 / float64(self.count-1)
+}
+
+// Shared by the aggregates which work on numeric statistics. Items
+// which are not numbers are ignored.
+type _NumericStatsAggregate struct {
+	name string
+}
+
+func (self _NumericStatsAggregate) Init(scope *Scope) Any {
+	return &_NumericStats{}
+}
+
+func (self _NumericStatsAggregate) Accumulate(
+	ctx context.Context,
+	scope *Scope,
+	state Any,
+	args *ordereddict.Dict) Any {
+	arg := &_CountFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		reportArgError(scope, self.name, err)
+		return state
+	}
+
+	stats := state.(*_NumericStats)
+	value, ok := to_float(arg.Items)
+	if ok && !is_null_obj(arg.Items) {
+		stats.add(value)
+	}
+
+	return stats
+}
+
+func (self _NumericStatsAggregate) Merge(scope *Scope, a Any, b Any) Any {
+	a_stats := a.(*_NumericStats)
+	a_stats.merge(b.(*_NumericStats))
+	return a_stats
+}
+
+type _AvgFunction struct {
+	_NumericStatsAggregate
+}
+
+func (self _AvgFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "avg",
+		Doc:     "Finds the average of the numeric items in the aggregate.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
+	}
+}
+
+func (self _AvgFunction) Result(scope *Scope, state Any) Any {
+	stats := state.(*_NumericStats)
+	if stats.count == 0 {
 		return Null{}
 	}
 
-	var value Any
-	previous_value, ok := scope.GetContext(GetID(self)).([]Any)
-	if ok {
-		value = append(previous_value, arg.Items)
-	} else {
-		value = []Any{arg.Items}
+	return stats.mean
+}
+
+type _VarianceFunction struct {
+	_NumericStatsAggregate
+}
+
+func (self _VarianceFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "variance",
+		Doc:     "Finds the sample variance of the numeric items in the aggregate.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
+	}
+}
+
+func (self _VarianceFunction) Result(scope *Scope, state Any) Any {
+	stats := state.(*_NumericStats)
+	if stats.count == 0 {
+		return Null{}
+	}
+
+	return stats.variance()
+}
+
+type _StddevFunction struct {
+	_NumericStatsAggregate
+}
+
+func (self _StddevFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "stddev",
+		Doc:     "Finds the sample standard deviation of the numeric items in the aggregate.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
+	}
+}
+
+func (self _StddevFunction) Result(scope *Scope, state Any) Any {
+	stats := state.(*_NumericStats)
+	if stats.count == 0 {
+		return Null{}
 	}
 
-	scope.SetContext(GetID(self), value)
+	return math.Sqrt(stats.variance())
+}
+
+type _PercentileFunctionArgs struct {
+	Items Any     `vfilter:"required,field=items"`
+	P     float64 `vfilter:"required,field=p"`
+}
+
+// The numeric items seen so far, kept sorted.
+type _PercentileState struct {
+	items []float64
+	p     float64
+}
+
+type _PercentileFunction struct{}
+
+func (self _PercentileFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name: "percentile",
+		Doc: "Finds the p'th percentile (0 to 100) of the numeric items " +
+			"in the aggregate, interpolating between items.",
+		ArgType: type_map.AddType(scope, _PercentileFunctionArgs{}),
+	}
+}
+
+func (self _PercentileFunction) Init(scope *Scope) Any {
+	return &_PercentileState{}
+}
+
+func (self _PercentileFunction) Accumulate(
+	ctx context.Context,
+	scope *Scope,
+	state Any,
+	args *ordereddict.Dict) Any {
+	arg := &_PercentileFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		reportArgError(scope, "percentile", err)
+		return state
+	}
+
+	percentile := state.(*_PercentileState)
+	if arg.P < 0 || arg.P > 100 {
+		scope.ReportError(newQueryError(ArgumentError,
+			"percentile: p must be between 0 and 100, not %v", arg.P))
+		return percentile
+	}
+	percentile.p = arg.P
+
+	value, ok := to_float(arg.Items)
+	if ok && !is_null_obj(arg.Items) {
+		idx := sort.SearchFloat64s(percentile.items, value)
+		percentile.items = append(percentile.items, 0)
+		copy(percentile.items[idx+1:], percentile.items[idx:])
+		percentile.items[idx] = value
+	}
+
+	return percentile
+}
+
+func (self _PercentileFunction) Result(scope *Scope, state Any) Any {
+	percentile := state.(*_PercentileState)
+	items := percentile.items
+	if len(items) == 0 {
+		return Null{}
+	}
+
+	rank := percentile.p / 100 * float64(len(items)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return items[lower] + (items[upper]-items[lower])*(rank-float64(lower))
+}
+
+func (self _PercentileFunction) Merge(scope *Scope, a Any, b Any) Any {
+	a_state := a.(*_PercentileState)
+	b_state := b.(*_PercentileState)
+	if len(b_state.items) > 0 {
+		a_state.p = b_state.p
+	}
+
+	a_state.items = append(a_state.items, b_state.items...)
+	sort.Float64s(a_state.items)
+
+	return a_state
+}
+
+type _CountDistinctFunction struct{}
+
+func (self _CountDistinctFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "count_distinct",
+		Doc:     "Counts the distinct non null items.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
+	}
+}
+
+func (self _CountDistinctFunction) Init(scope *Scope) Any {
+	return make(map[string]bool)
+}
+
+func (self _CountDistinctFunction) Accumulate(
+	ctx context.Context,
+	scope *Scope,
+	state Any,
+	args *ordereddict.Dict) Any {
+	arg := &_CountFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		reportArgError(scope, "count_distinct", err)
+		return state
+	}
+
+	seen := state.(map[string]bool)
+	if !is_null_obj(arg.Items) {
+		seen[scope.Hash(arg.Items)] = true
+	}
+
+	return seen
+}
+
+func (self _CountDistinctFunction) Result(scope *Scope, state Any) Any {
+	return uint64(len(state.(map[string]bool)))
+}
+
+func (self _CountDistinctFunction) Merge(scope *Scope, a Any, b Any) Any {
+	seen := a.(map[string]bool)
+	for key := range b.(map[string]bool) {
+		seen[key] = true
+	}
+
+	return seen
+}
+
+// The state of first() and last(). The item may be nil so we track
+// whether one was seen separately.
+type _ItemState struct {
+	item Any
+	seen bool
+}
+
+type _FirstFunction struct{}
+
+func (self _FirstFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "first",
+		Doc:     "Finds the first item in the aggregate.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
+	}
+}
+
+func (self _FirstFunction) Init(scope *Scope) Any {
+	return &_ItemState{}
+}
+
+func (self _FirstFunction) Accumulate(
+	ctx context.Context,
+	scope *Scope,
+	state Any,
+	args *ordereddict.Dict) Any {
+	arg := &_CountFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		reportArgError(scope, "first", err)
+		return state
+	}
+
+	return self.Merge(scope, state, &_ItemState{item: arg.Items, seen: true})
+}
+
+func (self _FirstFunction) Result(scope *Scope, state Any) Any {
+	return state.(*_ItemState).item
+}
+
+func (self _FirstFunction) Merge(scope *Scope, a Any, b Any) Any {
+	if a.(*_ItemState).seen {
+		return a
+	}
+	return b
+}
+
+type _LastFunction struct{}
+
+func (self _LastFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "last",
+		Doc:     "Finds the last item in the aggregate.",
+		ArgType: type_map.AddType(scope, _CountFunctionArgs{}),
+	}
+}
+
+func (self _LastFunction) Init(scope *Scope) Any {
+	return &_ItemState{}
+}
+
+func (self _LastFunction) Accumulate(
+	ctx context.Context,
+	scope *Scope,
+	state Any,
+	args *ordereddict.Dict) Any {
+	arg := &_CountFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		reportArgError(scope, "last", err)
+		return state
+	}
+
+	return self.Merge(scope, state, &_ItemState{item: arg.Items, seen: true})
+}
+
+func (self _LastFunction) Result(scope *Scope, state Any) Any {
+	return state.(*_ItemState).item
+}
+
+func (self _LastFunction) Merge(scope *Scope, a Any, b Any) Any {
+	if b.(*_ItemState).seen {
+		return b
+	}
+	return a
+}
+
+type _HistogramFunctionArgs struct {
+	Items  Any     `vfilter:"required,field=items"`
+	Bucket float64 `vfilter:"optional,field=bucket"`
+}
+
+// A single bar in the histogram.
+type _HistogramBin struct {
+	key   string
+	value Any
+	count uint64
+}
+
+type _HistogramFunction struct{}
+
+func (self _HistogramFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name: "histogram",
+		Doc: "Counts how many times each item occurs in the aggregate. " +
+			"If bucket is given, numbers are counted in buckets of that width.",
+		ArgType: type_map.AddType(scope, _HistogramFunctionArgs{}),
+	}
+}
+
+func (self _HistogramFunction) Init(scope *Scope) Any {
+	return make(map[string]*_HistogramBin)
+}
+
+func (self _HistogramFunction) Accumulate(
+	ctx context.Context,
+	scope *Scope,
+	state Any,
+	args *ordereddict.Dict) Any {
+	arg := &_HistogramFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		reportArgError(scope, "histogram", err)
+		return state
+	}
+
+	bins := state.(map[string]*_HistogramBin)
+	if is_null_obj(arg.Items) {
+		return bins
+	}
+
+	value := arg.Items
+	if number, ok := to_float(value); ok && arg.Bucket > 0 {
+		value = math.Floor(number/arg.Bucket) * arg.Bucket
+	}
+
+	key := scope.Hash(value)
+	bin, pres := bins[key]
+	if !pres {
+		bin = &_HistogramBin{key: key, value: value}
+		bins[key] = bin
+	}
+	bin.count++
+
+	return bins
+}
+
+func (self _HistogramFunction) Result(scope *Scope, state Any) Any {
+	bins := state.(map[string]*_HistogramBin)
+
+	// Emit the bins sorted by their values. Values which do not
+	// compare (e.g. of different types) are ordered by their hash
+	// so the output is stable.
+	sorted_bins := make([]*_HistogramBin, 0, len(bins))
+	for _, bin := range bins {
+		sorted_bins = append(sorted_bins, bin)
+	}
+	sort.Slice(sorted_bins, func(i, j int) bool {
+		order := compareKeys(scope, []Any{sorted_bins[i].value},
+			[]Any{sorted_bins[j].value})
+		if order != 0 {
+			return order < 0
+		}
+		return sorted_bins[i].key < sorted_bins[j].key
+	})
+
+	result := ordereddict.NewDict()
+	for _, bin := range sorted_bins {
+		key, ok := to_string(bin.value)
+		if !ok {
+			key = fmt.Sprintf("%v", bin.value)
+		}
+		result.Set(key, bin.count)
+	}
+
+	return result
+}
+
+func (self _HistogramFunction) Merge(scope *Scope, a Any, b Any) Any {
+	a_bins := a.(map[string]*_HistogramBin)
+	for key, bin := range b.(map[string]*_HistogramBin) {
+		a_bin, pres := a_bins[key]
+		if !pres {
+			a_bins[key] = bin
+			continue
+		}
+		a_bin.count += bin.count
+	}
 
-	return value
+	return a_bins
 }
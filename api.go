@@ -3,10 +3,11 @@ package vfilter
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Velocidex/ordereddict"
+	"github.com/pkg/errors"
 )
 
 // A response from VQL queries.
@@ -97,34 +98,8 @@ func GetResponseChannel(
 					rows = append(rows, row)
 
 				} else {
-					new_row := ordereddict.NewDict()
-					for _, key := range *columns {
-						value, pres := scope.Associative(row, key)
-						if pres && !IsNil(value) {
-							var cell Any
-							switch t := value.(type) {
-							case Null:
-								cell = nil
-
-							case fmt.Stringer:
-								cell = value
-
-							case []byte:
-								cell = string(t)
-
-							case StoredQuery:
-								cell = Materialize(
-									ctx, scope, t)
-
-							default:
-								// Pass directly to
-								// Json Marshal
-								cell = value
-							}
-							new_row.Set(key, cell)
-						}
-					}
-					rows = append(rows, new_row)
+					rows = append(rows, normalizeRow(
+						ctx, scope, row, *columns))
 				}
 
 				// Throttle if needed.
@@ -136,6 +111,211 @@ func GetResponseChannel(
 	return result_chan
 }
 
+// A paginated result set. The query is evaluated once in the
+// background and each part is retained, so callers may fetch any part
+// (e.g. when the user pages back or reconnects) without re-running
+// the query.
+//
+// The caller owns the PaginatedQuery and must call Close() once the
+// results are no longer needed. This stops the query and releases the
+// retained parts. By default all parts are retained until then, so
+// for long running queries SetMaxParts() should be used to only keep
+// the most recent parts.
+type PaginatedQuery struct {
+	mu sync.Mutex
+
+	// The retained parts, starting with part number first.
+	parts     []*VFilterJsonResult
+	first     int
+	max_parts int
+
+	done   bool
+	cancel func()
+
+	// Closed and replaced whenever a new part arrives or the
+	// query completes.
+	changed chan bool
+}
+
+// Start evaluating the query. Parts are split as for
+// GetResponseChannel(). The query runs until it completes, ctx is
+// done or Close() is called.
+func NewPaginatedQuery(
+	vql *VQL,
+	ctx context.Context,
+	scope *Scope,
+	maxrows int,
+	max_wait int) *PaginatedQuery {
+	sub_ctx, cancel := context.WithCancel(ctx)
+	result := &PaginatedQuery{
+		cancel:  cancel,
+		changed: make(chan bool),
+	}
+
+	go func() {
+		defer cancel()
+
+		for part := range GetResponseChannel(
+			vql, sub_ctx, scope, maxrows, max_wait) {
+			result.mu.Lock()
+			if !result.done {
+				result.parts = append(result.parts, part)
+				result.trim()
+				result.notify()
+			}
+			result.mu.Unlock()
+		}
+
+		result.mu.Lock()
+		if !result.done {
+			result.done = true
+			result.notify()
+		}
+		result.mu.Unlock()
+	}()
+
+	return result
+}
+
+// Only retain the last max_parts parts. GetPart() returns
+// ErrPartExpired for earlier parts. A limit of 0 retains all parts.
+func (self *PaginatedQuery) SetMaxParts(max_parts int) *PaginatedQuery {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.max_parts = max_parts
+	self.trim()
+	return self
+}
+
+// Stop the query and release all parts. Callers waiting for a part
+// receive no more parts.
+func (self *PaginatedQuery) Close() {
+	self.cancel()
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.first += len(self.parts)
+	self.parts = nil
+	if !self.done {
+		self.done = true
+		self.notify()
+	}
+}
+
+// Must be called with the lock held.
+func (self *PaginatedQuery) trim() {
+	for self.max_parts > 0 && len(self.parts) > self.max_parts {
+		// Clear the reference so the part can be collected.
+		self.parts[0] = nil
+		self.parts = self.parts[1:]
+		self.first++
+	}
+}
+
+// Must be called with the lock held.
+func (self *PaginatedQuery) notify() {
+	close(self.changed)
+	self.changed = make(chan bool)
+}
+
+var (
+	// Returned by GetPart() for parts which were dropped because
+	// of SetMaxParts() or Close().
+	ErrPartExpired = errors.New("Part is no longer retained.")
+
+	// Returned by GetPart() for parts after the last part of a
+	// completed query.
+	ErrNoSuchPart = errors.New("Query completed without producing the part.")
+)
+
+// Get the specified part, waiting for the query to produce it if
+// necessary. Returns ErrPartExpired if the part is no longer
+// retained, ErrNoSuchPart if the query completed with fewer parts or
+// the ctx error if ctx is done first.
+func (self *PaginatedQuery) GetPart(
+	ctx context.Context, part int) (*VFilterJsonResult, error) {
+	for {
+		self.mu.Lock()
+		idx := part - self.first
+		if idx < 0 {
+			self.mu.Unlock()
+			return nil, ErrPartExpired
+		}
+
+		if idx < len(self.parts) {
+			result := self.parts[idx]
+			self.mu.Unlock()
+			return result, nil
+		}
+
+		if self.done {
+			self.mu.Unlock()
+			return nil, ErrNoSuchPart
+		}
+
+		changed := self.changed
+		self.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Returns the number of the first part which is still retained.
+func (self *PaginatedQuery) FirstPart() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.first
+}
+
+// Returns a channel over which the parts are sent, starting with
+// start_part. This allows a client to resume reading a result set. A
+// reader which falls behind the retained parts (see SetMaxParts())
+// skips ahead to the first retained part, so callers should check
+// VFilterJsonResult.Part for gaps.
+func (self *PaginatedQuery) GetResponseChannel(
+	ctx context.Context, start_part int) <-chan *VFilterJsonResult {
+	result_chan := make(chan *VFilterJsonResult)
+
+	go func() {
+		defer close(result_chan)
+
+		for part := start_part; ; part++ {
+			result, err := self.GetPart(ctx, part)
+			if err == ErrPartExpired {
+				self.mu.Lock()
+				closed := self.done && len(self.parts) == 0
+				first := self.first
+				self.mu.Unlock()
+
+				if closed {
+					return
+				}
+				part = first - 1
+				continue
+			}
+
+			if err != nil {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case result_chan <- result:
+			}
+		}
+	}()
+
+	return result_chan
+}
+
 // A convenience function to generate JSON output from a VQL query.
 func OutputJSON(vql *VQL, ctx context.Context, scope *Scope) ([]byte, error) {
 	output_chan := vql.Eval(ctx, scope)
@@ -156,33 +336,7 @@ func OutputJSON(vql *VQL, ctx context.Context, scope *Scope) ([]byte, error) {
 			result = append(result, row)
 
 		} else {
-			new_row := ordereddict.NewDict()
-			for _, key := range *columns {
-				value, pres := scope.Associative(row, key)
-				if pres && !IsNil(value) {
-					var cell Any
-					switch t := value.(type) {
-					case Null:
-						cell = nil
-
-					case fmt.Stringer:
-						cell = value
-
-					case []byte:
-						cell = string(t)
-
-					case StoredQuery:
-						cell = Materialize(ctx, scope, t)
-
-					default:
-						// Pass directly to
-						// Json Marshal
-						cell = value
-					}
-					new_row.Set(key, cell)
-				}
-			}
-			result = append(result, new_row)
+			result = append(result, normalizeRow(ctx, scope, row, *columns))
 		}
 		if throttle != nil {
 			<-throttle
@@ -192,3 +346,18 @@ func OutputJSON(vql *VQL, ctx context.Context, scope *Scope) ([]byte, error) {
 	s, err := json.MarshalIndent(result, "", " ")
 	return s, err
 }
+
+// Build an output row from the columns of the row. Missing and nil
+// cells are omitted.
+func normalizeRow(ctx context.Context, scope *Scope,
+	row Row, columns []string) *ordereddict.Dict {
+	result := ordereddict.NewDict()
+	for _, key := range columns {
+		value, pres := scope.Associative(row, key)
+		if pres && !IsNil(value) {
+			result.Set(key, scope.Marshal(ctx, value))
+		}
+	}
+
+	return result
+}
@@ -5,10 +5,11 @@ package vfilter
 import (
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/Velocidex/ordereddict"
-	errors "github.com/pkg/errors"
 )
 
 // Structs may tag fields with this name to control parsing.
@@ -31,6 +32,19 @@ const tagName = "vfilter"
 // We will raise an error if a required field is missing or has the
 // wrong type of args.
 
+// Args may also be passed by position (e.g. my_func("x", 2)). These
+// populate the tagged fields in the order they are declared, or the
+// fields with a "pos=N" tag if there are any. A field tagged with
+// "rest" receives any remaining positional args:
+
+// type JoinArgs struct {
+//    Sep   string `vfilter:"required,field=sep"`
+//    Items []vfilter.Any `vfilter:"optional,field=items,rest"`
+// }
+
+// An error is raised if a field is given both by position and by
+// name, or if there are more positional args than fields.
+
 // NOTE: In order for the field to be populated by this function, the
 // field must be exported (i.e. name begins with cap) and it must have
 // vfilter tags.
@@ -46,43 +60,26 @@ func ExtractArgs(scope *Scope, args *ordereddict.Dict, value interface{}) error
 		v = v.Elem()
 	}
 
+	err := mapPositionalArgs(scope, arg_map, v.Type())
+	if err != nil {
+		return err
+	}
+
 	for i := 0; i < v.NumField(); i++ {
 		// Get the field tag value
 		field_types_value := v.Type().Field(i)
-		tag := field_types_value.Tag.Get(tagName)
-
-		// Skip if tag is not defined or ignored
-		if tag == "" || tag == "-" {
+		field_name, directives, ok := parseArgTag(field_types_value)
+		if !ok {
 			continue
 		}
 
-		directives := strings.Split(tag, ",")
-		options := make(map[string]string)
-		for _, directive := range directives {
-			if strings.Contains(directive, "=") {
-				components := strings.Split(directive, "=")
-				if len(components) >= 2 {
-					options[components[0]] = components[1]
-				}
-			}
-
-		}
-		field_name, pres := options["field"]
-		if !pres {
-			field_name = field_types_value.Name
-		}
-
-		if field_name == "" {
-			panic("Fields can not be empty")
-		}
-
 		// Get the field. If it is not present but is
 		// required, it is an error.
 		arg, pres := arg_map[field_name]
 		if !pres {
 			if InString(&directives, "required") {
-				return errors.New(fmt.Sprintf(
-					"Field %s is required.", field_name))
+				return argError(scope, ArgumentError,
+					"Field %s is required.", field_name)
 			}
 
 			// Field is optional and not provided.
@@ -96,8 +93,8 @@ func ExtractArgs(scope *Scope, args *ordereddict.Dict, value interface{}) error
 		// the value output struct.
 		field_value := v.Field(field_types_value.Index[0])
 		if !field_value.IsValid() || !field_value.CanSet() {
-			return errors.New(fmt.Sprintf(
-				"Field %s is unsettable.", field_name))
+			return argError(scope, ArgumentError,
+				"Field %s is unsettable.", field_name)
 		}
 
 		// The plugin may specify the arg as being a LazyExpr,
@@ -120,15 +117,22 @@ func ExtractArgs(scope *Scope, args *ordereddict.Dict, value interface{}) error
 		if field_types_value.Type.String() == "vfilter.StoredQuery" {
 			stored_query, ok := arg.(StoredQuery)
 			if !ok {
-				return errors.New(fmt.Sprintf(
+				return argError(scope, TypeError,
 					"Field %s should be a query.",
-					field_types_value.Name))
+					field_types_value.Name)
 			}
 
 			field_value.Set(reflect.ValueOf(stored_query))
 			continue
 		}
 
+		// A list of Any (e.g. a rest field) - just reduce the
+		// members.
+		if field_types_value.Type.String() == "[]vfilter.Any" {
+			field_value.Set(reflect.ValueOf(_ExtractAnyArray(arg)))
+			continue
+		}
+
 		// The target field is an Any type - just assign it directly.
 		if field_types_value.Type.String() == "vfilter.Any" {
 			// Evaluate the expression.
@@ -178,43 +182,45 @@ func ExtractArgs(scope *Scope, args *ordereddict.Dict, value interface{}) error
 			if ok {
 				field_value.Set(reflect.ValueOf(a))
 			} else {
-				return errors.New(fmt.Sprintf(
+				return argError(scope, TypeError,
 					"Field %s should be a float.",
-					field_types_value.Name))
+					field_types_value.Name)
 			}
 		case reflect.Int64:
 			a, ok := to_int64(arg)
 			if ok {
 				field_value.Set(reflect.ValueOf(a))
 			} else {
-				return errors.New(fmt.Sprintf(
+				return argError(scope, TypeError,
 					"Field %s should be an int.",
-					field_types_value.Name))
+					field_types_value.Name)
 			}
 		case reflect.Uint64:
 			a, ok := to_int64(arg)
 			if ok {
 				field_value.Set(reflect.ValueOf(uint64(a)))
 			} else {
-				return errors.New(fmt.Sprintf(
+				return argError(scope, TypeError,
 					"Field %s should be an int.",
-					field_types_value.Name))
+					field_types_value.Name)
 			}
 		case reflect.Int:
 			a, ok := to_int64(arg)
 			if ok {
 				field_value.Set(reflect.ValueOf(int(a)))
 			} else {
-				return errors.New(fmt.Sprintf(
+				return argError(scope, TypeError,
 					"Field %s should be an int.",
-					field_types_value.Name))
+					field_types_value.Name)
 			}
 		default:
 			if InString(&directives, "required") {
-				return errors.New(fmt.Sprintf(
-					"Field %s is required.", field_name))
+				return argError(scope, ArgumentError,
+					"Field %s is required.", field_name)
 			}
 			scope.Log("Unsupported type for field %v", field_name)
+			scope.recordError(newQueryError(TypeError,
+				"Unsupported type for field %v", field_name))
 		}
 	}
 
@@ -223,12 +229,225 @@ func ExtractArgs(scope *Scope, args *ordereddict.Dict, value interface{}) error
 	if len(arg_map) != 0 {
 		for k, _ := range arg_map {
 			scope.Log("Extra unrecognized arg: %s", k)
+			scope.recordError(newQueryError(ArgumentError,
+				"Extra unrecognized arg: %s", k))
 		}
 	}
 
 	return nil
 }
 
+// Parse the vfilter tag of a struct field. Returns the name of the
+// arg which populates the field and the tag's directives. Returns
+// false if the field is not tagged.
+func parseArgTag(field reflect.StructField) (string, []string, bool) {
+	tag := field.Tag.Get(tagName)
+
+	// Skip if tag is not defined or ignored
+	if tag == "" || tag == "-" {
+		return "", nil, false
+	}
+
+	directives := strings.Split(tag, ",")
+	field_name, pres := argTagOption(directives, "field")
+	if !pres {
+		field_name = field.Name
+	}
+
+	if field_name == "" {
+		panic("Fields can not be empty")
+	}
+
+	return field_name, directives, true
+}
+
+func argTagOption(directives []string, name string) (string, bool) {
+	for _, directive := range directives {
+		components := strings.SplitN(directive, "=", 2)
+		if len(components) == 2 && components[0] == name {
+			return components[1], true
+		}
+	}
+
+	return "", false
+}
+
+// Positional args are passed to functions and plugins with these
+// names.
+func positionalArg(idx int) string {
+	return "$" + strconv.Itoa(idx)
+}
+
+// Returns true if the arg name is that of a positional arg.
+func isPositionalArg(name string) bool {
+	if !strings.HasPrefix(name, "$") {
+		return false
+	}
+	_, err := strconv.Atoi(name[1:])
+	return err == nil
+}
+
+// The fields of an args struct which may be populated by position.
+type _PositionalFields struct {
+	// The tagged fields in the order they are declared.
+	positional []string
+
+	// The fields with a "pos=N" tag keyed by N.
+	explicit map[int]string
+
+	// The field tagged with "rest" if any.
+	rest string
+}
+
+var (
+	positional_fields_mu    sync.Mutex
+	positional_fields_cache = make(map[reflect.Type]*_PositionalFields)
+)
+
+// Parse the tags of the struct type to find the fields populated by
+// position. The result is cached since args are extracted on every
+// call.
+func getPositionalFields(struct_type reflect.Type) *_PositionalFields {
+	positional_fields_mu.Lock()
+	defer positional_fields_mu.Unlock()
+
+	result, pres := positional_fields_cache[struct_type]
+	if pres {
+		return result
+	}
+
+	result = &_PositionalFields{explicit: make(map[int]string)}
+	for i := 0; i < struct_type.NumField(); i++ {
+		field_name, directives, ok := parseArgTag(struct_type.Field(i))
+		if !ok {
+			continue
+		}
+
+		if InString(&directives, "rest") {
+			result.rest = field_name
+			continue
+		}
+
+		result.positional = append(result.positional, field_name)
+
+		pos, pres := argTagOption(directives, "pos")
+		if pres {
+			idx, err := strconv.Atoi(pos)
+			if err != nil || idx < 0 {
+				panic("Invalid pos tag on field " + field_name)
+			}
+			result.explicit[idx] = field_name
+		}
+	}
+
+	positional_fields_cache[struct_type] = result
+	return result
+}
+
+// Replace positional args in arg_map with the names of the fields
+// they populate. By default positional args populate the tagged
+// fields in the order they are declared. If any field has a "pos=N"
+// tag, only fields with such a tag may be passed by position. A field
+// tagged with "rest" receives any remaining positional args as a
+// list.
+func mapPositionalArgs(scope *Scope,
+	arg_map map[string]interface{}, struct_type reflect.Type) error {
+	fields := getPositionalFields(struct_type)
+	positional, explicit, rest := fields.positional, fields.explicit, fields.rest
+
+	var rest_args []Any
+	for idx := 0; ; idx++ {
+		arg, pres := arg_map[positionalArg(idx)]
+		if !pres {
+			break
+		}
+		delete(arg_map, positionalArg(idx))
+
+		field_name := ""
+		if len(explicit) > 0 {
+			field_name = explicit[idx]
+		} else if idx < len(positional) {
+			field_name = positional[idx]
+		}
+
+		if field_name == "" {
+			if rest == "" {
+				return argError(scope, ArgumentError,
+					"Unexpected positional arg %d.", idx)
+			}
+
+			lazy_arg, ok := arg.(LazyExpr)
+			if ok {
+				arg = lazy_arg.Reduce()
+			}
+			rest_args = append(rest_args, arg)
+			continue
+		}
+
+		_, pres = arg_map[field_name]
+		if pres {
+			return argError(scope, ArgumentError,
+				"Field %s is given both by position and by name.",
+				field_name)
+		}
+		arg_map[field_name] = arg
+	}
+
+	if len(rest_args) > 0 {
+		_, pres := arg_map[rest]
+		if pres {
+			return argError(scope, ArgumentError,
+				"Field %s is given both by position and by name.", rest)
+		}
+		arg_map[rest] = rest_args
+	}
+
+	return nil
+}
+
+// Record the error in the scope and return it to the caller. The
+// caller is expected to log the error.
+func argError(scope *Scope, error_type ErrorType,
+	format string, a ...interface{}) error {
+	err := newQueryError(error_type, format, a...)
+	scope.recordError(err)
+	return err
+}
+
+// Report an error returned by ExtractArgs to the named function or
+// plugin. ExtractArgs already recorded it so it is not collected
+// again.
+func reportArgError(scope *Scope, name string, err error) {
+	query_err, ok := err.(*QueryError)
+	if !ok {
+		query_err = newQueryError(ArgumentError, "%v", err)
+	}
+
+	scope.Log("%s: %s", name, query_err.Message)
+	scope.recordError(query_err)
+}
+
+// Coerce the arg into a list of values, reducing any lazy members.
+func _ExtractAnyArray(arg Any) []Any {
+	var result []Any
+
+	if !is_array(arg) {
+		return append(result, arg)
+	}
+
+	slice := reflect.ValueOf(arg)
+	for i := 0; i < slice.Len(); i++ {
+		value := slice.Index(i).Interface()
+		lazy_value, ok := value.(LazyExpr)
+		if ok {
+			value = lazy_value.Reduce()
+		}
+		result = append(result, value)
+	}
+
+	return result
+}
+
 // Try to retrieve an arg name from the Dict of args. Coerce the arg
 // into something resembling a list of strings.
 func _ExtractStringArray(scope *Scope, arg Any) ([]string, bool) {
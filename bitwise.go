@@ -0,0 +1,334 @@
+package vfilter
+
+// Modulo, bitwise and shift protocols.
+
+// These operators follow Go's precedence: % & << >> bind like * and
+// /, while | and ^ bind like + and -. The default bitwise
+// implementations work on integers (and bools, which are treated as 0
+// or 1) as well as floats holding whole numbers, since numbers often
+// arrive as floats (e.g. from JSON). Modulo also works on any float.
+// Like division, modulo by zero is trapped and returns false, as are
+// negative shift counts.
+
+import (
+	"math"
+)
+
+// Can a be used as an operand to the bitwise operators?
+func is_integral(a Any) bool {
+	if is_int(a) {
+		return true
+	}
+
+	value, ok := to_float(a)
+	return ok && value == math.Trunc(value) &&
+		value >= math.MinInt64 && value < math.MaxInt64
+}
+
+// Modulo protocol
+type ModProtocol interface {
+	Applicable(a Any, b Any) bool
+	Mod(scope *Scope, a Any, b Any) Any
+}
+
+type _ModDispatcher struct {
+	impl []ModProtocol
+}
+
+func (self _ModDispatcher) Mod(scope *Scope, a Any, b Any) Any {
+	for _, impl := range self.impl {
+		if impl.Applicable(a, b) {
+			return impl.Mod(scope, a, b)
+		}
+	}
+	scope.Trace("Protocol Mod not found for %v (%T) and %v (%T)",
+		a, a, b, b)
+
+	return Null{}
+}
+
+func (self *_ModDispatcher) AddImpl(elements ...ModProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+type _ModInt struct{}
+
+func (self _ModInt) Applicable(a Any, b Any) bool {
+	return is_int(a) && is_int(b)
+}
+
+func (self _ModInt) Mod(scope *Scope, a Any, b Any) Any {
+	a_val, _ := to_int64(a)
+	b_val, _ := to_int64(b)
+	if b_val == 0 {
+		return false
+	}
+
+	return a_val % b_val
+}
+
+type _NumericMod struct{}
+
+func (self _NumericMod) Applicable(a Any, b Any) bool {
+	_, a_ok := to_float(a)
+	_, b_ok := to_float(b)
+	return a_ok && b_ok
+}
+
+func (self _NumericMod) Mod(scope *Scope, a Any, b Any) Any {
+	a_val, _ := to_float(a)
+	b_val, _ := to_float(b)
+	if b_val == 0 {
+		return false
+	}
+
+	return math.Mod(a_val, b_val)
+}
+
+// Bitwise AND protocol
+type BitwiseAndProtocol interface {
+	Applicable(a Any, b Any) bool
+	BitwiseAnd(scope *Scope, a Any, b Any) Any
+}
+
+type _BitwiseAndDispatcher struct {
+	impl []BitwiseAndProtocol
+}
+
+func (self _BitwiseAndDispatcher) BitwiseAnd(scope *Scope, a Any, b Any) Any {
+	for _, impl := range self.impl {
+		if impl.Applicable(a, b) {
+			return impl.BitwiseAnd(scope, a, b)
+		}
+	}
+	scope.Trace("Protocol BitwiseAnd not found for %v (%T) and %v (%T)",
+		a, a, b, b)
+
+	return Null{}
+}
+
+func (self *_BitwiseAndDispatcher) AddImpl(elements ...BitwiseAndProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+type _BitwiseAndInt struct{}
+
+func (self _BitwiseAndInt) Applicable(a Any, b Any) bool {
+	return is_integral(a) && is_integral(b)
+}
+
+func (self _BitwiseAndInt) BitwiseAnd(scope *Scope, a Any, b Any) Any {
+	a_val, _ := to_int64(a)
+	b_val, _ := to_int64(b)
+	return a_val & b_val
+}
+
+// Bitwise OR protocol
+type BitwiseOrProtocol interface {
+	Applicable(a Any, b Any) bool
+	BitwiseOr(scope *Scope, a Any, b Any) Any
+}
+
+type _BitwiseOrDispatcher struct {
+	impl []BitwiseOrProtocol
+}
+
+func (self _BitwiseOrDispatcher) BitwiseOr(scope *Scope, a Any, b Any) Any {
+	for _, impl := range self.impl {
+		if impl.Applicable(a, b) {
+			return impl.BitwiseOr(scope, a, b)
+		}
+	}
+	scope.Trace("Protocol BitwiseOr not found for %v (%T) and %v (%T)",
+		a, a, b, b)
+
+	return Null{}
+}
+
+func (self *_BitwiseOrDispatcher) AddImpl(elements ...BitwiseOrProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+type _BitwiseOrInt struct{}
+
+func (self _BitwiseOrInt) Applicable(a Any, b Any) bool {
+	return is_integral(a) && is_integral(b)
+}
+
+func (self _BitwiseOrInt) BitwiseOr(scope *Scope, a Any, b Any) Any {
+	a_val, _ := to_int64(a)
+	b_val, _ := to_int64(b)
+	return a_val | b_val
+}
+
+// Bitwise XOR protocol
+type BitwiseXorProtocol interface {
+	Applicable(a Any, b Any) bool
+	BitwiseXor(scope *Scope, a Any, b Any) Any
+}
+
+type _BitwiseXorDispatcher struct {
+	impl []BitwiseXorProtocol
+}
+
+func (self _BitwiseXorDispatcher) BitwiseXor(scope *Scope, a Any, b Any) Any {
+	for _, impl := range self.impl {
+		if impl.Applicable(a, b) {
+			return impl.BitwiseXor(scope, a, b)
+		}
+	}
+	scope.Trace("Protocol BitwiseXor not found for %v (%T) and %v (%T)",
+		a, a, b, b)
+
+	return Null{}
+}
+
+func (self *_BitwiseXorDispatcher) AddImpl(elements ...BitwiseXorProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+type _BitwiseXorInt struct{}
+
+func (self _BitwiseXorInt) Applicable(a Any, b Any) bool {
+	return is_integral(a) && is_integral(b)
+}
+
+func (self _BitwiseXorInt) BitwiseXor(scope *Scope, a Any, b Any) Any {
+	a_val, _ := to_int64(a)
+	b_val, _ := to_int64(b)
+	return a_val ^ b_val
+}
+
+// Left shift protocol
+type LeftShiftProtocol interface {
+	Applicable(a Any, b Any) bool
+	LeftShift(scope *Scope, a Any, b Any) Any
+}
+
+type _LeftShiftDispatcher struct {
+	impl []LeftShiftProtocol
+}
+
+func (self _LeftShiftDispatcher) LeftShift(scope *Scope, a Any, b Any) Any {
+	for _, impl := range self.impl {
+		if impl.Applicable(a, b) {
+			return impl.LeftShift(scope, a, b)
+		}
+	}
+	scope.Trace("Protocol LeftShift not found for %v (%T) and %v (%T)",
+		a, a, b, b)
+
+	return Null{}
+}
+
+func (self *_LeftShiftDispatcher) AddImpl(elements ...LeftShiftProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+type _LeftShiftInt struct{}
+
+func (self _LeftShiftInt) Applicable(a Any, b Any) bool {
+	return is_integral(a) && is_integral(b)
+}
+
+func (self _LeftShiftInt) LeftShift(scope *Scope, a Any, b Any) Any {
+	a_val, _ := to_int64(a)
+	b_val, _ := to_int64(b)
+	if b_val < 0 {
+		return false
+	}
+
+	return a_val << uint64(b_val)
+}
+
+// Right shift protocol
+type RightShiftProtocol interface {
+	Applicable(a Any, b Any) bool
+	RightShift(scope *Scope, a Any, b Any) Any
+}
+
+type _RightShiftDispatcher struct {
+	impl []RightShiftProtocol
+}
+
+func (self _RightShiftDispatcher) RightShift(scope *Scope, a Any, b Any) Any {
+	for _, impl := range self.impl {
+		if impl.Applicable(a, b) {
+			return impl.RightShift(scope, a, b)
+		}
+	}
+	scope.Trace("Protocol RightShift not found for %v (%T) and %v (%T)",
+		a, a, b, b)
+
+	return Null{}
+}
+
+func (self *_RightShiftDispatcher) AddImpl(elements ...RightShiftProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+type _RightShiftInt struct{}
+
+func (self _RightShiftInt) Applicable(a Any, b Any) bool {
+	return is_integral(a) && is_integral(b)
+}
+
+func (self _RightShiftInt) RightShift(scope *Scope, a Any, b Any) Any {
+	a_val, _ := to_int64(a)
+	b_val, _ := to_int64(b)
+	if b_val < 0 {
+		return false
+	}
+
+	return a_val >> uint64(b_val)
+}
+
+// Bitwise NOT protocol (unary ~)
+type BitwiseNotProtocol interface {
+	Applicable(a Any) bool
+	BitwiseNot(scope *Scope, a Any) Any
+}
+
+type _BitwiseNotDispatcher struct {
+	impl []BitwiseNotProtocol
+}
+
+func (self _BitwiseNotDispatcher) BitwiseNot(scope *Scope, a Any) Any {
+	for _, impl := range self.impl {
+		if impl.Applicable(a) {
+			return impl.BitwiseNot(scope, a)
+		}
+	}
+	scope.Trace("Protocol BitwiseNot not found for %v (%T)", a, a)
+
+	return Null{}
+}
+
+func (self *_BitwiseNotDispatcher) AddImpl(elements ...BitwiseNotProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+type _BitwiseNotInt struct{}
+
+func (self _BitwiseNotInt) Applicable(a Any) bool {
+	return is_integral(a)
+}
+
+func (self _BitwiseNotInt) BitwiseNot(scope *Scope, a Any) Any {
+	a_val, _ := to_int64(a)
+	return ^a_val
+}
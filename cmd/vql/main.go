@@ -0,0 +1,70 @@
+// A command line tool for running VQL queries.
+
+// Running vql without a command starts an interactive shell:
+
+// $ vql
+// vql> LET X = SELECT * FROM parse_csv(data=read_file(filename="sales.csv"));
+// vql> SELECT Region, sum(items=Amount) AS Total FROM X GROUP BY Region;
+// Region  Total
+// ------  -----
+// North   1200
+// South   650
+
+// Scripts can also be run in batch, see run.go.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	app = kingpin.New("vql", "Run VQL queries.")
+
+	repl_command = app.Command("repl", "Start an interactive VQL shell.").Default()
+	repl_format  = repl_command.Flag("format", "The initial output format.").
+			Default("table").String()
+	repl_history = repl_command.Flag("history", "The file to keep history in.").
+			Default(defaultHistoryFile()).String()
+
+	run_command = app.Command("run", "Run a VQL script.")
+	run_script  = run_command.Arg("script", "The VQL script to run.").
+			Required().ExistingFile()
+	run_inputs = run_command.Flag("input",
+		"An input file as NAME=PATH or PATH. May be given more than once.").
+		Short('i').Strings()
+	run_format = run_command.Flag("format", "The output format.").
+			Default("jsonl").String()
+	run_output = run_command.Flag("output", "Write the results to this file.").
+			Short('o').String()
+	run_strict = run_command.Flag("strict", "Stop at the first query error.").Bool()
+)
+
+func main() {
+	app.HelpFlag.Short('h')
+
+	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	case repl_command.FullCommand():
+		err := runRepl(*repl_format, *repl_history)
+		kingpin.FatalIfError(err, "repl")
+
+	case run_command.FullCommand():
+		out := os.Stdout
+		if *run_output != "" {
+			fd, err := os.Create(*run_output)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(exit_failed)
+			}
+			out = fd
+		}
+
+		code := runScript(*run_script, *run_inputs, *run_format,
+			*run_strict, out)
+		out.Close()
+		os.Exit(code)
+	}
+}
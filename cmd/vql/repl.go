@@ -0,0 +1,483 @@
+package main
+
+// The interactive shell.
+
+// A statement may span several lines. The shell keeps reading lines
+// until one ends with ";" or is empty, and then runs everything typed
+// so far (reporting the error if it does not parse). This allows a
+// WHERE or ORDER BY clause to be added on the next line of a query
+// which would already parse without it.
+
+// All statements share the same scope so LET definitions remain
+// available to later statements. Lines starting with "." are meta
+// commands (see .help). A statement from the history may be recalled
+// with .recall and extended on the following lines before running it.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/vfilter"
+)
+
+const (
+	prompt              = "vql> "
+	continuation_prompt = "...> "
+
+	// Only this many statements are kept in the history file.
+	max_history = 1000
+)
+
+type _Repl struct {
+	scope  *vfilter.Scope
+	format string
+	out    io.Writer
+
+	history      []string
+	history_file string
+
+	// Set by .recall to the statement to continue editing.
+	recalled string
+
+	// Cancels the running statement on interrupt.
+	mu     sync.Mutex
+	cancel func()
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".vql_history")
+}
+
+func runRepl(format string, history_file string) error {
+	_, err := vfilter.NewEncoder(format, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	self := &_Repl{
+		scope:        makeScope(),
+		format:       format,
+		out:          os.Stdout,
+		history_file: history_file,
+	}
+	self.loadHistory()
+	self.handleInterrupts()
+
+	fmt.Fprintln(self.out, "Enter .help for help.")
+	return self.loop(bufio.NewReader(os.Stdin))
+}
+
+func (self *_Repl) loop(in *bufio.Reader) error {
+	pending := ""
+	for {
+		if pending == "" {
+			fmt.Fprint(self.out, prompt)
+		} else {
+			fmt.Fprint(self.out, continuation_prompt)
+		}
+
+		line, err := in.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if err == io.EOF && line == "" {
+			fmt.Fprintln(self.out)
+			if pending != "" {
+				self.run(pending)
+			}
+			return nil
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if pending == "" && strings.HasPrefix(trimmed, ".") {
+			if !self.metaCommand(trimmed) {
+				return nil
+			}
+			pending, self.recalled = self.recalled, ""
+			continue
+		}
+
+		if pending == "" && trimmed == "" {
+			continue
+		}
+
+		// An empty line runs what we have so far.
+		if trimmed == "" {
+			self.run(pending)
+			pending = ""
+			continue
+		}
+
+		pending += line
+		if strings.HasSuffix(trimmed, ";") {
+			self.run(pending)
+			pending = ""
+		}
+	}
+}
+
+// Run all the statements in the text, writing the output of each
+// query in the current format.
+func (self *_Repl) run(text string) {
+	text = strings.TrimSpace(text)
+	self.addHistory(text)
+
+	statements, err := vfilter.ParseMultiVQL(text)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Syntax error: %v\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	self.mu.Lock()
+	self.cancel = cancel
+	self.mu.Unlock()
+
+	defer func() {
+		self.mu.Lock()
+		self.cancel = nil
+		self.mu.Unlock()
+	}()
+
+	for _, statement := range statements {
+		// LET statements produce no rows.
+		if statement.VQL.Let != "" {
+			for range statement.VQL.Eval(ctx, self.scope) {
+			}
+			continue
+		}
+
+		encoder, _ := vfilter.NewEncoder(self.format, self.out)
+		err := vfilter.Encode(statement.VQL, ctx, self.scope, encoder)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return
+		}
+
+		if ctx.Err() != nil {
+			fmt.Fprintln(os.Stderr, "Interrupted.")
+			return
+		}
+	}
+}
+
+// Interrupting a running statement cancels it. Otherwise the shell
+// exits.
+func (self *_Repl) handleInterrupts() {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+
+	go func() {
+		for range interrupts {
+			self.mu.Lock()
+			cancel := self.cancel
+			self.mu.Unlock()
+
+			if cancel == nil {
+				fmt.Fprintln(self.out)
+				os.Exit(130)
+			}
+			cancel()
+		}
+	}()
+}
+
+// Returns false if the shell should exit.
+func (self *_Repl) metaCommand(line string) bool {
+	fields := strings.Fields(line)
+	command, args := fields[0], fields[1:]
+
+	switch command {
+	case ".quit", ".exit":
+		return false
+
+	case ".help":
+		fmt.Fprint(self.out, `.describe NAME  Describe a plugin or function.
+.functions      List the functions.
+.plugins        List the plugins.
+.mode [FORMAT]  Show or set the output format.
+.history        Show the statements entered so far.
+.recall N       Recall statement N from the history. Enter an empty
+                line to run it or continue it on the next lines.
+.quit           Exit the shell.
+`)
+
+	case ".plugins":
+		self.listPlugins()
+
+	case ".functions":
+		self.listFunctions()
+
+	case ".describe":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: .describe NAME")
+			break
+		}
+		self.describe(args[0])
+
+	case ".mode":
+		if len(args) == 0 {
+			fmt.Fprintf(self.out, "Output format is %v. Available formats: %v\n",
+				self.format, strings.Join(vfilter.EncoderFormats(), ", "))
+			break
+		}
+
+		_, err := vfilter.NewEncoder(args[0], self.out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			break
+		}
+		self.format = args[0]
+
+	case ".history":
+		for idx, item := range self.history {
+			fmt.Fprintf(self.out, "%5d  %v\n", idx+1,
+				strings.Replace(item, "\n", "\n       ", -1))
+		}
+
+	case ".recall":
+		var idx int
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: .recall N")
+			break
+		}
+
+		_, err := fmt.Sscanf(args[0], "%d", &idx)
+		if err != nil || idx < 1 || idx > len(self.history) {
+			fmt.Fprintf(os.Stderr, "No statement %v in the history.\n", args[0])
+			break
+		}
+
+		self.recalled = self.history[idx-1] + "\n"
+		fmt.Fprint(self.out, self.recalled)
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %v. Enter .help for help.\n",
+			command)
+	}
+
+	return true
+}
+
+func (self *_Repl) listPlugins() {
+	info := self.scope.Describe(vfilter.NewTypeMap())
+	sort.Slice(info.Plugins, func(i, j int) bool {
+		return info.Plugins[i].Name < info.Plugins[j].Name
+	})
+
+	var rows []*ordereddict.Dict
+	for _, plugin := range info.Plugins {
+		rows = append(rows, ordereddict.NewDict().
+			Set("Name", plugin.Name).
+			Set("Doc", plugin.Doc))
+	}
+	self.writeTable([]string{"Name", "Doc"}, rows)
+}
+
+func (self *_Repl) listFunctions() {
+	info := self.scope.Describe(vfilter.NewTypeMap())
+	sort.Slice(info.Functions, func(i, j int) bool {
+		return info.Functions[i].Name < info.Functions[j].Name
+	})
+
+	var rows []*ordereddict.Dict
+	for _, function := range info.Functions {
+		kind := ""
+		if function.IsAggregate {
+			kind = "aggregate"
+		}
+
+		rows = append(rows, ordereddict.NewDict().
+			Set("Name", function.Name).
+			Set("Type", kind).
+			Set("Doc", function.Doc))
+	}
+	self.writeTable([]string{"Name", "Type", "Doc"}, rows)
+}
+
+// Describe the plugin or function and its args.
+func (self *_Repl) describe(name string) {
+	type_map := vfilter.NewTypeMap()
+	info := self.scope.Describe(type_map)
+
+	kind, doc, arg_type := "", "", ""
+	for _, plugin := range info.Plugins {
+		if plugin.Name == name {
+			kind, doc, arg_type = "Plugin", plugin.Doc, plugin.ArgType
+		}
+	}
+
+	for _, function := range info.Functions {
+		if function.Name == name {
+			kind, doc, arg_type = "Function", function.Doc, function.ArgType
+			if function.IsAggregate {
+				kind = "Aggregate function"
+			}
+		}
+	}
+
+	if kind == "" {
+		fmt.Fprintf(os.Stderr, "No plugin or function named %v.\n", name)
+		return
+	}
+
+	fmt.Fprintf(self.out, "%v %v: %v\n", kind, name, doc)
+
+	desc, pres := type_map.Get(self.scope, arg_type)
+	if !pres || len(desc.Fields) == 0 {
+		return
+	}
+
+	var names []string
+	for arg := range desc.Fields {
+		names = append(names, arg)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(self.out)
+	var rows []*ordereddict.Dict
+	for _, arg := range names {
+		field := desc.Fields[arg]
+		arg_type := field.Target
+		if field.Repeated {
+			arg_type = "[]" + arg_type
+		}
+
+		required := ""
+		if strings.HasPrefix(field.Tag, "required") {
+			required = "required"
+		}
+
+		arg_doc := ""
+		if idx := strings.Index(field.Tag, "doc="); idx >= 0 {
+			arg_doc = field.Tag[idx+len("doc="):]
+		}
+
+		rows = append(rows, ordereddict.NewDict().
+			Set("Arg", arg).
+			Set("Type", arg_type).
+			Set("Required", required).
+			Set("Doc", arg_doc))
+	}
+	self.writeTable([]string{"Arg", "Type", "Required", "Doc"}, rows)
+}
+
+func (self *_Repl) writeTable(columns []string, rows []*ordereddict.Dict) {
+	encoder := vfilter.NewTextTableEncoder(self.out)
+	_ = encoder.WriteHeader(columns)
+	for _, row := range rows {
+		_ = encoder.WriteRow(row)
+	}
+	_ = encoder.Close()
+}
+
+func (self *_Repl) loadHistory() {
+	if self.history_file == "" {
+		return
+	}
+
+	fd, err := os.Open(self.history_file)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		if scanner.Text() != "" {
+			self.history = append(self.history,
+				unescapeHistory(scanner.Text()))
+		}
+	}
+
+	if len(self.history) > max_history {
+		self.history = self.history[len(self.history)-max_history:]
+		self.writeHistory()
+	}
+}
+
+// Statements are kept in the history file one per line, with
+// newlines escaped so comments and the layout of the statement
+// survive. Once there are more than max_history statements the file
+// is rewritten with only the most recent ones.
+func (self *_Repl) addHistory(text string) {
+	self.history = append(self.history, text)
+	if len(self.history) > max_history {
+		self.history = self.history[len(self.history)-max_history:]
+		self.writeHistory()
+		return
+	}
+
+	if self.history_file == "" {
+		return
+	}
+
+	fd, err := os.OpenFile(self.history_file,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	fmt.Fprintln(fd, escapeHistory(text))
+}
+
+// Replace the history file with the history kept in memory. The new
+// file is renamed over the old one so the history is not lost if
+// writing fails.
+func (self *_Repl) writeHistory() {
+	if self.history_file == "" {
+		return
+	}
+
+	tmp_file := self.history_file + ".tmp"
+	fd, err := os.OpenFile(tmp_file, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+
+	writer := bufio.NewWriter(fd)
+	for _, item := range self.history {
+		fmt.Fprintln(writer, escapeHistory(item))
+	}
+
+	err = writer.Flush()
+	if err1 := fd.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp_file)
+		return
+	}
+
+	os.Rename(tmp_file, self.history_file)
+}
+
+var (
+	history_escaper   = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+	history_unescaper = strings.NewReplacer("\\\\", "\\", "\\n", "\n")
+)
+
+func escapeHistory(text string) string {
+	return history_escaper.Replace(text)
+}
+
+func unescapeHistory(text string) string {
+	return history_unescaper.Replace(text)
+}
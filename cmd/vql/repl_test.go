@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepl(t *testing.T) {
+	out := &bytes.Buffer{}
+	repl := &_Repl{scope: makeScope(), format: "csv", out: out}
+
+	input := strings.Join([]string{
+		`LET X = SELECT * FROM parse_jsonl(data='{"a": 1}` + "\\n" + `{"a": 2}');`,
+		// A statement over several lines runs on an empty line,
+		// even though it already parses before the WHERE clause.
+		`SELECT sum(items=a) AS Total`,
+		`FROM X`,
+		`WHERE a > 1`,
+		``,
+		`.mode jsonl`,
+		`SELECT a FROM X; SELECT a * 10 AS b FROM X LIMIT 1;`,
+		`.quit`,
+		`SELECT a FROM X`,
+	}, "\n")
+
+	assert.NoError(t, repl.loop(bufio.NewReader(strings.NewReader(input))))
+
+	output := strings.Replace(out.String(), continuation_prompt, "", -1)
+	assert.Equal(t, strings.Join([]string{
+		prompt + prompt + "Total",
+		"2",
+		prompt + prompt + `{"a":1}`,
+		`{"a":2}`,
+		`{"b":10}`,
+		prompt,
+	}, "\n"), output)
+
+	assert.Equal(t, []string{
+		`LET X = SELECT * FROM parse_jsonl(data='{"a": 1}\n{"a": 2}');`,
+		"SELECT sum(items=a) AS Total\nFROM X\nWHERE a > 1",
+		`SELECT a FROM X; SELECT a * 10 AS b FROM X LIMIT 1;`,
+	}, repl.history)
+}
+
+// Statements over several lines keep their layout in the history
+// file and may be recalled.
+func TestReplHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vql_history")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	history_file := filepath.Join(dir, "history")
+	input := strings.Join([]string{
+		`SELECT 1 AS A -- a comment`,
+		`FROM scope()`,
+		``,
+		`SELECT '\\n' AS B FROM scope();`,
+	}, "\n")
+
+	repl := &_Repl{scope: makeScope(), format: "jsonl",
+		out: &bytes.Buffer{}, history_file: history_file}
+	assert.NoError(t, repl.loop(bufio.NewReader(strings.NewReader(input))))
+
+	// A new shell loads the same history.
+	out := &bytes.Buffer{}
+	loaded := &_Repl{scope: makeScope(), format: "jsonl",
+		out: out, history_file: history_file}
+	loaded.loadHistory()
+	assert.Equal(t, repl.history, loaded.history)
+	assert.Equal(t, "SELECT 1 AS A -- a comment\nFROM scope()", loaded.history[0])
+
+	// A recalled statement may be extended before it runs.
+	input = strings.Join([]string{
+		`.recall 1`,
+		`WHERE A = 2`,
+		``,
+	}, "\n")
+	assert.NoError(t, loaded.loop(bufio.NewReader(strings.NewReader(input))))
+	assert.NotContains(t, out.String(), `{"A":1}`)
+	assert.Equal(t, "SELECT 1 AS A -- a comment\nFROM scope()\nWHERE A = 2",
+		loaded.history[2])
+
+	// The history file only keeps the most recent statements.
+	for i := 0; i < max_history+10; i++ {
+		loaded.addHistory(fmt.Sprintf("SELECT %d FROM scope()", i))
+	}
+
+	data, err := ioutil.ReadFile(history_file)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, max_history, len(lines))
+	assert.Equal(t, fmt.Sprintf("SELECT %d FROM scope()", max_history+9),
+		lines[len(lines)-1])
+}
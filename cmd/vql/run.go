@@ -0,0 +1,211 @@
+package main
+
+// Running VQL scripts in batch.
+
+// $ vql run report.vql --input events.jsonl --input users=accounts.csv --format csv
+
+// Each input file is available to the script as a stored query named
+// after the file (or the name given before "="), so the script can
+// select from it like from any LET query:
+
+// SELECT User, count(items=1) AS Logins FROM events GROUP BY User
+
+// The rows of each query in the script are written one query after
+// the other in the selected format. Since a JSON document holds a
+// single array, the json format only accepts scripts with a single
+// query (use jsonl otherwise). The exit code is 0 on success, 1 if
+// any query reported an error (including input files which fail to
+// parse) and 2 if the script could not be run at all (e.g. it does
+// not parse or an input is missing).
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/vfilter"
+)
+
+const (
+	exit_ok           = 0
+	exit_query_errors = 1
+	exit_failed       = 2
+)
+
+// The plugin used to parse each type of input file.
+var input_queries = map[string]string{
+	".json":   "SELECT * FROM parse_json(data=InputFile)",
+	".jsonl":  "SELECT * FROM parse_jsonl(data=InputFile)",
+	".ndjson": "SELECT * FROM parse_jsonl(data=InputFile)",
+	".csv":    "SELECT * FROM parse_csv(data=InputFile)",
+	".tsv":    "SELECT * FROM parse_csv(data=InputFile, separator='\t')",
+}
+
+var non_identifier_regex = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// A stored query which parses an input file each time it is
+// evaluated.
+type _InputQuery struct {
+	path  string
+	query *vfilter.VQL
+}
+
+// Parse an --input flag of the form NAME=PATH or PATH.
+func newInputQuery(input string) (string, *_InputQuery, error) {
+	name, path := "", input
+	if idx := strings.Index(input, "="); idx > 0 {
+		name, path = input[:idx], input[idx+1:]
+	}
+
+	// Default the name from the file name, e.g. "my-events.jsonl"
+	// becomes "my_events".
+	if name == "" {
+		base := filepath.Base(path)
+		name = non_identifier_regex.ReplaceAllString(
+			strings.TrimSuffix(base, filepath.Ext(base)), "_")
+		if name == "" || (name[0] >= '0' && name[0] <= '9') {
+			name = "_" + name
+		}
+	}
+
+	query, pres := input_queries[strings.ToLower(filepath.Ext(path))]
+	if !pres {
+		return "", nil, fmt.Errorf(
+			"Input %v should be a .json, .jsonl, .ndjson, .csv or .tsv file.", path)
+	}
+
+	_, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	vql, err := vfilter.Parse(query)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return name, &_InputQuery{path: path, query: vql}, nil
+}
+
+func (self *_InputQuery) Eval(ctx context.Context, scope *vfilter.Scope) <-chan vfilter.Row {
+	output_chan := make(chan vfilter.Row)
+
+	go func() {
+		defer close(output_chan)
+
+		fd, err := os.Open(self.path)
+		if err != nil {
+			scope.Log("%v", err)
+			return
+		}
+		defer fd.Close()
+
+		sub_scope := scope.Copy()
+		sub_scope.AppendVars(ordereddict.NewDict().Set("InputFile", fd))
+
+		for row := range self.query.Eval(ctx, sub_scope) {
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- row:
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+func (self *_InputQuery) Columns(scope *vfilter.Scope) *[]string {
+	return &[]string{}
+}
+
+func (self *_InputQuery) ToString(scope *vfilter.Scope) string {
+	return self.query.ToString(scope)
+}
+
+// Run the script with the inputs, writing the results to out. Returns
+// the exit code.
+func runScript(script_path string, inputs []string, format string,
+	strict bool, out io.Writer) int {
+	script, err := ioutil.ReadFile(script_path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exit_failed
+	}
+
+	statements, err := vfilter.ParseMultiVQL(string(script))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", script_path, err)
+		return exit_failed
+	}
+
+	_, err = vfilter.NewEncoder(format, out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exit_failed
+	}
+
+	queries := 0
+	for _, statement := range statements {
+		if statement.VQL.Let == "" {
+			queries++
+		}
+	}
+
+	if format == "json" && queries > 1 {
+		fmt.Fprintf(os.Stderr, "%v: The json format can only be used "+
+			"with a single query. Use jsonl for scripts with %v queries.\n",
+			script_path, queries)
+		return exit_failed
+	}
+
+	scope := makeScope()
+	env := ordereddict.NewDict()
+	for _, input := range inputs {
+		name, query, err := newInputQuery(input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exit_failed
+		}
+		env.Set(name, query)
+	}
+	scope.AppendVars(env)
+
+	collector := vfilter.NewErrorCollector(strict)
+	scope.SetErrorCollector(collector)
+
+	ctx, cancel := collector.WithContext(context.Background())
+	defer cancel()
+
+	for _, statement := range statements {
+		// LET statements produce no rows.
+		if statement.VQL.Let != "" {
+			for range statement.VQL.Eval(ctx, scope) {
+			}
+			continue
+		}
+
+		encoder, _ := vfilter.NewEncoder(format, out)
+		err := vfilter.Encode(statement.VQL, ctx, scope, encoder)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exit_failed
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(collector.Errors()) > 0 {
+		return exit_query_errors
+	}
+
+	return exit_ok
+}
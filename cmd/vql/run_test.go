@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vql")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+
+	events := write("my-events.jsonl", `{"User":"bob","Action":"login"}
+{"User":"al","Action":"login"}
+{"User":"bob","Action":"logout"}
+{"User":"bob","Action":"login"}
+`)
+	accounts := write("accounts.csv", "Name,Age\nbob,40\nal,20\n")
+
+	script := write("script.vql", `
+-- Logins per user.
+LET logins = SELECT * FROM my_events WHERE Action = 'login';
+SELECT User, count(items=1) AS Logins FROM logins GROUP BY User ORDER BY User;
+SELECT Name FROM users WHERE Age > 30
+`)
+
+	out := &bytes.Buffer{}
+	assert.Equal(t, exit_ok, runScript(script,
+		[]string{events, "users=" + accounts}, "csv", false, out))
+	assert.Equal(t, "User,Logins\nal,1\nbob,2\nName\nbob\n", out.String())
+
+	// A missing input is a query error.
+	out.Reset()
+	assert.Equal(t, exit_query_errors, runScript(script,
+		[]string{events}, "jsonl", false, out))
+	assert.Equal(t, `{"User":"al","Logins":1}`+"\n"+
+		`{"User":"bob","Logins":2}`+"\n", out.String())
+
+	// Input files which fail to parse are query errors.
+	bad_events := write("bad.jsonl", `{"User":"bob","Action":"login"}
+not json
+`)
+	out.Reset()
+	assert.Equal(t, exit_query_errors, runScript(script,
+		[]string{"my_events=" + bad_events, "users=" + accounts},
+		"csv", false, out))
+	assert.Equal(t, "User,Logins\nbob,1\nName\nbob\n", out.String())
+
+	bad_accounts := write("bad.csv", "Name,Age\n\"bob,40\n")
+	out.Reset()
+	assert.Equal(t, exit_query_errors, runScript(script,
+		[]string{events, "users=" + bad_accounts}, "csv", true, out))
+
+	// A single JSON array can only hold the rows of one query.
+	single := write("single.vql", `
+LET logins = SELECT * FROM my_events WHERE Action = 'login';
+SELECT User FROM logins LIMIT 1
+`)
+	out.Reset()
+	assert.Equal(t, exit_ok, runScript(single, []string{events}, "json", false, out))
+	assert.Equal(t, "[\n {\n  \"User\": \"bob\"\n }\n]", out.String())
+	assert.Equal(t, exit_failed, runScript(script,
+		[]string{events, "users=" + accounts}, "json", false, out))
+
+	bad_script := write("bad.vql", "SELECT * FROM")
+	assert.Equal(t, exit_failed, runScript(bad_script, nil, "csv", false, out))
+	assert.Equal(t, exit_failed, runScript(script,
+		[]string{filepath.Join(dir, "events.txt")}, "csv", false, out))
+	assert.Equal(t, exit_failed, runScript(script, nil, "xml", false, out))
+}
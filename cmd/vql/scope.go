@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/vfilter"
+)
+
+// Plugins, functions and protocols are added to the scope by
+// initializers. Files in this package add their own from an init()
+// function, so extending the tool does not require changing the code
+// which builds the scope.
+var scope_initializers []func(scope *vfilter.Scope)
+
+func RegisterScopeInitializer(initializer func(scope *vfilter.Scope)) {
+	scope_initializers = append(scope_initializers, initializer)
+}
+
+// Build a scope with all the registered plugins. Messages logged by
+// queries go to stderr.
+func makeScope() *vfilter.Scope {
+	scope := vfilter.NewScope()
+	scope.Logger = log.New(os.Stderr, "", 0)
+
+	for _, initializer := range scope_initializers {
+		initializer(scope)
+	}
+
+	return scope
+}
+
+func init() {
+	RegisterScopeInitializer(func(scope *vfilter.Scope) {
+		scope.AppendFunctions(_ReadFileFunction{})
+	})
+}
+
+type _ReadFileFunctionArgs struct {
+	Filename string `vfilter:"required,field=filename,doc=The file to read."`
+}
+
+// Reads a file into a string, e.g. to pass to parse_json().
+type _ReadFileFunction struct{}
+
+func (self _ReadFileFunction) Info(
+	scope *vfilter.Scope, type_map *vfilter.TypeMap) *vfilter.FunctionInfo {
+	return &vfilter.FunctionInfo{
+		Name:    "read_file",
+		Doc:     "Read the contents of a file.",
+		ArgType: type_map.AddType(scope, &_ReadFileFunctionArgs{}),
+	}
+}
+
+func (self _ReadFileFunction) Call(ctx context.Context,
+	scope *vfilter.Scope, args *ordereddict.Dict) vfilter.Any {
+	arg := &_ReadFileFunctionArgs{}
+	err := vfilter.ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("read_file: %v", err)
+		return vfilter.Null{}
+	}
+
+	data, err := ioutil.ReadFile(arg.Filename)
+	if err != nil {
+		scope.Log("read_file: %v", err)
+		return vfilter.Null{}
+	}
+
+	return string(data)
+}
@@ -0,0 +1,388 @@
+package vfilter
+
+// Output encoders.
+
+// An encoder writes the rows of a query to an io.Writer as the query
+// produces them (see Encode()). The cells of each row are normalised
+// the same way as for OutputJSON().
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+type Encoder interface {
+	// Called once before any rows are written. The columns are
+	// those of the query, or of the first row if the query does
+	// not name its columns.
+	WriteHeader(columns []string) error
+
+	// Called for each row. The row holds the normalised cells of
+	// the columns passed to WriteHeader() which are present in
+	// the row. If the query does not name its columns the row
+	// holds all of its own columns instead, which may differ from
+	// those of the first row.
+	WriteRow(row *ordereddict.Dict) error
+
+	// Called after the last row.
+	Close() error
+}
+
+var encoders_mu sync.RWMutex
+
+var encoders = map[string]func(w io.Writer) Encoder{
+	"json":     NewJSONEncoder,
+	"jsonl":    NewJSONLEncoder,
+	"csv":      NewCSVEncoder,
+	"tsv":      NewTSVEncoder,
+	"table":    NewTextTableEncoder,
+	"markdown": NewMarkdownTableEncoder,
+}
+
+// Register a new output format for NewEncoder().
+func RegisterEncoder(format string, factory func(w io.Writer) Encoder) {
+	encoders_mu.Lock()
+	defer encoders_mu.Unlock()
+
+	encoders[format] = factory
+}
+
+// The names of all the output formats.
+func EncoderFormats() []string {
+	encoders_mu.RLock()
+	defer encoders_mu.RUnlock()
+
+	result := make([]string, 0, len(encoders))
+	for format := range encoders {
+		result = append(result, format)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// Create an encoder for the named output format.
+func NewEncoder(format string, w io.Writer) (Encoder, error) {
+	encoders_mu.RLock()
+	factory, pres := encoders[format]
+	encoders_mu.RUnlock()
+
+	if !pres {
+		return nil, fmt.Errorf("Unknown output format %v. Expected one of %v.",
+			format, strings.Join(EncoderFormats(), ", "))
+	}
+
+	return factory(w), nil
+}
+
+// Evaluate the query and pass each row to the encoder as it arrives.
+func Encode(vql *VQL, ctx context.Context, scope *Scope, encoder Encoder) error {
+	// Stop the query if the encoder fails.
+	sub_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	columns := *vql.Columns(scope)
+	fixed_columns := len(columns) > 0
+	header_written := false
+
+	for row := range vql.Eval(sub_ctx, scope) {
+		if !header_written {
+			if !fixed_columns {
+				columns = scope.GetMembers(row)
+			}
+
+			err := encoder.WriteHeader(columns)
+			if err != nil {
+				return err
+			}
+			header_written = true
+		}
+
+		row_columns := columns
+		if !fixed_columns {
+			row_columns = scope.GetMembers(row)
+		}
+
+		err := encoder.WriteRow(normalizeRow(sub_ctx, scope, row, row_columns))
+		if err != nil {
+			return err
+		}
+
+		// Throttle if needed.
+		ChargeOp(scope)
+	}
+
+	if !header_written {
+		err := encoder.WriteHeader(columns)
+		if err != nil {
+			return err
+		}
+	}
+
+	return encoder.Close()
+}
+
+// Convert a normalised cell to a string for the text based
+// encoders. Strings and numbers are written as they are, anything
+// else as JSON.
+func formatCell(value Any) string {
+	switch t := value.(type) {
+	case nil:
+		return ""
+
+	case string:
+		return t
+
+	case *ordereddict.Dict:
+		// Fall through to JSON below.
+
+	case fmt.Stringer:
+		return t.String()
+	}
+
+	if _, ok := to_float(value); ok {
+		return fmt.Sprintf("%v", value)
+	}
+
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(serialized)
+}
+
+// Writes the rows as a JSON array, in the same format as
+// OutputJSON().
+type _JSONEncoder struct {
+	w    io.Writer
+	rows int
+}
+
+func NewJSONEncoder(w io.Writer) Encoder {
+	return &_JSONEncoder{w: w}
+}
+
+func (self *_JSONEncoder) WriteHeader(columns []string) error {
+	_, err := io.WriteString(self.w, "[")
+	return err
+}
+
+func (self *_JSONEncoder) WriteRow(row *ordereddict.Dict) error {
+	serialized, err := json.MarshalIndent(row, " ", " ")
+	if err != nil {
+		return err
+	}
+
+	separator := "\n "
+	if self.rows > 0 {
+		separator = ",\n "
+	}
+	self.rows++
+
+	_, err = io.WriteString(self.w, separator+string(serialized))
+	return err
+}
+
+func (self *_JSONEncoder) Close() error {
+	end := "]"
+	if self.rows > 0 {
+		end = "\n]"
+	}
+
+	_, err := io.WriteString(self.w, end)
+	return err
+}
+
+// Writes each row as a JSON object on its own line.
+type _JSONLEncoder struct {
+	w io.Writer
+}
+
+func NewJSONLEncoder(w io.Writer) Encoder {
+	return &_JSONLEncoder{w: w}
+}
+
+func (self *_JSONLEncoder) WriteHeader(columns []string) error {
+	return nil
+}
+
+func (self *_JSONLEncoder) WriteRow(row *ordereddict.Dict) error {
+	serialized, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	_, err = self.w.Write(append(serialized, '\n'))
+	return err
+}
+
+func (self *_JSONLEncoder) Close() error {
+	return nil
+}
+
+// Writes the rows as comma (or tab) separated values with a header
+// line. Cells missing from a row are left empty.
+type _CSVEncoder struct {
+	writer  *csv.Writer
+	columns []string
+}
+
+func NewCSVEncoder(w io.Writer) Encoder {
+	return &_CSVEncoder{writer: csv.NewWriter(w)}
+}
+
+func NewTSVEncoder(w io.Writer) Encoder {
+	writer := csv.NewWriter(w)
+	writer.Comma = '\t'
+	return &_CSVEncoder{writer: writer}
+}
+
+func (self *_CSVEncoder) WriteHeader(columns []string) error {
+	self.columns = columns
+	return self.write(columns)
+}
+
+func (self *_CSVEncoder) WriteRow(row *ordereddict.Dict) error {
+	record := make([]string, 0, len(self.columns))
+	for _, column := range self.columns {
+		value, _ := row.Get(column)
+		record = append(record, formatCell(value))
+	}
+
+	return self.write(record)
+}
+
+// Flush each line so the output streams.
+func (self *_CSVEncoder) write(record []string) error {
+	err := self.writer.Write(record)
+	if err != nil {
+		return err
+	}
+
+	self.writer.Flush()
+	return self.writer.Error()
+}
+
+func (self *_CSVEncoder) Close() error {
+	return nil
+}
+
+// Writes the rows as a table with aligned columns, either as plain
+// text or in Markdown. Since the width of the columns depends on all
+// the rows, the table is written when the encoder is closed.
+type _TableEncoder struct {
+	w        io.Writer
+	markdown bool
+	columns  []string
+	rows     [][]string
+}
+
+func NewTextTableEncoder(w io.Writer) Encoder {
+	return &_TableEncoder{w: w}
+}
+
+func NewMarkdownTableEncoder(w io.Writer) Encoder {
+	return &_TableEncoder{w: w, markdown: true}
+}
+
+func (self *_TableEncoder) WriteHeader(columns []string) error {
+	self.columns = columns
+	return nil
+}
+
+func (self *_TableEncoder) WriteRow(row *ordereddict.Dict) error {
+	record := make([]string, 0, len(self.columns))
+	for _, column := range self.columns {
+		value, _ := row.Get(column)
+		record = append(record, self.escape(formatCell(value)))
+	}
+	self.rows = append(self.rows, record)
+
+	return nil
+}
+
+// Cells must fit on a single line.
+func (self *_TableEncoder) escape(cell string) string {
+	cell = strings.Replace(cell, "\r", "", -1)
+	cell = strings.Replace(cell, "\n", " ", -1)
+	if self.markdown {
+		cell = strings.Replace(cell, "|", "\\|", -1)
+	}
+	return cell
+}
+
+func (self *_TableEncoder) Close() error {
+	if len(self.columns) == 0 {
+		return nil
+	}
+
+	// Markdown needs at least three dashes under each header.
+	min_width := 0
+	if self.markdown {
+		min_width = 3
+	}
+
+	header := make([]string, 0, len(self.columns))
+	widths := make([]int, 0, len(self.columns))
+	for _, column := range self.columns {
+		column = self.escape(column)
+		header = append(header, column)
+		widths = append(widths, min_width)
+	}
+
+	for idx, column := range header {
+		width := utf8.RuneCountInString(column)
+		if width > widths[idx] {
+			widths[idx] = width
+		}
+	}
+
+	for _, record := range self.rows {
+		for idx, cell := range record {
+			width := utf8.RuneCountInString(cell)
+			if width > widths[idx] {
+				widths[idx] = width
+			}
+		}
+	}
+
+	separator := make([]string, 0, len(widths))
+	for _, width := range widths {
+		separator = append(separator, strings.Repeat("-", width))
+	}
+
+	lines := []string{self.formatLine(header, widths), self.formatLine(separator, widths)}
+	for _, record := range self.rows {
+		lines = append(lines, self.formatLine(record, widths))
+	}
+
+	_, err := io.WriteString(self.w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+func (self *_TableEncoder) formatLine(cells []string, widths []int) string {
+	padded := make([]string, 0, len(cells))
+	for idx, cell := range cells {
+		padding := widths[idx] - utf8.RuneCountInString(cell)
+		if padding < 0 {
+			padding = 0
+		}
+		padded = append(padded, cell+strings.Repeat(" ", padding))
+	}
+
+	if self.markdown {
+		return "| " + strings.Join(padded, " | ") + " |"
+	}
+
+	return strings.TrimRight(strings.Join(padded, "  "), " ")
+}
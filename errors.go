@@ -0,0 +1,175 @@
+// Structured errors reported during query evaluation.
+
+// Most failures in VQL are not fatal - a function which receives bad
+// args simply returns NULL and a plugin which can not be found
+// produces no rows. This makes queries robust but it also makes it
+// impossible for callers to distinguish a query which matched
+// nothing from a query which was broken. Callers may install an
+// ErrorCollector in the scope to receive a typed record of every
+// failure, and optionally cancel the query on the first error.
+
+package vfilter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/alecthomas/participle/lexer"
+)
+
+type ErrorType int
+
+const (
+	UnknownPluginError ErrorType = iota
+	UnknownFunctionError
+	UnknownSymbolError
+	ArgumentError
+	TypeError
+	RecursionError
+	InvalidQueryError
+)
+
+func (self ErrorType) String() string {
+	switch self {
+	case UnknownPluginError:
+		return "UnknownPlugin"
+	case UnknownFunctionError:
+		return "UnknownFunction"
+	case UnknownSymbolError:
+		return "UnknownSymbol"
+	case ArgumentError:
+		return "ArgumentError"
+	case TypeError:
+		return "TypeError"
+	case RecursionError:
+		return "RecursionError"
+	case InvalidQueryError:
+		return "InvalidQuery"
+	default:
+		return "Unknown"
+	}
+}
+
+// An error encountered while evaluating the query.
+type QueryError struct {
+	Type    ErrorType
+	Message string
+
+	// The VQL fragment which caused the error (as produced by
+	// ToString()). May be empty if the error was not raised
+	// within a function or plugin call.
+	Node string
+
+	// The position of Node within the query.
+	Pos lexer.Position
+
+	// Set once the error is recorded so it is only collected once.
+	recorded bool
+}
+
+func (self *QueryError) Error() string {
+	if self.Node == "" {
+		return self.Message
+	}
+
+	return fmt.Sprintf("%v: %v (in %v at %v)", self.Type, self.Message,
+		self.Node, self.Pos)
+}
+
+func newQueryError(error_type ErrorType,
+	format string, a ...interface{}) *QueryError {
+	return &QueryError{
+		Type:    error_type,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+// AST nodes which may be blamed for an error.
+type _ErrorNode interface {
+	// Must not take any locks since errors may be reported while
+	// the node is being reduced.
+	toString(scope *Scope) string
+	position() lexer.Position
+}
+
+// Collects errors raised while evaluating queries in a scope.
+type ErrorCollector struct {
+	mu     sync.Mutex
+	errors []*QueryError
+
+	// In strict mode the first error cancels the query.
+	strict bool
+
+	// The contexts returned by WithContext() which were not
+	// released yet, keyed by an id.
+	cancels map[int]context.CancelFunc
+	next_id int
+}
+
+func NewErrorCollector(strict bool) *ErrorCollector {
+	return &ErrorCollector{strict: strict}
+}
+
+// Returns a context which will be cancelled when a strict collector
+// receives its first error. The collector stops tracking the context
+// when the returned CancelFunc is called.
+func (self *ErrorCollector) WithContext(ctx context.Context) (
+	context.Context, context.CancelFunc) {
+	sub_ctx, cancel := context.WithCancel(ctx)
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.strict && len(self.errors) > 0 {
+		cancel()
+		return sub_ctx, cancel
+	}
+
+	if self.cancels == nil {
+		self.cancels = make(map[int]context.CancelFunc)
+	}
+	id := self.next_id
+	self.next_id++
+	self.cancels[id] = cancel
+
+	return sub_ctx, func() {
+		self.mu.Lock()
+		delete(self.cancels, id)
+		self.mu.Unlock()
+
+		cancel()
+	}
+}
+
+func (self *ErrorCollector) Add(err *QueryError) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.errors = append(self.errors, err)
+	if self.strict {
+		for id, cancel := range self.cancels {
+			cancel()
+			delete(self.cancels, id)
+		}
+	}
+}
+
+// All the errors collected so far.
+func (self *ErrorCollector) Errors() []*QueryError {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return append([]*QueryError{}, self.errors...)
+}
+
+// Returns the first error collected or nil if there were no errors.
+func (self *ErrorCollector) Err() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if len(self.errors) == 0 {
+		return nil
+	}
+	return self.errors[0]
+}
@@ -14,6 +14,11 @@ import (
 	"golang.org/x/text/transform"
 )
 
+// Functions receive their args in a dict keyed by the arg names. Args
+// passed by position are keyed by their position among the positional
+// args, i.e. "$0", "$1" etc. ExtractArgs() maps these to the fields of
+// the args struct, but functions which read the dict directly must
+// handle (or reject) such keys themselves.
 type FunctionInterface interface {
 	Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any
 	Info(scope *Scope, type_map *TypeMap) *FunctionInfo
@@ -33,6 +38,12 @@ func (self _DictFunc) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
 func (self _DictFunc) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
 	result := ordereddict.NewDict()
 	for _, k := range scope.GetMembers(args) {
+		if isPositionalArg(k) {
+			scope.ReportError(newQueryError(ArgumentError,
+				"dict() only accepts keyword args."))
+			return Null{}
+		}
+
 		v, _ := args.Get(k)
 		lazy_arg, ok := v.(LazyExpr)
 		if ok {
@@ -45,15 +56,16 @@ func (self _DictFunc) Call(ctx context.Context, scope *Scope, args *ordereddict.
 }
 
 type _TimestampArg struct {
-	Epoch       int64 `vfilter:"optional,field=epoch"`
+	Epoch       Any   `vfilter:"optional,field=epoch"`
 	WinFileTime int64 `vfilter:"optional,field=winfiletime"`
 }
 type _Timestamp struct{}
 
 func (self _Timestamp) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
 	return &FunctionInfo{
-		Name:    "timestamp",
-		Doc:     "Convert seconds from epoch into a string.",
+		Name: "timestamp",
+		Doc: "Convert seconds from epoch, or a string in RFC3339 or " +
+			"another common format, into a time.",
 		ArgType: type_map.AddType(scope, _TimestampArg{}),
 	}
 }
@@ -62,16 +74,27 @@ func (self _Timestamp) Call(ctx context.Context, scope *Scope, args *ordereddict
 	arg := &_TimestampArg{}
 	err := ExtractArgs(scope, args, arg)
 	if err != nil {
-		scope.Log("timestamp: %s", err.Error())
+		reportArgError(scope, "timestamp", err)
 		return Null{}
 	}
 
-	if arg.Epoch > 0 {
-		return time.Unix(arg.Epoch, 0)
+	if !is_null_obj(arg.Epoch) {
+		// Zero epochs usually mean the time is not known.
+		if value, ok := to_float(arg.Epoch); ok && value <= 0 {
+			return Null{}
+		}
+
+		result, ok := to_time(arg.Epoch)
+		if !ok {
+			scope.ReportError(newQueryError(TypeError,
+				"timestamp: Unable to parse %v as a time.", arg.Epoch))
+			return Null{}
+		}
+		return result
 	}
 
 	if arg.WinFileTime > 0 {
-		return time.Unix((arg.WinFileTime/10000000)-11644473600, 0)
+		return time.Unix((arg.WinFileTime/10000000)-11644473600, 0).UTC()
 	}
 
 	return Null{}
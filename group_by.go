@@ -0,0 +1,455 @@
+package vfilter
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+// Aggregate functions (count, sum etc) operate by storing data in the
+// scope context between rows. When we group by we create a different
+// scope context for each bin - all the rows with the same group by
+// values are placed in the same bin and share the same context.
+type _AggregateContext struct {
+	row     Row
+	keys    []Any
+	context *ordereddict.Dict
+
+	// The untransformed last row in this bin.
+	source Row
+
+	// The seq of the first row in this bin. Bins which sort the
+	// same are emitted in the order they were first seen.
+	seq int64
+}
+
+func (self _Select) evalGroupBy(
+	ctx context.Context, scope *Scope, output_chan chan Row) {
+	// Without an ORDER BY, emit the groups sorted by their keys.
+	compare := func(a []Any, b []Any) int {
+		return compareKeys(scope, a, b)
+	}
+	if len(self.OrderBy) > 0 {
+		compare = func(a []Any, b []Any) int {
+			return compareTerms(scope, self.OrderBy, a, b)
+		}
+	}
+
+	sorter := newExternalSorter(scope, compare)
+	defer sorter.Close()
+
+	// Stop reading the spill files before they are removed.
+	sub_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	input := self.groupByInput(sub_ctx, scope)
+	workers := scope.aggregateWorkers()
+
+	// Parallel aggregation keeps all the groups in memory so it
+	// is not used when the caller limits memory use. It also
+	// needs to merge the state of every aggregate.
+	var has_rows bool
+	if workers > 1 && scope.memoryBudget() == 0 &&
+		self.hasMergeableAggregates(scope) {
+		has_rows = self.aggregateParallel(sub_ctx, scope, input, workers, sorter)
+	} else {
+		has_rows = self.aggregate(sub_ctx, scope, input, 0, sorter)
+	}
+
+	// Without a GROUP BY all rows are in a single group, which
+	// exists even when there are no rows (e.g. count() is 0).
+	if !has_rows && len(self.GroupBy) == 0 && sub_ctx.Err() == nil {
+		self.emitEmptyAggregate(sub_ctx, scope, sorter)
+	}
+
+	offset := 0
+	if self.Offset != nil {
+		offset = int(*self.Offset)
+	}
+
+	distinct := newDistinctFilter(self.Distinct)
+	count := 0
+	for row := range sorter.Rows(sub_ctx) {
+		if self.Limit != nil && count >= int(*self.Limit) {
+			break
+		}
+
+		if !distinct.Check(scope, row) {
+			continue
+		}
+
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case output_chan <- row:
+		}
+		count++
+	}
+}
+
+// Returns true if all the aggregates the query calls keep their state
+// in an AggregatorInterface, which can be merged. Other aggregate
+// functions (e.g. those keeping state with Scope.SetContext()) can
+// only be evaluated serially.
+func (self _Select) hasMergeableAggregates(scope *Scope) bool {
+	result := true
+	walkAST([]Any{self.SelectExpression, self.OrderBy}, func(node Any) bool {
+		switch t := node.(type) {
+		case *_Select:
+			// Subqueries aggregate separately.
+			return false
+
+		case *_SymbolRef:
+			if t.IsAggregate(scope) {
+				scope.Lock()
+				function := scope.functions[t.Symbol]
+				scope.Unlock()
+
+				if _, ok := function.(_AggregateFunction); !ok {
+					result = false
+				}
+			}
+		}
+		return result
+	})
+
+	return result
+}
+
+// Produce the rows which pass the WHERE clause along with their group
+// by keys.
+func (self _Select) groupByInput(
+	ctx context.Context, scope *Scope) <-chan *_SortItem {
+	output_chan := make(chan *_SortItem)
+
+	go func() {
+		defer close(output_chan)
+
+		seq := int64(0)
+		for row := range self.From.Eval(ctx, scope) {
+			transformed_row := self.SelectExpression.Transform(
+				ctx, scope, row)
+
+			// Order matters - transformed row may mask
+			// original row.
+			row_scope := scope.Copy()
+			row_scope.AppendVars(row)
+			row_scope.AppendVars(transformed_row)
+
+			if self.Where != nil {
+				expression := self.Where.Reduce(ctx, row_scope)
+				// If the filtered expression returns a
+				// bool false, then skip the row.
+				if expression == nil || !scope.Bool(expression) {
+					scope.Trace("During Groupby: Row rejected")
+					continue
+				}
+			}
+
+			keys := make([]Any, 0, len(self.GroupBy))
+			for _, expr := range self.GroupBy {
+				keys = append(keys, expr.Reduce(ctx, row_scope))
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- &_SortItem{seq: seq, keys: keys, row: row}:
+			}
+			seq++
+		}
+	}()
+
+	return output_chan
+}
+
+// Place each row in a bin based on its group by keys and pass the
+// aggregated rows to the sorter. Once the memory budget is exceeded,
+// rows for new bins are spilled into partitions which are aggregated
+// separately at the next level. Returns true if there were any rows.
+func (self _Select) aggregate(ctx context.Context, scope *Scope,
+	input <-chan *_SortItem, level int, sorter *_ExternalSorter) bool {
+
+	// Collect all the rows with the same group_by values. This is
+	// a map between the Hash() of the group by values and an
+	// aggregate context.
+	bins := make(map[string]*_AggregateContext)
+	index := newHashIndex()
+
+	// Bins in the order they were first seen.
+	var ordered_bins []*_AggregateContext
+
+	var partitions *_GroupPartitions
+	defer func() {
+		if partitions != nil {
+			partitions.Close()
+		}
+	}()
+
+	budget := scope.memoryBudget()
+	size := int64(0)
+
+	new_scope := scope.Copy()
+
+	for item := range input {
+		entry, pres := index.Find(scope, item.keys)
+
+		aggregate_ctx := bins[entry.group]
+		if !pres {
+			if partitions != nil &&
+				partitions.Add(ctx, entry.partitionHash(), item) {
+				continue
+			}
+
+			// No previous aggregate_row - initialize
+			// with a new context.
+			aggregate_ctx = newAggregateContext(item)
+			index.Add(entry)
+			bins[entry.group] = aggregate_ctx
+			ordered_bins = append(ordered_bins, aggregate_ctx)
+		}
+
+		self.accumulate(ctx, scope, new_scope, aggregate_ctx, item.row)
+
+		if budget > 0 && partitions == nil && level < max_spill_level {
+			size += estimateSize(item)
+			if size > budget {
+				partitions = newGroupPartitions(scope, level)
+			}
+		}
+	}
+
+	for _, aggregate_ctx := range ordered_bins {
+		self.emitBin(ctx, scope, aggregate_ctx, sorter)
+	}
+
+	if partitions == nil {
+		return len(ordered_bins) > 0
+	}
+
+	for _, file := range partitions.files {
+		if file != nil {
+			self.aggregate(ctx, scope, file.Items(ctx, scope),
+				level+1, sorter)
+		}
+	}
+	return true
+}
+
+// Emit the single group of an aggregate query without a GROUP BY
+// over no rows. Aggregates give the result of their initial state
+// and all other columns are NULL.
+func (self _Select) emitEmptyAggregate(ctx context.Context, scope *Scope,
+	sorter *_ExternalSorter) {
+	aggregate_ctx := &_AggregateContext{context: ordereddict.NewDict()}
+	aggregate_ctx.context.Set(aggregate_final_key, true)
+
+	new_scope := scope.Copy()
+	new_scope.context = aggregate_ctx.context
+
+	row := ordereddict.NewDict()
+	for _, expr := range self.SelectExpression.Expressions {
+		column_name := expr.GetName(scope)
+
+		if expr.Expression != nil && expr.Expression.IsAggregate(scope) {
+			row.Set(column_name, expr.Reduce(ctx, new_scope))
+		} else {
+			row.Set(column_name, Null{})
+		}
+	}
+
+	aggregate_ctx.row = row
+	self.emitBin(ctx, scope, aggregate_ctx, sorter)
+}
+
+func newAggregateContext(item *_SortItem) *_AggregateContext {
+	return &_AggregateContext{
+		keys:    item.keys,
+		context: ordereddict.NewDict(),
+		seq:     item.seq,
+	}
+}
+
+// Add the row to the bin.
+func (self _Select) accumulate(ctx context.Context, scope *Scope,
+	new_scope *Scope, aggregate_ctx *_AggregateContext, row Row) {
+
+	// The transform function receives its own unique context for
+	// the specific aggregate group.
+	new_scope.context = aggregate_ctx.context
+
+	// Update the row with the transformed columns. Note we must
+	// materialize these rows because evaluating the row may have
+	// side effects (e.g. for aggregate functions).
+	aggregate_ctx.row = MaterializedLazyRow(
+		self.SelectExpression.Transform(ctx, new_scope, row), scope)
+	aggregate_ctx.source = row
+}
+
+// Pass the aggregated row of the bin to the sorter.
+func (self _Select) emitBin(ctx context.Context, scope *Scope,
+	aggregate_ctx *_AggregateContext, sorter *_ExternalSorter) {
+	keys := aggregate_ctx.keys
+	if len(self.OrderBy) > 0 {
+		keys = orderByKeys(ctx, scope, self.OrderBy,
+			aggregate_ctx.source, aggregate_ctx.row)
+	}
+	sorter.Add(ctx, aggregate_ctx.seq, keys, aggregate_ctx.row)
+}
+
+// The input to a parallel aggregation is split into chunks of this
+// many rows.
+var aggregate_chunk_size = 1000
+
+// A chunk of consecutive input rows.
+type _AggregateChunk struct {
+	idx   int
+	items []*_SortItem
+	bins  map[string]*_AggregateContext
+}
+
+// Aggregate the input using several workers. The input is split into
+// chunks of consecutive rows and each worker aggregates whole chunks
+// into partial bins. The partial bins of each chunk are then merged
+// in input order using the aggregators' Merge(), so the result is the
+// same as aggregating serially. Finally the last row in each bin is
+// transformed again with the merged states to produce the output
+// row.
+//
+// Only state kept by an AggregatorInterface can be merged, so this
+// must only be used when hasMergeableAggregates() is true. Returns
+// true if there were any rows.
+func (self _Select) aggregateParallel(ctx context.Context, scope *Scope,
+	input <-chan *_SortItem, workers int, sorter *_ExternalSorter) bool {
+
+	chunks := make(chan *_AggregateChunk)
+	go func() {
+		defer close(chunks)
+
+		chunk := &_AggregateChunk{}
+		for item := range input {
+			chunk.items = append(chunk.items, item)
+			if len(chunk.items) < aggregate_chunk_size {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case chunks <- chunk:
+			}
+			chunk = &_AggregateChunk{idx: chunk.idx + 1}
+		}
+
+		if len(chunk.items) > 0 {
+			select {
+			case <-ctx.Done():
+			case chunks <- chunk:
+			}
+		}
+	}()
+
+	results := make(chan *_AggregateChunk)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			worker_scope := scope.Copy()
+			new_scope := scope.Copy()
+			for chunk := range chunks {
+				chunk.bins = make(map[string]*_AggregateContext)
+				index := newHashIndex()
+				for _, item := range chunk.items {
+					entry, pres := index.Find(worker_scope, item.keys)
+					aggregate_ctx := chunk.bins[entry.group]
+					if !pres {
+						aggregate_ctx = newAggregateContext(item)
+						index.Add(entry)
+						chunk.bins[entry.group] = aggregate_ctx
+					}
+
+					self.accumulate(ctx, worker_scope, new_scope,
+						aggregate_ctx, item.row)
+				}
+				chunk.items = nil
+
+				select {
+				case <-ctx.Done():
+					return
+				case results <- chunk:
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Merge the chunks in order as they become available.
+	bins := make(map[string]*_AggregateContext)
+	index := newHashIndex()
+	var ordered_bins []*_AggregateContext
+	pending := make(map[int]*_AggregateChunk)
+	next := 0
+	for chunk := range results {
+		pending[chunk.idx] = chunk
+		for {
+			chunk, pres := pending[next]
+			if !pres {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			for _, partial := range chunk.bins {
+				entry, pres := index.Find(scope, partial.keys)
+				if !pres {
+					index.Add(entry)
+					bins[entry.group] = partial
+					ordered_bins = append(ordered_bins, partial)
+					continue
+				}
+				mergeAggregateContexts(scope, bins[entry.group], partial)
+			}
+		}
+	}
+
+	new_scope := scope.Copy()
+	for _, aggregate_ctx := range ordered_bins {
+		aggregate_ctx.context.Set(aggregate_final_key, true)
+		self.accumulate(ctx, scope, new_scope, aggregate_ctx,
+			aggregate_ctx.source)
+		self.emitBin(ctx, scope, aggregate_ctx, sorter)
+	}
+
+	return len(ordered_bins) > 0
+}
+
+// Merge the partial bin b into a. All of a's rows came before b's.
+func mergeAggregateContexts(scope *Scope, a *_AggregateContext, b *_AggregateContext) {
+	for _, key := range b.context.Keys() {
+		b_value, _ := b.context.Get(key)
+		a_value, _ := a.context.Get(key)
+
+		a_state, a_ok := a_value.(*_AggregateState)
+		b_state, b_ok := b_value.(*_AggregateState)
+		if a_ok && b_ok {
+			a_state.state = a_state.impl.Merge(scope, a_state.state, b_state.state)
+			continue
+		}
+
+		a.context.Set(key, b_value)
+	}
+
+	a.source = b.source
+}
@@ -0,0 +1,314 @@
+package vfilter
+
+// Hash protocol.
+
+// Grouping and de-duplicating rows requires a way to tell which
+// values are the same. Go map keys only work for comparable types so
+// arrays, dicts and most custom types can not be used directly. The
+// Hash protocol produces a canonical string for any value such that
+// values which are Eq() to each other produce the same hash. The
+// default implementation handles primitive types, arrays, maps,
+// anything which exposes members through a registered Associative
+// protocol and the exported fields of structs (or all their fields if
+// none are exported). Methods are never called since they may be
+// expensive or have side effects.
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Nested values deeper than this are not distinguished.
+const max_hash_depth = 20
+
+type HashProtocol interface {
+	Applicable(a Any) bool
+	Hash(scope *Scope, a Any) string
+}
+
+type _HashDispatcher struct {
+	impl []HashProtocol
+}
+
+func (self _HashDispatcher) Hash(scope *Scope, a Any) string {
+	return self.hash(scope, a, 0, nil)
+}
+
+// Like Hash() but times and strings which parse as a time are hashed
+// as the time they represent. They are appended to slots in the
+// order they are found.
+func (self _HashDispatcher) timeHash(scope *Scope, a Any, slots *[]Any) string {
+	return self.hash(scope, a, 0, slots)
+}
+
+func (self _HashDispatcher) hash(scope *Scope, a Any, depth int, slots *[]Any) string {
+	if depth > max_hash_depth {
+		return "..."
+	}
+
+	if slots != nil {
+		if is_time(a) {
+			*slots = append(*slots, a)
+			return "time:" + _TimeHash{}.Hash(scope, a)
+		}
+
+		if str, ok := to_string(a); ok {
+			if value, ok := to_time(str); ok {
+				*slots = append(*slots, str)
+				return "time:" + _TimeHash{}.Hash(scope, value)
+			}
+		}
+	}
+
+	for _, impl := range self.impl {
+		if impl.Applicable(a) {
+			return impl.Hash(scope, a)
+		}
+	}
+
+	if a == nil || is_null_obj(a) {
+		return "null"
+	}
+
+	// Bools are not numbers here so DISTINCT keeps TRUE and 1
+	// apart.
+	if b, ok := a.(bool); ok {
+		return strconv.FormatBool(b)
+	}
+
+	if str, ok := to_string(a); ok {
+		return strconv.Quote(str)
+	}
+
+	// Numbers which are Eq compare by value regardless of type.
+	if number, ok := to_float(a); ok {
+		return strconv.FormatFloat(number, 'g', -1, 64)
+	}
+
+	if dict, ok := to_dict(a); ok {
+		var items []string
+		for _, key := range dict.Keys() {
+			value, _ := dict.Get(key)
+			items = append(items, strconv.Quote(key)+":"+
+				self.hash(scope, value, depth+1, slots))
+		}
+		return "{" + strings.Join(items, ",") + "}"
+	}
+
+	// Rows like LazyRow or joined rows are hashed by their members.
+	if scope.associative.hasImpl(a) {
+		var items []string
+		for _, member := range scope.GetMembers(a) {
+			item, _ := scope.Associative(a, member)
+			items = append(items, strconv.Quote(member)+":"+
+				self.hash(scope, item, depth+1, slots))
+		}
+		return "{" + strings.Join(items, ",") + "}"
+	}
+
+	value := reflect.Indirect(reflect.ValueOf(a))
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		var items []string
+		for i := 0; i < value.Len(); i++ {
+			items = append(items, self.hash(
+				scope, value.Index(i).Interface(), depth+1, slots))
+		}
+		return "[" + strings.Join(items, ",") + "]"
+
+	case reflect.Map:
+		// Map iteration order is random so the items are sorted
+		// by their key.
+		type map_item struct {
+			key   string
+			value reflect.Value
+		}
+		var map_items []map_item
+		for _, key := range value.MapKeys() {
+			map_items = append(map_items, map_item{
+				key:   self.hash(scope, key.Interface(), depth+1, nil),
+				value: value.MapIndex(key),
+			})
+		}
+		sort.Slice(map_items, func(i, j int) bool {
+			return map_items[i].key < map_items[j].key
+		})
+
+		var items []string
+		for _, item := range map_items {
+			items = append(items, item.key+":"+self.hash(
+				scope, item.value.Interface(), depth+1, slots))
+		}
+		return "{" + strings.Join(items, ",") + "}"
+
+	case reflect.Struct:
+		// Only the exported fields are used.
+		var items []string
+		value_type := value.Type()
+		for i := 0; i < value.NumField(); i++ {
+			field := value_type.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			items = append(items, strconv.Quote(field.Name)+":"+
+				self.hash(scope, value.Field(i).Interface(), depth+1, slots))
+		}
+
+		// Opaque types (e.g. big.Int) only have unexported
+		// fields, which must still tell values apart.
+		if len(items) == 0 && value.NumField() > 0 {
+			return fmt.Sprintf("%T:%#v", a, value.Interface())
+		}
+		return fmt.Sprintf("%T{", a) + strings.Join(items, ",") + "}"
+	}
+
+	return fmt.Sprintf("%T:%v", a, a)
+}
+
+// Returns true if a registered implementation handles a.
+func (self _HashDispatcher) hasImpl(a Any) bool {
+	for _, impl := range self.impl {
+		if impl.Applicable(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *_HashDispatcher) AddImpl(elements ...HashProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+// Finds the group of values which are Eq to each other (used by
+// GROUP BY and DISTINCT). Values are mostly grouped by their Hash()
+// but a time is also Eq to a string which parses as the same time,
+// even though they hash differently. Values holding times or such
+// strings are therefore also indexed by their timeHash(), and values
+// with the same timeHash() are in the same group unless they differ
+// in one of their strings.
+type _HashIndex struct {
+	// The group of each hash seen so far.
+	groups map[string]string
+
+	// Values holding times or time strings by their timeHash().
+	by_time map[string][]*_HashEntry
+}
+
+// A value found in the index.
+type _HashEntry struct {
+	// The hash of the value's group.
+	group string
+
+	// The timeHash() of the value and its times and time
+	// strings, or empty if it has none.
+	time_hash string
+	slots     []Any
+}
+
+func newHashIndex() *_HashIndex {
+	return &_HashIndex{
+		groups:  make(map[string]string),
+		by_time: make(map[string][]*_HashEntry),
+	}
+}
+
+// Returns the entry for a and true if a belongs to a group which
+// was already added. Otherwise the entry starts a new group when it
+// is passed to Add().
+func (self *_HashIndex) Find(scope *Scope, a Any) (*_HashEntry, bool) {
+	hash := scope.Hash(a)
+	if group, pres := self.groups[hash]; pres {
+		return &_HashEntry{group: group}, true
+	}
+
+	entry := &_HashEntry{group: hash}
+	time_hash := scope.hash.timeHash(scope, a, &entry.slots)
+	if len(entry.slots) == 0 {
+		return entry, false
+	}
+
+	entry.time_hash = time_hash
+	for _, other := range self.by_time[time_hash] {
+		if entry.matches(other) {
+			// Later values with the same hash are in
+			// the same group.
+			entry.group = other.group
+			self.groups[hash] = other.group
+			self.by_time[time_hash] = append(self.by_time[time_hash], entry)
+			return entry, true
+		}
+	}
+
+	return entry, false
+}
+
+// Adds a new group for the entry returned by Find().
+func (self *_HashIndex) Add(entry *_HashEntry) {
+	self.groups[entry.group] = entry.group
+	if entry.time_hash != "" {
+		self.by_time[entry.time_hash] = append(
+			self.by_time[entry.time_hash], entry)
+	}
+}
+
+// Entries with the same timeHash() are Eq unless two of their
+// strings differ.
+func (self *_HashEntry) matches(other *_HashEntry) bool {
+	if len(self.slots) != len(other.slots) {
+		return false
+	}
+
+	for idx, slot := range self.slots {
+		str, ok := slot.(string)
+		if !ok {
+			continue
+		}
+
+		other_str, ok := other.slots[idx].(string)
+		if ok && str != other_str {
+			return false
+		}
+	}
+	return true
+}
+
+// Values Eq to each other are spilled into the same partition.
+func (self *_HashEntry) partitionHash() string {
+	if self.time_hash != "" {
+		return self.time_hash
+	}
+	return self.group
+}
+
+// Drops rows which were already seen (used by SELECT DISTINCT).
+type _DistinctFilter struct {
+	enabled bool
+	seen    *_HashIndex
+}
+
+func newDistinctFilter(enabled bool) *_DistinctFilter {
+	return &_DistinctFilter{
+		enabled: enabled,
+		seen:    newHashIndex(),
+	}
+}
+
+// Returns true if the row should be emitted.
+func (self *_DistinctFilter) Check(scope *Scope, row Row) bool {
+	if !self.enabled {
+		return true
+	}
+
+	entry, pres := self.seen.Find(scope, row)
+	if pres {
+		return false
+	}
+
+	self.seen.Add(entry)
+	return true
+}
@@ -0,0 +1,389 @@
+package vfilter
+
+// This file implements JOIN between plugins and stored queries.
+
+// A JOIN correlates rows from two sources:
+
+// SELECT * FROM a JOIN b ON a.x = b.y
+
+// Each source is known by its alias (either given with AS or the
+// name of the plugin). The rows emitted by the FROM clause are
+// joined rows which resolve an alias to the row from that source,
+// and any other column to the first source which has it. A LEFT
+// JOIN emits left rows without a match with the right alias set to
+// NULL.
+
+// The right source is read into memory once. When the ON clause
+// contains an equality between the two sides (e.g. a.x = b.y) the
+// right rows are bucketed by the Hash() of their key so each left
+// row only needs to be compared with the rows in its bucket. This is
+// only done for keys of the same kind whose hash agrees with Eq()
+// (strings, numbers, bools and types with a registered Hash
+// protocol). Keys of any other kind, or of a different kind than the
+// left key, are compared with the nested loop. Each candidate is then
+// confirmed by evaluating the entire ON clause so the result is the
+// same as the nested loop join which is used for all other
+// conditions.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+func (self _From) aliasName() string {
+	if self.Alias != "" {
+		return self.Alias
+	}
+	return self.Plugin.Name
+}
+
+func (self _From) evalJoins(ctx context.Context, scope *Scope) <-chan Row {
+	output_chan := make(chan Row)
+
+	go func() {
+		defer close(output_chan)
+
+		aliases := []string{self.aliasName()}
+		for _, join := range self.Joins {
+			alias := join.aliasName()
+			if InString(&aliases, alias) {
+				scope.Log("JOIN: Alias %v is used more than once. "+
+					"Use AS to give each source a unique name.", alias)
+				return
+			}
+			aliases = append(aliases, alias)
+		}
+
+		var input_chan <-chan Row = self.wrapRows(ctx, scope)
+		for idx, join := range self.Joins {
+			input_chan = join.Eval(ctx, scope, aliases[:idx+1], input_chan)
+		}
+
+		for row := range input_chan {
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- row:
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+// Wrap the rows of the leftmost source so they may be addressed by
+// their alias.
+func (self _From) wrapRows(ctx context.Context, scope *Scope) <-chan Row {
+	output_chan := make(chan Row)
+	alias := self.aliasName()
+
+	go func() {
+		defer close(output_chan)
+
+		for row := range self.Plugin.Eval(ctx, scope) {
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- (&_JoinedRow{}).join(alias, row):
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+// The columns of a join are only known if they are known for all
+// sources. Otherwise the caller needs to get them from the rows.
+func (self _From) Columns(scope *Scope) *[]string {
+	result := *self.Plugin.Columns(scope)
+	for _, join := range self.Joins {
+		columns := *join.Plugin.Columns(scope)
+		if len(result) == 0 || len(columns) == 0 {
+			return &[]string{}
+		}
+
+		for _, column := range columns {
+			if !InString(&result, column) {
+				result = append(result, column)
+			}
+		}
+	}
+
+	return &result
+}
+
+func (self _Join) aliasName() string {
+	if self.Alias != "" {
+		return self.Alias
+	}
+	return self.Plugin.Name
+}
+
+func (self _Join) ToString(scope *Scope) string {
+	result := "JOIN "
+	if self.Left {
+		result = "LEFT JOIN "
+	}
+
+	result += self.Plugin.ToString(scope)
+	if self.Alias != "" {
+		result += " AS " + quoteIdent(self.Alias)
+	}
+
+	return result + " ON " + self.On.ToString(scope)
+}
+
+// Join the rows from the left channel with the rows of this
+// source. left_aliases are the aliases already present in the left
+// rows.
+func (self _Join) Eval(ctx context.Context, scope *Scope,
+	left_aliases []string, left_chan <-chan Row) <-chan Row {
+	output_chan := make(chan Row)
+
+	go func() {
+		defer close(output_chan)
+
+		alias := self.aliasName()
+
+		// Read the right side into memory.
+		var right_rows []Row
+		for row := range self.Plugin.Eval(ctx, scope) {
+			right_rows = append(right_rows, row)
+		}
+
+		left_key, right_key := self.equiJoinKeys(left_aliases, alias)
+
+		// Right rows are bucketed by the kind and hash of their
+		// key. by_kind holds the rows of each kind so left keys
+		// can be compared with the rows of other kinds.
+		var buckets map[string][]int
+		var by_kind map[string][]int
+		if left_key != nil {
+			buckets = make(map[string][]int)
+			by_kind = make(map[string][]int)
+			for idx, row := range right_rows {
+				value := right_key.Reduce(ctx, scope.Copy().AppendVars(
+					(&_JoinedRow{}).join(alias, row)))
+				kind := hashKind(scope, value)
+				by_kind[kind] = append(by_kind[kind], idx)
+				if kind != "" {
+					key := kind + ":" + scope.Hash(value)
+					buckets[key] = append(buckets[key], idx)
+				}
+			}
+		}
+
+		for left_row := range left_chan {
+			joined_row := left_row.(*_JoinedRow)
+
+			var candidates []int
+			if left_key != nil {
+				value := left_key.Reduce(
+					ctx, scope.Copy().AppendVars(joined_row))
+				kind := hashKind(scope, value)
+				if kind == "" {
+					candidates = allIndexes(len(right_rows))
+				} else {
+					candidates = joinCandidates(
+						buckets[kind+":"+scope.Hash(value)],
+						kind, by_kind)
+				}
+			} else {
+				candidates = allIndexes(len(right_rows))
+			}
+
+			matched := false
+			for _, idx := range candidates {
+				new_row := joined_row.join(alias, right_rows[idx])
+
+				new_scope := scope.Copy()
+				new_scope.AppendVars(new_row)
+
+				if !scope.Bool(self.On.Reduce(ctx, new_scope)) {
+					continue
+				}
+
+				matched = true
+				select {
+				case <-ctx.Done():
+					return
+				case output_chan <- new_row:
+				}
+			}
+
+			if !matched && self.Left {
+				select {
+				case <-ctx.Done():
+					return
+				case output_chan <- joined_row.join(alias, Null{}):
+				}
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+// Find an equality term in the ON clause which compares a member of
+// the left rows with a member of the right rows. Returns nil if
+// there is no such term.
+func (self _Join) equiJoinKeys(left_aliases []string, right_alias string) (
+	left *_AdditionExpression, right *_AdditionExpression) {
+	terms := []*_OrExpression{self.On.Left}
+	for _, term := range self.On.Right {
+		terms = append(terms, term.Term)
+	}
+
+	for _, term := range terms {
+		if len(term.Right) > 0 {
+			continue
+		}
+
+		condition := term.Left
+		if condition.Not != nil || condition.Right == nil ||
+			condition.Right.Operator != "=" {
+			continue
+		}
+
+		lhs := rootSymbol(condition.Left)
+		rhs := rootSymbol(condition.Right.Right)
+		if InString(&left_aliases, lhs) && rhs == right_alias {
+			return condition.Left, condition.Right.Right
+		}
+
+		if InString(&left_aliases, rhs) && lhs == right_alias {
+			return condition.Right.Right, condition.Left
+		}
+	}
+
+	return nil, nil
+}
+
+// Returns the symbol a member expression is rooted at (e.g. "a" for
+// a.x.y) or "" if the expression is not a simple member expression.
+func rootSymbol(expr *_AdditionExpression) string {
+	if expr == nil || len(expr.Right) > 0 || len(expr.Left.Right) > 0 {
+		return ""
+	}
+
+	value := expr.Left.Left.Left
+	if value == nil || value.Negated || value.SymbolRef == nil ||
+		value.SymbolRef.Parameters != nil {
+		return ""
+	}
+
+	return value.SymbolRef.Symbol
+}
+
+// The kind of a join key whose Hash() agrees with Eq() for all keys
+// of the same kind, or "" if it can only be compared with Eq().
+func hashKind(scope *Scope, a Any) string {
+	if scope.hash.hasImpl(a) {
+		return fmt.Sprintf("%T", a)
+	}
+
+	switch a.(type) {
+	case bool:
+		return "bool"
+	case string:
+		return "string"
+	}
+
+	if _, ok := to_float(a); ok {
+		return "number"
+	}
+
+	return ""
+}
+
+// The rows in the bucket and all rows whose key is of a different
+// kind, in the order they were read.
+func joinCandidates(bucket []int, kind string, by_kind map[string][]int) []int {
+	if _, pres := by_kind[kind]; pres && len(by_kind) == 1 {
+		return bucket
+	}
+
+	result := append([]int{}, bucket...)
+	for other_kind, indexes := range by_kind {
+		if other_kind != kind {
+			result = append(result, indexes...)
+		}
+	}
+	sort.Ints(result)
+	return result
+}
+
+func allIndexes(length int) []int {
+	result := make([]int, 0, length)
+	for i := 0; i < length; i++ {
+		result = append(result, i)
+	}
+	return result
+}
+
+// A row produced by a JOIN. Each alias resolves to the row from that
+// source and all other members are resolved from the first source
+// which has them.
+type _JoinedRow struct {
+	aliases []string
+	rows    []Row
+}
+
+func (self *_JoinedRow) join(alias string, row Row) *_JoinedRow {
+	result := &_JoinedRow{
+		aliases: make([]string, 0, len(self.aliases)+1),
+		rows:    make([]Row, 0, len(self.rows)+1),
+	}
+	result.aliases = append(append(result.aliases, self.aliases...), alias)
+	result.rows = append(append(result.rows, self.rows...), row)
+
+	return result
+}
+
+type _JoinedRowAssociative struct{}
+
+func (self _JoinedRowAssociative) Applicable(a Any, b Any) bool {
+	_, a_ok := a.(*_JoinedRow)
+	_, b_ok := b.(string)
+	return a_ok && b_ok
+}
+
+func (self _JoinedRowAssociative) Associative(
+	scope *Scope, a Any, b Any) (Any, bool) {
+	row := a.(*_JoinedRow)
+	key := b.(string)
+
+	for idx, alias := range row.aliases {
+		if alias == key {
+			return row.rows[idx], true
+		}
+	}
+
+	for _, item := range row.rows {
+		// Unmatched rows of a LEFT JOIN have no members.
+		if is_null_obj(item) {
+			continue
+		}
+
+		value, pres := scope.Associative(item, key)
+		if pres {
+			return value, true
+		}
+	}
+
+	return nil, false
+}
+
+func (self _JoinedRowAssociative) GetMembers(scope *Scope, a Any) []string {
+	var result []string
+	for _, item := range a.(*_JoinedRow).rows {
+		for _, member := range scope.GetMembers(item) {
+			if !InString(&result, member) {
+				result = append(result, member)
+			}
+		}
+	}
+
+	return result
+}
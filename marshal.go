@@ -0,0 +1,368 @@
+package vfilter
+
+// Marshal protocol.
+
+// Query results are eventually written out by one of the encoders
+// (see encoders.go) which only understand plain JSON compatible
+// values: nil, bools, numbers, strings, arrays and dicts. The Marshal
+// protocol converts any other value into such a value. Clients may
+// register their own implementations to control how their types are
+// rendered, for example:
+
+// type _IPMarshaller struct{}
+//
+// func (self _IPMarshaller) Applicable(a Any) bool {
+//	_, ok := a.(net.IP)
+//	return ok
+// }
+//
+// func (self _IPMarshaller) Marshal(scope *Scope, a Any) Any {
+//	return a.(net.IP).String()
+// }
+//
+// scope.AddProtocolImpl(_IPMarshaller{})
+
+// The value returned by an implementation is itself marshalled so it
+// may contain other types which need converting. Values without an
+// implementation are converted by walking their members. Cycles are
+// replaced by nil, as are values nested deeper than max_marshal_depth.
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+const max_marshal_depth = 20
+
+type MarshalProtocol interface {
+	Applicable(a Any) bool
+	Marshal(scope *Scope, a Any) Any
+}
+
+type _MarshalDispatcher struct {
+	impl []MarshalProtocol
+}
+
+func (self _MarshalDispatcher) Marshal(
+	ctx context.Context, scope *Scope, a Any) Any {
+	return self.marshal(ctx, scope, a, 0, make(map[uintptr]bool))
+}
+
+// seen holds the containers on the path from the top level value
+// down to a, so a container which contains itself is detected while
+// one which merely appears several times is not.
+func (self _MarshalDispatcher) marshal(ctx context.Context, scope *Scope,
+	a Any, depth int, seen map[uintptr]bool) Any {
+	if depth > max_marshal_depth {
+		scope.Trace("Marshal: %T nested too deeply", a)
+		return nil
+	}
+
+	for _, impl := range self.impl {
+		if impl.Applicable(a) {
+			return self.marshal(ctx, scope, impl.Marshal(scope, a), depth+1, seen)
+		}
+	}
+
+	if is_null_obj(a) {
+		return nil
+	}
+
+	switch t := a.(type) {
+	case string, bool:
+		return a
+
+	// Times are always emitted in UTC so they sort and compare as
+	// strings.
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+
+	case *time.Time:
+		if t == nil {
+			return nil
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+
+	case time.Duration:
+		return t.String()
+
+	case []byte:
+		return string(t)
+
+	case StoredQuery:
+		rows := Materialize(ctx, scope, t)
+		result := make([]Any, 0, len(rows))
+		for _, row := range rows {
+			result = append(result, self.marshal(ctx, scope, row, depth+1, seen))
+		}
+		return result
+
+	// Args are stored as LazyExpr values.
+	case LazyExpr:
+		return self.marshal(ctx, scope, t.Reduce(), depth+1, seen)
+
+	case *LazyExpr:
+		return self.marshal(ctx, scope, t.Reduce(), depth+1, seen)
+
+	case *ordereddict.Dict:
+		return self.marshalDict(ctx, scope, t, depth, seen)
+
+	case ordereddict.Dict:
+		return self.marshalDict(ctx, scope, &t, depth, seen)
+
+	// The type knows how to serialize itself.
+	case json.Marshaler:
+		return a
+
+	case encoding.TextMarshaler:
+		text, err := t.MarshalText()
+		if err != nil {
+			return nil
+		}
+		return string(text)
+	}
+
+	if _, ok := to_float(a); ok {
+		return a
+	}
+
+	value := reflect.ValueOf(a)
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+
+		if value.Kind() == reflect.Ptr {
+			if !self.enter(value, seen) {
+				scope.Trace("Marshal: cycle detected in %T", a)
+				return nil
+			}
+			defer delete(seen, value.Pointer())
+		}
+
+		// Types which expose their members through a
+		// registered Associative protocol are marshalled by
+		// those members.
+		if scope.associative.hasImpl(a) {
+			return self.marshalMembers(ctx, scope, a, depth, seen)
+		}
+
+		return self.marshal(ctx, scope, value.Elem().Interface(), depth+1, seen)
+
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice {
+			if value.IsNil() {
+				return nil
+			}
+
+			if value.Len() > 0 {
+				if !self.enter(value, seen) {
+					scope.Trace("Marshal: cycle detected in %T", a)
+					return nil
+				}
+				defer delete(seen, value.Pointer())
+			}
+		}
+
+		result := make([]Any, 0, value.Len())
+		for i := 0; i < value.Len(); i++ {
+			result = append(result, self.marshal(
+				ctx, scope, value.Index(i).Interface(), depth+1, seen))
+		}
+		return result
+
+	case reflect.Map:
+		if value.IsNil() {
+			return nil
+		}
+
+		if !self.enter(value, seen) {
+			scope.Trace("Marshal: cycle detected in %T", a)
+			return nil
+		}
+		defer delete(seen, value.Pointer())
+
+		// Sort the keys like json.Marshal does because map
+		// iteration order is random.
+		keys := make(map[string]reflect.Value)
+		names := make([]string, 0, value.Len())
+		for _, key := range value.MapKeys() {
+			name := marshalMapKey(key)
+			keys[name] = key
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		result := ordereddict.NewDict()
+		for _, name := range names {
+			result.Set(name, self.marshal(ctx, scope,
+				value.MapIndex(keys[name]).Interface(), depth+1, seen))
+		}
+		return result
+
+	case reflect.Struct:
+		if scope.associative.hasImpl(a) {
+			return self.marshalMembers(ctx, scope, a, depth, seen)
+		}
+
+		result := ordereddict.NewDict()
+		self.marshalStruct(ctx, scope, value, result, depth, seen)
+		return result
+
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	}
+
+	return a
+}
+
+// Marks the container as being on the current path. Returns false if
+// it already was.
+func (self _MarshalDispatcher) enter(
+	value reflect.Value, seen map[uintptr]bool) bool {
+	ptr := value.Pointer()
+	if seen[ptr] {
+		return false
+	}
+	seen[ptr] = true
+	return true
+}
+
+func (self _MarshalDispatcher) marshalDict(ctx context.Context, scope *Scope,
+	dict *ordereddict.Dict, depth int, seen map[uintptr]bool) Any {
+	if !self.enter(reflect.ValueOf(dict), seen) {
+		scope.Trace("Marshal: cycle detected in dict")
+		return nil
+	}
+	defer delete(seen, reflect.ValueOf(dict).Pointer())
+
+	result := ordereddict.NewDict()
+	for _, key := range dict.Keys() {
+		value, _ := dict.Get(key)
+		result.Set(key, self.marshal(ctx, scope, value, depth+1, seen))
+	}
+	return result
+}
+
+func (self _MarshalDispatcher) marshalMembers(ctx context.Context, scope *Scope,
+	a Any, depth int, seen map[uintptr]bool) Any {
+	result := ordereddict.NewDict()
+	for _, member := range scope.GetMembers(a) {
+		value, pres := scope.Associative(a, member)
+		if pres {
+			result.Set(member, self.marshal(ctx, scope, value, depth+1, seen))
+		}
+	}
+	return result
+}
+
+// Add the exported fields of the struct to result, honouring the same
+// json tags as json.Marshal. Embedded structs without a tag have
+// their fields promoted.
+func (self _MarshalDispatcher) marshalStruct(ctx context.Context, scope *Scope,
+	value reflect.Value, result *ordereddict.Dict, depth int,
+	seen map[uintptr]bool) {
+	value_type := value.Type()
+	for i := 0; i < value.NumField(); i++ {
+		field := value_type.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := field.Name
+		omit_empty := false
+		if tag != "" {
+			parts := strings.Split(tag, ",")
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, option := range parts[1:] {
+				if option == "omitempty" {
+					omit_empty = true
+				}
+			}
+		}
+
+		field_value := value.Field(i)
+		if field.Anonymous && tag == "" {
+			embedded := field_value
+			if embedded.Kind() == reflect.Ptr {
+				if embedded.IsNil() {
+					continue
+				}
+				embedded = embedded.Elem()
+			}
+
+			if embedded.Kind() == reflect.Struct {
+				self.marshalStruct(ctx, scope, embedded, result, depth, seen)
+				continue
+			}
+		}
+
+		if !field_value.CanInterface() {
+			continue
+		}
+
+		if omit_empty && isEmptyValue(field_value) {
+			continue
+		}
+
+		result.Set(name, self.marshal(
+			ctx, scope, field_value.Interface(), depth+1, seen))
+	}
+}
+
+// Convert a map key to a string the same way json.Marshal does.
+// Other keys (e.g. floats) are formatted with fmt.
+func marshalMapKey(key reflect.Value) string {
+	if key.Kind() == reflect.String {
+		return key.String()
+	}
+
+	if key.Kind() != reflect.Ptr || !key.IsNil() {
+		if text_marshaler, ok := key.Interface().(encoding.TextMarshaler); ok {
+			text, err := text_marshaler.MarshalText()
+			if err == nil {
+				return string(text)
+			}
+		}
+	}
+
+	return fmt.Sprint(key.Interface())
+}
+
+func (self *_MarshalDispatcher) AddImpl(elements ...MarshalProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+// The values omitted by the json omitempty option.
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return value.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return value.IsNil()
+	}
+	return false
+}
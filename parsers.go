@@ -0,0 +1,351 @@
+package vfilter
+
+// Plugins which parse serialized query results back into rows.
+
+// The output of OutputJSON() or one of the encoders (see encoders.go)
+// can be fed back into a query with these plugins. The data may be
+// given as a string or as an io.Reader stored in the scope:
+
+// scope.AppendVars(ordereddict.NewDict().Set("Saved", fd))
+// SELECT * FROM parse_jsonl(data=Saved) WHERE Size > 10
+
+// Each row is an *ordereddict.Dict with the columns in the same
+// order as they appear in the data.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+type _ParsePluginArgs struct {
+	Data Any `vfilter:"required,field=data,doc=A string or an io.Reader to parse."`
+}
+
+// Get a reader for the data.
+func parseReader(data Any) (io.Reader, error) {
+	switch t := data.(type) {
+	case string:
+		return strings.NewReader(t), nil
+	case []byte:
+		return bytes.NewReader(t), nil
+	case io.Reader:
+		return t, nil
+	}
+
+	return nil, errors.New("data should be a string or an io.Reader.")
+}
+
+// Send the row unless the query is cancelled.
+func emitParsedRow(ctx context.Context, output_chan chan Row,
+	row *ordereddict.Dict) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case output_chan <- row:
+		return true
+	}
+}
+
+// Parses a JSON array of objects, as written by OutputJSON(). A
+// single object (or several objects one after the other) may also
+// be given.
+type _ParseJSONPlugin struct{}
+
+func (self _ParseJSONPlugin) Info(scope *Scope, type_map *TypeMap) *PluginInfo {
+	return &PluginInfo{
+		Name:    "parse_json",
+		Doc:     "Parse a JSON array of objects into rows.",
+		ArgType: type_map.AddType(scope, &_ParsePluginArgs{}),
+	}
+}
+
+func (self _ParseJSONPlugin) Call(ctx context.Context,
+	scope *Scope,
+	args *ordereddict.Dict) <-chan Row {
+	output_chan := make(chan Row)
+
+	go func() {
+		defer close(output_chan)
+
+		arg := _ParsePluginArgs{}
+		err := ExtractArgs(scope, args, &arg)
+		if err != nil {
+			// ExtractArgs already reported the error.
+			scope.Log("parse_json: %v", err)
+			return
+		}
+
+		reader, err := parseReader(arg.Data)
+		if err != nil {
+			scope.ReportError(newQueryError(ArgumentError,
+				"parse_json: %v", err))
+			return
+		}
+
+		// Peek at the first character to see if this is an
+		// array or a single object.
+		buffered := bufio.NewReader(reader)
+		first, err := peekNonSpace(buffered)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			scope.ReportError(newQueryError(TypeError,
+				"parse_json: %v", err))
+			return
+		}
+
+		decoder := json.NewDecoder(buffered)
+		switch first {
+		case '[':
+			_, err := decoder.Token()
+			if err != nil {
+				scope.ReportError(newQueryError(TypeError,
+					"parse_json: %v", err))
+				return
+			}
+
+		case '{':
+		default:
+			scope.ReportError(newQueryError(TypeError,
+				"parse_json: Expected an array of objects."))
+			return
+		}
+
+		for idx := 0; decoder.More(); idx++ {
+			var item json.RawMessage
+			err := decoder.Decode(&item)
+			if err != nil {
+				scope.ReportError(newQueryError(TypeError,
+					"parse_json: %v", err))
+				return
+			}
+
+			row := ordereddict.NewDict()
+			err = row.UnmarshalJSON(item)
+			if err != nil {
+				scope.ReportError(newQueryError(TypeError,
+					"parse_json: item %d: %v", idx, err))
+				continue
+			}
+
+			if !emitParsedRow(ctx, output_chan, row) {
+				return
+			}
+		}
+
+		// decoder.More() is also false at the end of the
+		// input, so make sure the array was closed.
+		if first == '[' {
+			token, err := decoder.Token()
+			if err != nil || token != json.Delim(']') {
+				scope.ReportError(newQueryError(TypeError,
+					"parse_json: Unterminated array."))
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+// Skip leading white space and return the next byte without
+// consuming it.
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		next, err := reader.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+
+		switch next[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = reader.ReadByte()
+		default:
+			return next[0], nil
+		}
+	}
+}
+
+// Parses one JSON object per line, as written by the jsonl
+// encoder. Lines which fail to parse are reported and skipped.
+type _ParseJSONLPlugin struct{}
+
+func (self _ParseJSONLPlugin) Info(scope *Scope, type_map *TypeMap) *PluginInfo {
+	return &PluginInfo{
+		Name:    "parse_jsonl",
+		Doc:     "Parse one JSON object per line into rows.",
+		ArgType: type_map.AddType(scope, &_ParsePluginArgs{}),
+	}
+}
+
+func (self _ParseJSONLPlugin) Call(ctx context.Context,
+	scope *Scope,
+	args *ordereddict.Dict) <-chan Row {
+	output_chan := make(chan Row)
+
+	go func() {
+		defer close(output_chan)
+
+		arg := _ParsePluginArgs{}
+		err := ExtractArgs(scope, args, &arg)
+		if err != nil {
+			// ExtractArgs already reported the error.
+			scope.Log("parse_jsonl: %v", err)
+			return
+		}
+
+		reader, err := parseReader(arg.Data)
+		if err != nil {
+			scope.ReportError(newQueryError(ArgumentError,
+				"parse_jsonl: %v", err))
+			return
+		}
+
+		buffered := bufio.NewReader(reader)
+		for line_number := 1; ; line_number++ {
+			line, err := buffered.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				scope.ReportError(newQueryError(TypeError,
+					"parse_jsonl: %v", err))
+				return
+			}
+
+			if len(bytes.TrimSpace(line)) > 0 {
+				row := ordereddict.NewDict()
+				parse_err := row.UnmarshalJSON(line)
+				if parse_err != nil {
+					scope.ReportError(newQueryError(TypeError,
+						"parse_jsonl: line %d: %v", line_number, parse_err))
+
+				} else if !emitParsedRow(ctx, output_chan, row) {
+					return
+				}
+			}
+
+			if err == io.EOF {
+				return
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+type _ParseCSVPluginArgs struct {
+	Data      Any    `vfilter:"required,field=data,doc=A string or an io.Reader to parse."`
+	Separator string `vfilter:"optional,field=separator,doc=The field separator (default ,)."`
+}
+
+// Parses comma (or otherwise) separated values with a header
+// line. Since CSV has no types, cells which hold an integer or a
+// float in canonical form are converted to numbers so they can be
+// aggregated. Everything else remains a string.
+type _ParseCSVPlugin struct{}
+
+func (self _ParseCSVPlugin) Info(scope *Scope, type_map *TypeMap) *PluginInfo {
+	return &PluginInfo{
+		Name:    "parse_csv",
+		Doc:     "Parse CSV data with a header line into rows.",
+		ArgType: type_map.AddType(scope, &_ParseCSVPluginArgs{}),
+	}
+}
+
+func (self _ParseCSVPlugin) Call(ctx context.Context,
+	scope *Scope,
+	args *ordereddict.Dict) <-chan Row {
+	output_chan := make(chan Row)
+
+	go func() {
+		defer close(output_chan)
+
+		arg := _ParseCSVPluginArgs{}
+		err := ExtractArgs(scope, args, &arg)
+		if err != nil {
+			// ExtractArgs already reported the error.
+			scope.Log("parse_csv: %v", err)
+			return
+		}
+
+		reader, err := parseReader(arg.Data)
+		if err != nil {
+			scope.ReportError(newQueryError(ArgumentError,
+				"parse_csv: %v", err))
+			return
+		}
+
+		csv_reader := csv.NewReader(reader)
+		csv_reader.FieldsPerRecord = -1
+		if arg.Separator != "" {
+			separator := []rune(arg.Separator)
+			if len(separator) != 1 {
+				scope.ReportError(newQueryError(ArgumentError,
+					"parse_csv: Separator should be a single character."))
+				return
+			}
+			csv_reader.Comma = separator[0]
+		}
+
+		headers, err := csv_reader.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			scope.ReportError(newQueryError(TypeError,
+				"parse_csv: %v", err))
+			return
+		}
+
+		for {
+			record, err := csv_reader.Read()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				scope.ReportError(newQueryError(TypeError,
+					"parse_csv: %v", err))
+				return
+			}
+
+			row := ordereddict.NewDict()
+			for idx, header := range headers {
+				if idx < len(record) {
+					row.Set(header, parseCSVCell(record[idx]))
+				}
+			}
+
+			if !emitParsedRow(ctx, output_chan, row) {
+				return
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+// Only convert numbers which print back the same way so values like
+// "007" or "1.50" are left alone.
+func parseCSVCell(cell string) Any {
+	if value, err := strconv.ParseInt(cell, 10, 64); err == nil &&
+		strconv.FormatInt(value, 10) == cell {
+		return value
+	}
+
+	// NaN and Inf would be lost when the row is serialized.
+	if value, err := strconv.ParseFloat(cell, 64); err == nil &&
+		!math.IsNaN(value) && !math.IsInf(value, 0) &&
+		strconv.FormatFloat(value, 'f', -1, 64) == cell {
+		return value
+	}
+
+	return cell
+}
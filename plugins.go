@@ -7,6 +7,9 @@ import (
 	"github.com/Velocidex/ordereddict"
 )
 
+// Plugins receive their args like functions do (see
+// FunctionInterface), so args passed by position are keyed "$0", "$1"
+// etc.
 type PluginGeneratorInterface interface {
 	Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) <-chan Row
 	Info(scope *Scope, type_map *TypeMap) *PluginInfo
@@ -133,7 +136,8 @@ func (self _ChainPlugin) Info(scope *Scope, type_map *TypeMap) *PluginInfo {
 	return &PluginInfo{
 		Name: "chain",
 		Doc: "Chain the output of several queries into the same table." +
-			"This plugin takes any args and chains them.",
+			"This plugin takes any args and chains them, positional " +
+			"args first.",
 	}
 }
 
@@ -144,8 +148,20 @@ func (self _ChainPlugin) Call(
 	output_chan := make(chan Row)
 
 	queries := []StoredQuery{}
+	// Positional args are chained in order, followed by the
+	// keyword args in sorted order.
 	members := scope.GetMembers(args)
-	sort.Strings(members)
+	sort.Slice(members, func(i, j int) bool {
+		pos_i, pos_j := isPositionalArg(members[i]), isPositionalArg(members[j])
+		if pos_i && pos_j {
+			return len(members[i]) < len(members[j]) ||
+				len(members[i]) == len(members[j]) && members[i] < members[j]
+		}
+		if pos_i != pos_j {
+			return pos_i
+		}
+		return members[i] < members[j]
+	})
 
 	go func() {
 		defer close(output_chan)
@@ -159,8 +175,8 @@ func (self _ChainPlugin) Call(
 
 			query, ok := member_obj.(StoredQuery)
 			if !ok {
-				scope.Log("Parameter " + member +
-					" should be a query")
+				scope.ReportError(newQueryError(TypeError,
+					"Parameter %v should be a query", member))
 				return
 			}
 
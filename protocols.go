@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 type _BoolDispatcher struct {
@@ -780,6 +781,17 @@ func (self *_AssociativeDispatcher) GetMembers(
 	return DefaultAssociative{}.GetMembers(scope, a)
 }
 
+// Returns true if a registered implementation handles a (rather than
+// the reflection based default).
+func (self *_AssociativeDispatcher) hasImpl(a Any) bool {
+	for _, impl := range self.impl {
+		if impl.Applicable(a, "") {
+			return true
+		}
+	}
+	return false
+}
+
 func (self *_AssociativeDispatcher) AddImpl(elements ...AssociativeProtocol) {
 	for _, impl := range elements {
 		self.impl = append(self.impl, impl)
@@ -967,21 +979,39 @@ func (self _SubstringRegex) Match(scope *Scope, pattern Any, target Any) bool {
 	pattern_string, _ := to_string(pattern)
 	target_string, _ := to_string(target)
 
-	re, pres := scope.regexp_cache[pattern_string]
-	if !pres {
-		var err error
-		re, err = regexp.Compile("(?i)" + pattern_string)
-		if err != nil {
-			scope.Log("Compile regexp: %v", err)
-			return false
-		}
-
-		scope.regexp_cache[pattern_string] = re
+	re, err := compileRegex(scope, pattern_string)
+	if err != nil {
+		scope.Log("Compile regexp: %v", err)
+		return false
 	}
 
 	return re.MatchString(target_string)
 }
 
+// Compile a VQL regular expression, caching it in the scope. VQL
+// regular expressions are case insensitive.
+func compileRegex(scope *Scope, pattern string) (*regexp.Regexp, error) {
+	// The cache is shared by all copies of the scope, which may be
+	// used from several goroutines.
+	regexp_cache_mu.Lock()
+	defer regexp_cache_mu.Unlock()
+
+	re, pres := scope.regexp_cache[pattern]
+	if pres {
+		return re, nil
+	}
+
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	scope.regexp_cache[pattern] = re
+	return re, nil
+}
+
+var regexp_cache_mu sync.Mutex
+
 type _ArrayRegex struct{}
 
 func (self _ArrayRegex) Applicable(pattern Any, target Any) bool {
@@ -1000,6 +1030,122 @@ func (self _ArrayRegex) Match(scope *Scope, pattern Any, target Any) bool {
 	return false
 }
 
+// Like protocol: SQL style pattern matching where % matches any
+// sequence of characters and _ matches a single character. Like the
+// regex protocol, matching is case insensitive.
+type LikeProtocol interface {
+	Applicable(pattern Any, target Any) bool
+	Like(scope *Scope, pattern Any, target Any) bool
+}
+
+type _LikeDispatcher struct {
+	impl []LikeProtocol
+}
+
+func (self _LikeDispatcher) Like(scope *Scope, pattern Any, target Any) bool {
+	for _, impl := range self.impl {
+		if impl.Applicable(pattern, target) {
+			return impl.Like(scope, pattern, target)
+		}
+	}
+
+	scope.Trace("Protocol Like not found for %v (%T) and %v (%T)",
+		pattern, pattern, target, target)
+
+	return false
+}
+
+func (self *_LikeDispatcher) AddImpl(elements ...LikeProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+// Convert a LIKE pattern to an anchored regular expression. A
+// backslash escapes the next character.
+func likeToRegex(pattern string) string {
+	result := "^"
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			result += regexp.QuoteMeta(string(c))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '%':
+			result += "(?s:.*)"
+		case c == '_':
+			result += "(?s:.)"
+		default:
+			result += regexp.QuoteMeta(string(c))
+		}
+	}
+
+	return result + "$"
+}
+
+type _StringLike struct{}
+
+func (self _StringLike) Applicable(pattern Any, target Any) bool {
+	_, a_ok := to_string(pattern)
+	_, b_ok := to_string(target)
+
+	return a_ok && b_ok
+}
+
+func (self _StringLike) Like(scope *Scope, pattern Any, target Any) bool {
+	pattern_string, _ := to_string(pattern)
+
+	// The translated pattern shares the regex protocol's cache.
+	return _SubstringRegex{}.Match(scope, likeToRegex(pattern_string), target)
+}
+
+type _ArrayLike struct{}
+
+func (self _ArrayLike) Applicable(pattern Any, target Any) bool {
+	_, pattern_ok := to_string(pattern)
+	return pattern_ok && is_array(target)
+}
+
+func (self _ArrayLike) Like(scope *Scope, pattern Any, target Any) bool {
+	a_slice := reflect.ValueOf(target)
+	for i := 0; i < a_slice.Len(); i++ {
+		if scope.Like(pattern, a_slice.Index(i).Interface()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsNull protocol: used by IS NULL and IS NOT NULL. Types which
+// represent a missing value may implement this to compare as NULL.
+type IsNullProtocol interface {
+	Applicable(a Any) bool
+	IsNull(scope *Scope, a Any) bool
+}
+
+type _IsNullDispatcher struct {
+	impl []IsNullProtocol
+}
+
+func (self _IsNullDispatcher) IsNull(scope *Scope, a Any) bool {
+	for _, impl := range self.impl {
+		if impl.Applicable(a) {
+			return impl.IsNull(scope, a)
+		}
+	}
+
+	return a == nil || is_null_obj(a)
+}
+
+func (self *_IsNullDispatcher) AddImpl(elements ...IsNullProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
 type StringProtocol interface {
 	ToString(scope *Scope) string
 }
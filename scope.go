@@ -1,6 +1,7 @@
 package vfilter
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"regexp"
@@ -49,9 +50,21 @@ type Scope struct {
 	sub         _SubDispatcher
 	mul         _MulDispatcher
 	div         _DivDispatcher
+	mod         _ModDispatcher
+	bitwise_and _BitwiseAndDispatcher
+	bitwise_or  _BitwiseOrDispatcher
+	bitwise_xor _BitwiseXorDispatcher
+	left_shift  _LeftShiftDispatcher
+	right_shift _RightShiftDispatcher
+	bitwise_not _BitwiseNotDispatcher
 	membership  _MembershipDispatcher
 	associative _AssociativeDispatcher
+	slice       _SliceDispatcher
 	regex       _RegexDispatcher
+	like        _LikeDispatcher
+	is_null     _IsNullDispatcher
+	hash        _HashDispatcher
+	marshal     _MarshalDispatcher
 
 	Logger *log.Logger
 
@@ -62,6 +75,27 @@ type Scope struct {
 	regexp_cache map[string]*regexp.Regexp
 
 	context *ordereddict.Dict
+
+	// If set, structured errors are recorded here.
+	errors *ErrorCollector
+
+	// The function or plugin call currently being evaluated. Used
+	// to attribute errors (e.g. from ExtractArgs) to the AST node
+	// which caused them.
+	call_site _ErrorNode
+
+	// ORDER BY, GROUP BY and window functions spill rows to
+	// spill_dir once they buffer more than memory_budget bytes (0
+	// means no limit).
+	memory_budget int64
+	spill_dir     string
+
+	// The number of goroutines GROUP BY uses to aggregate rows.
+	aggregate_workers int
+
+	// The number of nested calls to user defined functions and
+	// queries.
+	call_depth int
 }
 
 func (self *Scope) GetContext(name string) Any {
@@ -166,6 +200,41 @@ func (self *Scope) Div(a Any, b Any) Any {
 	return self.div.Div(self, a, b)
 }
 
+// The remainder of a divided by b.
+func (self *Scope) Mod(a Any, b Any) Any {
+	return self.mod.Mod(self, a, b)
+}
+
+// Bitwise AND of a and b.
+func (self *Scope) BitwiseAnd(a Any, b Any) Any {
+	return self.bitwise_and.BitwiseAnd(self, a, b)
+}
+
+// Bitwise OR of a and b.
+func (self *Scope) BitwiseOr(a Any, b Any) Any {
+	return self.bitwise_or.BitwiseOr(self, a, b)
+}
+
+// Bitwise XOR of a and b.
+func (self *Scope) BitwiseXor(a Any, b Any) Any {
+	return self.bitwise_xor.BitwiseXor(self, a, b)
+}
+
+// Shift a left by b bits.
+func (self *Scope) LeftShift(a Any, b Any) Any {
+	return self.left_shift.LeftShift(self, a, b)
+}
+
+// Shift a right by b bits.
+func (self *Scope) RightShift(a Any, b Any) Any {
+	return self.right_shift.RightShift(self, a, b)
+}
+
+// Bitwise complement of a.
+func (self *Scope) BitwiseNot(a Any) Any {
+	return self.bitwise_not.BitwiseNot(self, a)
+}
+
 // Is a a member in b?
 func (self *Scope) Membership(a Any, b Any) bool {
 	return self.membership.Membership(self, a, b)
@@ -181,11 +250,36 @@ func (self *Scope) GetMembers(a Any) []string {
 	return self.associative.GetMembers(self, a)
 }
 
+// The items of a between start and end (i.e. a[start:end]).
+func (self *Scope) Slice(a Any, start Any, end Any) Any {
+	return self.slice.Slice(self, a, start, end)
+}
+
 // Does the regex a match object b.
 func (self *Scope) Match(a Any, b Any) bool {
 	return self.regex.Match(self, a, b)
 }
 
+// Does the LIKE pattern a match object b.
+func (self *Scope) Like(a Any, b Any) bool {
+	return self.like.Like(self, a, b)
+}
+
+// Is a NULL?
+func (self *Scope) IsNull(a Any) bool {
+	return self.is_null.IsNull(self, a)
+}
+
+// A canonical string for a. Values which are equal have the same hash.
+func (self *Scope) Hash(a Any) string {
+	return self.hash.Hash(self, a)
+}
+
+// Convert a into a value which can be serialized as JSON.
+func (self *Scope) Marshal(ctx context.Context, a Any) Any {
+	return self.marshal.Marshal(ctx, self, a)
+}
+
 /*
 func (self Scope) Copy() *Scope {
 	copy_of_vars := append([]Row{}, self.vars...)
@@ -206,6 +300,13 @@ func (self *Scope) Copy() *Scope {
 		regexp_cache: self.regexp_cache,
 		vars:         append([]Row{}, self.vars...),
 		context:      self.context,
+		errors:       self.errors,
+		call_site:    self.call_site,
+
+		memory_budget:     self.memory_budget,
+		spill_dir:         self.spill_dir,
+		aggregate_workers: self.aggregate_workers,
+		call_depth:        self.call_depth,
 
 		bool:        self.bool,
 		eq:          self.eq,
@@ -214,9 +315,21 @@ func (self *Scope) Copy() *Scope {
 		sub:         self.sub,
 		mul:         self.mul,
 		div:         self.div,
+		mod:         self.mod,
+		bitwise_and: self.bitwise_and,
+		bitwise_or:  self.bitwise_or,
+		bitwise_xor: self.bitwise_xor,
+		left_shift:  self.left_shift,
+		right_shift: self.right_shift,
+		bitwise_not: self.bitwise_not,
 		membership:  self.membership,
 		associative: self.associative,
+		slice:       self.slice,
 		regex:       self.regex,
+		like:        self.like,
+		is_null:     self.is_null,
+		hash:        self.hash,
+		marshal:     self.marshal,
 	}
 }
 
@@ -243,12 +356,36 @@ func (self *Scope) AddProtocolImpl(implementations ...Any) *Scope {
 			self.mul.AddImpl(t)
 		case DivProtocol:
 			self.div.AddImpl(t)
+		case ModProtocol:
+			self.mod.AddImpl(t)
+		case BitwiseAndProtocol:
+			self.bitwise_and.AddImpl(t)
+		case BitwiseOrProtocol:
+			self.bitwise_or.AddImpl(t)
+		case BitwiseXorProtocol:
+			self.bitwise_xor.AddImpl(t)
+		case LeftShiftProtocol:
+			self.left_shift.AddImpl(t)
+		case RightShiftProtocol:
+			self.right_shift.AddImpl(t)
+		case BitwiseNotProtocol:
+			self.bitwise_not.AddImpl(t)
 		case MembershipProtocol:
 			self.membership.AddImpl(t)
 		case AssociativeProtocol:
 			self.associative.AddImpl(t)
+		case SliceProtocol:
+			self.slice.AddImpl(t)
 		case RegexProtocol:
 			self.regex.AddImpl(t)
+		case LikeProtocol:
+			self.like.AddImpl(t)
+		case IsNullProtocol:
+			self.is_null.AddImpl(t)
+		case HashProtocol:
+			self.hash.AddImpl(t)
+		case MarshalProtocol:
+			self.marshal.AddImpl(t)
 		default:
 			Debug(t)
 			panic("Unsupported interface")
@@ -286,6 +423,29 @@ func (self *Scope) AppendFunctions(functions ...FunctionInterface) *Scope {
 	return result
 }
 
+// Add aggregate functions to the scope. These are called from VQL
+// like any other function but summarise their args over all the rows
+// in each group.
+func (self *Scope) AppendAggregators(aggregators ...AggregatorInterface) *Scope {
+	functions := make([]FunctionInterface, 0, len(aggregators))
+	for _, aggregator := range aggregators {
+		functions = append(functions, _AggregateFunction{impl: aggregator})
+	}
+
+	return self.AppendFunctions(functions...)
+}
+
+// Add window functions to the scope. These may only be called with an
+// OVER clause.
+func (self *Scope) AppendWindowFunctions(functions ...WindowFunctionInterface) *Scope {
+	adapted := make([]FunctionInterface, 0, len(functions))
+	for _, function := range functions {
+		adapted = append(adapted, _WindowFunction{impl: function})
+	}
+
+	return self.AppendFunctions(adapted...)
+}
+
 // Add plugins (data sources) to the scope. VQL queries may select
 // from these newly added plugins.
 func (self *Scope) AppendPlugins(plugins ...PluginGeneratorInterface) *Scope {
@@ -323,6 +483,54 @@ func (self *Scope) Log(format string, a ...interface{}) {
 	}
 }
 
+// Install an error collector in this scope. Errors raised while
+// evaluating queries in this scope (or any scope copied from it) are
+// recorded in the collector.
+func (self *Scope) SetErrorCollector(collector *ErrorCollector) *Scope {
+	self.Lock()
+	defer self.Unlock()
+
+	self.errors = collector
+	return self
+}
+
+// Report a structured error. The error message is logged and the
+// error is recorded in the error collector if one is installed.
+func (self *Scope) ReportError(err *QueryError) {
+	self.Log("%v", err.Message)
+	self.recordError(err)
+}
+
+// Record the error in the error collector without logging it.
+func (self *Scope) recordError(err *QueryError) {
+	if self.errors == nil || err.recorded {
+		return
+	}
+	err.recorded = true
+
+	// Blame the current call site if the error does not specify
+	// a node.
+	if err.Node == "" && self.call_site != nil {
+		err.Node = self.call_site.toString(self)
+		err.Pos = self.call_site.position()
+	}
+
+	self.errors.Add(err)
+}
+
+// Returns a scope which attributes errors to the node. Since this
+// is only useful when errors are collected, we avoid copying the
+// scope if there is no collector.
+func (self *Scope) withCallSite(node _ErrorNode) *Scope {
+	if self.errors == nil {
+		return self
+	}
+
+	result := self.Copy()
+	result.call_site = node
+	return result
+}
+
 func (self *Scope) Trace(format string, a ...interface{}) {
 	self.Lock()
 	defer self.Unlock()
@@ -385,28 +593,57 @@ func NewScope() *Scope {
 		_AddNull{}, _AddStrings{}, _AddInts{}, _AddFloats{}, _AddSlices{}, _AddSliceAny{},
 		_StoredQueryAdd{},
 		_SubInts{}, _SubFloats{},
+		_TimeLt{}, _TimeEq{}, _TimeAdd{}, _TimeSub{},
+		_DurationLt{}, _DurationEq{}, _DurationAdd{}, _DurationSub{},
+		_TimeHash{}, _DurationHash{},
 		_SubstringMembership{},
 		_MulInt{}, _NumericMul{},
 		_NumericDiv{},
+		_ModInt{}, _NumericMod{},
+		_BitwiseAndInt{}, _BitwiseOrInt{}, _BitwiseXorInt{},
+		_LeftShiftInt{}, _RightShiftInt{}, _BitwiseNotInt{},
 		_DictAssociative{},
 		_SubstringRegex{}, _ArrayRegex{},
+		_StringLike{}, _ArrayLike{},
+		_SliceString{}, _SliceArray{},
 		_StoredQueryAssociative{}, _StoredQueryBool{},
-		_ScopeAssociative{}, _LazyRowAssociative{},
+		_ScopeAssociative{}, _LazyRowAssociative{}, _JoinedRowAssociative{},
 	)
 
 	// Built in functions.
 	result.AppendFunctions(
 		_DictFunc{},
 		_Timestamp{},
+		_NowFunction{},
 		_SubSelectFunction{},
 		_SplitFunction{},
 		_IfFunction{},
 		_GetFunction{},
 		_EncodeFunction{},
+	)
+
+	result.AppendAggregators(
 		_CountFunction{},
 		_MinFunction{},
 		_MaxFunction{},
 		_EnumerateFunction{},
+		_SumFunction{},
+		_AvgFunction{_NumericStatsAggregate{name: "avg"}},
+		_VarianceFunction{_NumericStatsAggregate{name: "variance"}},
+		_StddevFunction{_NumericStatsAggregate{name: "stddev"}},
+		_PercentileFunction{},
+		_CountDistinctFunction{},
+		_FirstFunction{},
+		_LastFunction{},
+		_HistogramFunction{},
+	)
+
+	result.AppendWindowFunctions(
+		_RowNumberFunction{},
+		_RankFunction{},
+		_DenseRankFunction{},
+		_LagFunction{name: "lag", direction: -1},
+		_LagFunction{name: "lead", direction: 1},
 	)
 
 	result.AppendPlugins(
@@ -414,6 +651,9 @@ func NewScope() *Scope {
 		_FlattenPluginImpl{},
 		_ChainPlugin{},
 		_ForeachPluginImpl{},
+		_ParseJSONPlugin{},
+		_ParseJSONLPlugin{},
+		_ParseCSVPlugin{},
 		&GenericListPlugin{
 			PluginName: "scope",
 			Function: func(scope *Scope, args *ordereddict.Dict) []Row {
@@ -454,6 +694,69 @@ func (self *Scope) Resolve(field string) (interface{}, bool) {
 	return default_value, default_value != nil
 }
 
+// Limit the approximate number of bytes that ORDER BY, GROUP BY and
+// window functions may buffer in memory. Rows beyond the budget are
+// spilled to temporary files. A budget of 0 (the default) means no
+// limit. Window functions still hold the rows of one partition in
+// memory. Setting a budget disables parallel aggregation (see
+// SetAggregateWorkers()).
+func (self *Scope) SetMemoryBudget(budget int64) *Scope {
+	self.Lock()
+	defer self.Unlock()
+
+	self.memory_budget = budget
+	return self
+}
+
+// Set the directory for temporary spill files. By default the
+// system's temporary directory is used.
+func (self *Scope) SetSpillDirectory(directory string) *Scope {
+	self.Lock()
+	defer self.Unlock()
+
+	self.spill_dir = directory
+	return self
+}
+
+// Aggregate GROUP BY queries (and queries using aggregate functions)
+// using several goroutines. This helps when evaluating the columns is
+// expensive. The results are the same as when aggregating with a
+// single goroutine (the default).
+//
+// Only aggregates implementing AggregatorInterface can be aggregated
+// in parallel. Queries calling any other aggregate function, such as
+// a FunctionInterface which keeps its state with SetContext(), are
+// aggregated with a single goroutine. So are all queries when a memory
+// budget is set (see SetMemoryBudget()).
+func (self *Scope) SetAggregateWorkers(workers int) *Scope {
+	self.Lock()
+	defer self.Unlock()
+
+	self.aggregate_workers = workers
+	return self
+}
+
+func (self *Scope) aggregateWorkers() int {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.aggregate_workers
+}
+
+func (self *Scope) memoryBudget() int64 {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.memory_budget
+}
+
+func (self *Scope) spillDirectory() string {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.spill_dir
+}
+
 // Scope Associative
 type _ScopeAssociative struct{}
 
@@ -0,0 +1,149 @@
+package vfilter
+
+// Slice protocol.
+
+// Implements x[start:end]. Either bound may be omitted, in which case
+// it is passed to the protocol as Null. As in Python, negative bounds
+// count from the end and out of range bounds are clamped so slicing
+// never fails - it just returns fewer items. The default
+// implementations handle strings (by character), []byte and arrays.
+
+import (
+	"reflect"
+)
+
+type SliceProtocol interface {
+	Applicable(a Any) bool
+	Slice(scope *Scope, a Any, start Any, end Any) Any
+}
+
+type _SliceDispatcher struct {
+	impl []SliceProtocol
+}
+
+func (self _SliceDispatcher) Slice(scope *Scope, a Any, start Any, end Any) Any {
+	for _, impl := range self.impl {
+		if impl.Applicable(a) {
+			return impl.Slice(scope, a, start, end)
+		}
+	}
+
+	scope.Trace("Protocol Slice not found for %v (%T)", a, a)
+	return Null{}
+}
+
+func (self *_SliceDispatcher) AddImpl(elements ...SliceProtocol) {
+	for _, impl := range elements {
+		self.impl = append(self.impl, impl)
+	}
+}
+
+// The length of an array or slice.
+func sliceLength(a Any) (int, bool) {
+	if a == nil {
+		return 0, false
+	}
+
+	value := reflect.Indirect(reflect.ValueOf(a))
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array, reflect.String:
+		return value.Len(), true
+	}
+
+	return 0, false
+}
+
+// Resolve the start and end of a slice of a sequence with length
+// items. Returns false if the bounds are not numbers.
+func sliceBounds(length int, start Any, end Any) (int, int, bool) {
+	resolve := func(bound Any, default_value int) (int, bool) {
+		if is_null_obj(bound) {
+			return default_value, true
+		}
+
+		if !is_integral(bound) {
+			return 0, false
+		}
+
+		idx, _ := to_int64(bound)
+		if idx < 0 {
+			idx += int64(length)
+		}
+
+		if idx < 0 {
+			return 0, true
+		}
+
+		if idx > int64(length) {
+			return length, true
+		}
+
+		return int(idx), true
+	}
+
+	start_idx, ok := resolve(start, 0)
+	if !ok {
+		return 0, 0, false
+	}
+
+	end_idx, ok := resolve(end, length)
+	if !ok {
+		return 0, 0, false
+	}
+
+	if end_idx < start_idx {
+		end_idx = start_idx
+	}
+
+	return start_idx, end_idx, true
+}
+
+type _SliceString struct{}
+
+func (self _SliceString) Applicable(a Any) bool {
+	switch a.(type) {
+	case string, *string, []byte:
+		return true
+	}
+	return false
+}
+
+func (self _SliceString) Slice(scope *Scope, a Any, start Any, end Any) Any {
+	if data, ok := a.([]byte); ok {
+		start_idx, end_idx, ok := sliceBounds(len(data), start, end)
+		if !ok {
+			return Null{}
+		}
+		return data[start_idx:end_idx]
+	}
+
+	str, _ := to_string(a)
+	runes := []rune(str)
+	start_idx, end_idx, ok := sliceBounds(len(runes), start, end)
+	if !ok {
+		return Null{}
+	}
+
+	return string(runes[start_idx:end_idx])
+}
+
+type _SliceArray struct{}
+
+func (self _SliceArray) Applicable(a Any) bool {
+	return is_array(a)
+}
+
+func (self _SliceArray) Slice(scope *Scope, a Any, start Any, end Any) Any {
+	value := reflect.Indirect(reflect.ValueOf(a))
+	start_idx, end_idx, ok := sliceBounds(value.Len(), start, end)
+	if !ok {
+		return Null{}
+	}
+
+	result := make([]Any, 0, end_idx-start_idx)
+	for i := start_idx; i < end_idx; i++ {
+		result = append(result, value.Index(i).Interface())
+	}
+
+	return result
+}
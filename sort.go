@@ -1,5 +1,9 @@
 package vfilter
 
+import (
+	"context"
+)
+
 type ResultSet struct {
 	Items   []Row
 	OrderBy string
@@ -11,21 +15,22 @@ func (self *ResultSet) Len() int {
 	return len(self.Items)
 }
 
+// Rows which do not have the OrderBy column sort as NULL.
 func (self *ResultSet) Less(i, j int) bool {
 	element1, pres1 := self.scope.Associative(
 		self.Items[i], self.OrderBy)
-	element2, pres2 := self.scope.Associative(
-		self.Items[j], self.OrderBy)
-
-	if !pres1 || !pres2 {
-		return false
+	if !pres1 {
+		element1 = Null{}
 	}
 
-	if self.Desc {
-		return !self.scope.Lt(element1, element2)
+	element2, pres2 := self.scope.Associative(
+		self.Items[j], self.OrderBy)
+	if !pres2 {
+		element2 = Null{}
 	}
 
-	return self.scope.Lt(element1, element2)
+	term := &_OrderByTerm{Desc: self.Desc}
+	return term.compare(self.scope, element1, element2) < 0
 }
 
 func (self *ResultSet) Swap(i, j int) {
@@ -33,3 +38,77 @@ func (self *ResultSet) Swap(i, j int) {
 	self.Items[i] = self.Items[j]
 	self.Items[j] = element1
 }
+
+// Evaluate the ORDER BY terms in a scope containing the source row
+// and the transformed row.
+func orderByKeys(ctx context.Context, scope *Scope,
+	terms []*_OrderByTerm, source Row, row Row) []Any {
+	// Order matters - transformed row may mask original row.
+	row_scope := scope.Copy()
+	row_scope.AppendVars(source)
+	row_scope.AppendVars(row)
+
+	keys := make([]Any, 0, len(terms))
+	for _, term := range terms {
+		keys = append(keys, term.Expression.Reduce(ctx, row_scope))
+	}
+
+	return keys
+}
+
+// Compare the keys of two rows. Returns -1 if a sorts before b, 1 if
+// b sorts before a and 0 if they are equivalent.
+func compareTerms(scope *Scope, terms []*_OrderByTerm, a []Any, b []Any) int {
+	for idx, term := range terms {
+		result := term.compare(scope, a[idx], b[idx])
+		if result != 0 {
+			return result
+		}
+	}
+
+	return 0
+}
+
+func (self *_OrderByTerm) compare(scope *Scope, a Any, b Any) int {
+	a_null := is_null_obj(a)
+	b_null := is_null_obj(b)
+
+	if a_null || b_null {
+		if a_null && b_null {
+			return 0
+		}
+
+		nulls_first := self.NullsFirst || (self.Desc && !self.NullsLast)
+		if a_null == nulls_first {
+			return -1
+		}
+		return 1
+	}
+
+	result := 0
+	if scope.Lt(a, b) {
+		result = -1
+	} else if scope.Lt(b, a) {
+		result = 1
+	}
+
+	if self.Desc {
+		return -result
+	}
+	return result
+}
+
+// Compare two tuples of keys in order.
+func compareKeys(scope *Scope, a []Any, b []Any) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if scope.Lt(a[i], b[i]) {
+			return -1
+		}
+
+		if scope.Lt(b[i], a[i]) {
+			return 1
+		}
+	}
+
+	return len(a) - len(b)
+}
@@ -0,0 +1,821 @@
+package vfilter
+
+// Disk spilling for ORDER BY, GROUP BY and window functions.
+
+// Sorting, grouping and window functions need to see all the rows
+// before they can emit any. By default all rows are buffered in
+// memory. When the caller sets a memory budget on the scope
+// (Scope.SetMemoryBudget()), rows which exceed the budget are
+// serialized to temporary files and merged back when the results are
+// emitted.
+
+// ORDER BY uses an external merge sort: once the buffered rows exceed
+// the budget they are sorted and written to a run file. The runs are
+// then merged together with the remaining rows in memory.
+
+// GROUP BY partitions its input: once the budget is exceeded, rows
+// belonging to groups which are already in memory continue to be
+// aggregated, but rows for new groups are written to one of several
+// partition files based on the hash of their group by keys. All the
+// rows of a group therefore end up in the same partition, which is
+// aggregated separately after the in memory groups are done.
+
+// Window functions sort the rows of each window by partition with an
+// external sort, so only one partition is in memory at a time.
+
+// Spilled rows are serialized as JSON with each value tagged by its
+// type, so they are read back as the same Go values.
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+const (
+	// Number of partition files GROUP BY spills into.
+	spill_partitions = 8
+
+	// Partitions may themselves be partitioned again if they
+	// are still too large. Beyond this depth we stay in memory.
+	max_spill_level = 3
+
+	// Nested values beyond this depth are not counted when
+	// estimating the size of a row.
+	max_estimate_depth = 10
+)
+
+type _SortItem struct {
+	seq  int64
+	keys []Any
+	row  Row
+}
+
+// A spilled value tagged with its type so it is read back as the same
+// Go type.
+type _SpillValue struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v,omitempty"`
+}
+
+type _SpillField struct {
+	Key   string       `json:"k"`
+	Value *_SpillValue `json:"v"`
+}
+
+type _SpillRecord struct {
+	Seq  int64          `json:"seq"`
+	Keys []*_SpillValue `json:"keys"`
+	Row  *_SpillValue   `json:"row"`
+}
+
+// The rows of a JOIN are spilled with their aliases so they may still
+// be accessed by alias once read back.
+type _SpillJoinedRow struct {
+	Aliases []string       `json:"aliases"`
+	Rows    []*_SpillValue `json:"rows"`
+}
+
+// Serialize the item as a single line of JSON.
+func (self *_SortItem) marshal(scope *Scope, file *_SpillFile) ([]byte, error) {
+	record := &_SpillRecord{Seq: self.seq}
+	for _, key := range self.keys {
+		value, err := file.encode(key)
+		if err != nil {
+			return nil, err
+		}
+		record.Keys = append(record.Keys, value)
+	}
+
+	row, err := file.encodeRow(scope, self.row)
+	if err != nil {
+		return nil, err
+	}
+	record.Row = row
+
+	serialized, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(serialized, '\n'), nil
+}
+
+func (self *_SpillFile) unmarshal(data []byte) (*_SortItem, error) {
+	record := &_SpillRecord{}
+	err := json.Unmarshal(data, record)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &_SortItem{seq: record.Seq}
+	for _, key := range record.Keys {
+		value, err := self.decode(key)
+		if err != nil {
+			return nil, err
+		}
+		result.keys = append(result.keys, value)
+	}
+
+	row, err := self.decode(record.Row)
+	if err != nil {
+		return nil, err
+	}
+	result.row = row
+
+	return result, nil
+}
+
+// Rows are spilled as dicts of their members, except for the rows
+// of a JOIN which keep the row of each source. The unmatched rows of
+// a LEFT JOIN are NULL.
+func (self *_SpillFile) encodeRow(scope *Scope, row Row) (*_SpillValue, error) {
+	joined, ok := row.(*_JoinedRow)
+	if ok {
+		record := &_SpillJoinedRow{Aliases: joined.aliases}
+		for _, item := range joined.rows {
+			value, err := self.encodeRow(scope, item)
+			if err != nil {
+				return nil, err
+			}
+			record.Rows = append(record.Rows, value)
+		}
+		return newSpillValue("joined", record)
+	}
+
+	if is_null_obj(row) {
+		return self.encode(row)
+	}
+
+	return self.encode(rowToDict(scope, row))
+}
+
+func newSpillValue(tag string, value interface{}) (*_SpillValue, error) {
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return &_SpillValue{Type: tag, Value: serialized}, nil
+}
+
+// Encode a value so it may be decoded back into the same Go type.
+// Types which can not be faithfully serialized (e.g. structs, stored
+// queries or typed slices) are retained in memory and only
+// referenced from the file.
+func (self *_SpillFile) encode(value Any) (*_SpillValue, error) {
+	switch t := value.(type) {
+	case nil:
+		return &_SpillValue{Type: "nil"}, nil
+	case Null:
+		return &_SpillValue{Type: "null"}, nil
+	case *Null:
+		if t != nil {
+			return &_SpillValue{Type: "null"}, nil
+		}
+	case LazyExpr:
+		return self.encode(t.Reduce())
+	case *LazyExpr:
+		return self.encode(t.Reduce())
+	case bool:
+		return newSpillValue("bool", t)
+	case string:
+		return newSpillValue("string", t)
+	case []byte:
+		return newSpillValue("bytes", t)
+	case int:
+		return newSpillValue("int", strconv.FormatInt(int64(t), 10))
+	case int8:
+		return newSpillValue("int8", strconv.FormatInt(int64(t), 10))
+	case int16:
+		return newSpillValue("int16", strconv.FormatInt(int64(t), 10))
+	case int32:
+		return newSpillValue("int32", strconv.FormatInt(int64(t), 10))
+	case int64:
+		return newSpillValue("int64", strconv.FormatInt(t, 10))
+	case uint:
+		return newSpillValue("uint", strconv.FormatUint(uint64(t), 10))
+	case uint8:
+		return newSpillValue("uint8", strconv.FormatUint(uint64(t), 10))
+	case uint16:
+		return newSpillValue("uint16", strconv.FormatUint(uint64(t), 10))
+	case uint32:
+		return newSpillValue("uint32", strconv.FormatUint(uint64(t), 10))
+	case uint64:
+		return newSpillValue("uint64", strconv.FormatUint(t, 10))
+	case float32:
+		// Floats are serialized as strings since JSON can not
+		// represent NaN and Inf.
+		return newSpillValue("float32",
+			strconv.FormatFloat(float64(t), 'g', -1, 32))
+	case float64:
+		return newSpillValue("float64", strconv.FormatFloat(t, 'g', -1, 64))
+	case time.Duration:
+		return newSpillValue("duration", strconv.FormatInt(int64(t), 10))
+	case time.Time:
+		// Only the offset is serialized so other locations
+		// would not be restored.
+		if t.Location() != time.UTC && t.Location() != time.Local {
+			break
+		}
+		serialized, err := t.MarshalText()
+		if err != nil {
+			break
+		}
+		return newSpillValue("time", string(serialized))
+	case []Any:
+		items := make([]*_SpillValue, 0, len(t))
+		for _, item := range t {
+			value, err := self.encode(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return newSpillValue("array", items)
+	case *ordereddict.Dict:
+		if t == nil {
+			break
+		}
+		fields := make([]_SpillField, 0, t.Len())
+		for _, key := range t.Keys() {
+			item, _ := t.Get(key)
+			value, err := self.encode(item)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, _SpillField{Key: key, Value: value})
+		}
+		return newSpillValue("dict", fields)
+	}
+
+	self.retained = append(self.retained, value)
+	return newSpillValue("retained", len(self.retained)-1)
+}
+
+func (self *_SpillFile) decode(value *_SpillValue) (Any, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch value.Type {
+	case "nil":
+		return nil, nil
+
+	case "null":
+		return Null{}, nil
+
+	case "bool":
+		var result bool
+		err := json.Unmarshal(value.Value, &result)
+		return result, err
+
+	case "string":
+		var result string
+		err := json.Unmarshal(value.Value, &result)
+		return result, err
+
+	case "bytes":
+		var result []byte
+		err := json.Unmarshal(value.Value, &result)
+		return result, err
+
+	case "int", "int8", "int16", "int32", "int64", "duration":
+		var serialized string
+		err := json.Unmarshal(value.Value, &serialized)
+		if err != nil {
+			return nil, err
+		}
+		result, err := strconv.ParseInt(serialized, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		switch value.Type {
+		case "int":
+			return int(result), nil
+		case "int8":
+			return int8(result), nil
+		case "int16":
+			return int16(result), nil
+		case "int32":
+			return int32(result), nil
+		case "duration":
+			return time.Duration(result), nil
+		}
+		return result, nil
+
+	case "uint", "uint8", "uint16", "uint32", "uint64":
+		var serialized string
+		err := json.Unmarshal(value.Value, &serialized)
+		if err != nil {
+			return nil, err
+		}
+		result, err := strconv.ParseUint(serialized, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		switch value.Type {
+		case "uint":
+			return uint(result), nil
+		case "uint8":
+			return uint8(result), nil
+		case "uint16":
+			return uint16(result), nil
+		case "uint32":
+			return uint32(result), nil
+		}
+		return result, nil
+
+	case "float32", "float64":
+		var serialized string
+		err := json.Unmarshal(value.Value, &serialized)
+		if err != nil {
+			return nil, err
+		}
+		if value.Type == "float32" {
+			result, err := strconv.ParseFloat(serialized, 32)
+			return float32(result), err
+		}
+		return strconv.ParseFloat(serialized, 64)
+
+	case "time":
+		var serialized string
+		err := json.Unmarshal(value.Value, &serialized)
+		if err != nil {
+			return nil, err
+		}
+		result := time.Time{}
+		err = result.UnmarshalText([]byte(serialized))
+		return result, err
+
+	case "array":
+		var items []*_SpillValue
+		err := json.Unmarshal(value.Value, &items)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]Any, 0, len(items))
+		for _, item := range items {
+			decoded, err := self.decode(item)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, decoded)
+		}
+		return result, nil
+
+	case "dict":
+		var fields []_SpillField
+		err := json.Unmarshal(value.Value, &fields)
+		if err != nil {
+			return nil, err
+		}
+		result := ordereddict.NewDict()
+		for _, field := range fields {
+			decoded, err := self.decode(field.Value)
+			if err != nil {
+				return nil, err
+			}
+			result.Set(field.Key, decoded)
+		}
+		return result, nil
+
+	case "joined":
+		record := &_SpillJoinedRow{}
+		err := json.Unmarshal(value.Value, record)
+		if err != nil {
+			return nil, err
+		}
+		result := &_JoinedRow{aliases: record.Aliases}
+		for _, item := range record.Rows {
+			decoded, err := self.decode(item)
+			if err != nil {
+				return nil, err
+			}
+			result.rows = append(result.rows, decoded)
+		}
+		return result, nil
+
+	case "retained":
+		var idx int
+		err := json.Unmarshal(value.Value, &idx)
+		if err != nil {
+			return nil, err
+		}
+		if idx < 0 || idx >= len(self.retained) {
+			return nil, fmt.Errorf("Invalid spilled value %v", idx)
+		}
+		return self.retained[idx], nil
+	}
+
+	return nil, fmt.Errorf("Unknown spilled type %v", value.Type)
+}
+
+// A temporary file holding serialized items.
+type _SpillFile struct {
+	fd   *os.File
+	path string
+
+	// Values which are kept in memory.
+	retained []Any
+}
+
+func newSpillFile(scope *Scope) (*_SpillFile, error) {
+	fd, err := ioutil.TempFile(scope.spillDirectory(), "vql_spill")
+	if err != nil {
+		return nil, err
+	}
+
+	return &_SpillFile{fd: fd, path: fd.Name()}, nil
+}
+
+func (self *_SpillFile) Write(scope *Scope, item *_SortItem) error {
+	serialized, err := item.marshal(scope, self)
+	if err != nil {
+		return err
+	}
+
+	_, err = self.fd.Write(serialized)
+	return err
+}
+
+// Read the items back from the start of the file.
+func (self *_SpillFile) Items(ctx context.Context, scope *Scope) <-chan *_SortItem {
+	output_chan := make(chan *_SortItem)
+
+	go func() {
+		defer close(output_chan)
+
+		_, err := self.fd.Seek(0, io.SeekStart)
+		if err != nil {
+			scope.Log("Unable to read spill file: %v", err)
+			return
+		}
+
+		decoder := json.NewDecoder(self.fd)
+		for {
+			var data json.RawMessage
+			err := decoder.Decode(&data)
+			if err == io.EOF {
+				return
+			}
+
+			if err != nil {
+				scope.Log("Unable to read spill file: %v", err)
+				return
+			}
+
+			item, err := self.unmarshal(data)
+			if err != nil {
+				scope.Log("Unable to read spill file: %v", err)
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- item:
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+func (self *_SpillFile) Close() {
+	self.fd.Close()
+	os.Remove(self.path)
+	self.retained = nil
+}
+
+// Roughly estimate the memory used by a row. Values are walked
+// without calling any methods so stored queries and lazy
+// expressions are not evaluated.
+func estimateSize(item *_SortItem) int64 {
+	result := estimateValueSize(reflect.ValueOf(item.row), 0)
+	for _, key := range item.keys {
+		result += estimateValueSize(reflect.ValueOf(key), 0)
+	}
+	return result
+}
+
+func estimateValueSize(value reflect.Value, depth int) int64 {
+	// Words used by an interface or pointer.
+	const word = 8
+
+	if !value.IsValid() || depth > max_estimate_depth {
+		return word
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		return 2*word + int64(value.Len())
+
+	case reflect.Interface, reflect.Ptr:
+		if value.IsNil() {
+			return word
+		}
+		return word + estimateValueSize(value.Elem(), depth+1)
+
+	case reflect.Slice, reflect.Array:
+		result := int64(3 * word)
+		for i := 0; i < value.Len(); i++ {
+			result += estimateValueSize(value.Index(i), depth+1)
+		}
+		return result
+
+	case reflect.Map:
+		result := int64(6 * word)
+		iter := value.MapRange()
+		for iter.Next() {
+			result += estimateValueSize(iter.Key(), depth+1) +
+				estimateValueSize(iter.Value(), depth+1)
+		}
+		return result
+
+	case reflect.Struct:
+		result := int64(0)
+		for i := 0; i < value.NumField(); i++ {
+			result += estimateValueSize(value.Field(i), depth+1)
+		}
+		return result
+	}
+
+	return int64(value.Type().Size())
+}
+
+// Sorts rows by their keys, spilling sorted runs to disk when the
+// memory budget is exceeded. Rows with equal keys are emitted in
+// order of their seq.
+type _ExternalSorter struct {
+	scope   *Scope
+	compare func(a []Any, b []Any) int
+
+	items []*_SortItem
+	size  int64
+	runs  []*_SpillFile
+
+	// Set when spilling failed. The remaining items are kept in
+	// memory rather than risking more failures.
+	spill_failed bool
+}
+
+func newExternalSorter(scope *Scope,
+	compare func(a []Any, b []Any) int) *_ExternalSorter {
+	return &_ExternalSorter{
+		scope:   scope,
+		compare: compare,
+	}
+}
+
+func (self *_ExternalSorter) less(a *_SortItem, b *_SortItem) bool {
+	result := self.compare(a.keys, b.keys)
+	if result != 0 {
+		return result < 0
+	}
+	return a.seq < b.seq
+}
+
+func (self *_ExternalSorter) Add(ctx context.Context,
+	seq int64, keys []Any, row Row) {
+	item := &_SortItem{seq: seq, keys: keys, row: row}
+	self.items = append(self.items, item)
+
+	budget := self.scope.memoryBudget()
+	if budget <= 0 || self.spill_failed {
+		return
+	}
+
+	self.size += estimateSize(item)
+	if self.size > budget {
+		self.spill(ctx)
+	}
+}
+
+// Write the items in memory to a new sorted run. If this fails all
+// items are kept in memory and no more runs are spilled.
+func (self *_ExternalSorter) spill(ctx context.Context) {
+	run, err := newSpillFile(self.scope)
+	if err == nil {
+		err = self.writeRun(run)
+	}
+
+	if err != nil {
+		self.scope.Log("Unable to spill rows to disk, keeping them in memory: %v", err)
+		self.spill_failed = true
+	}
+}
+
+// Write the items to the run. The items are only released once they
+// were all written, otherwise the partial run is removed.
+func (self *_ExternalSorter) writeRun(run *_SpillFile) error {
+	self.sortItems()
+	for _, item := range self.items {
+		err := run.Write(self.scope, item)
+		if err != nil {
+			run.Close()
+			return err
+		}
+	}
+
+	self.runs = append(self.runs, run)
+	self.items = nil
+	self.size = 0
+
+	return nil
+}
+
+func (self *_ExternalSorter) sortItems() {
+	sort.SliceStable(self.items, func(i, j int) bool {
+		return self.less(self.items[i], self.items[j])
+	})
+}
+
+// Emit all the rows in sorted order.
+func (self *_ExternalSorter) Rows(ctx context.Context) <-chan Row {
+	output_chan := make(chan Row)
+
+	go func() {
+		defer close(output_chan)
+
+		for item := range self.Items(ctx) {
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- item.row:
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+// Emit all the items in sorted order.
+func (self *_ExternalSorter) Items(ctx context.Context) <-chan *_SortItem {
+	output_chan := make(chan *_SortItem)
+
+	go func() {
+		defer close(output_chan)
+
+		self.sortItems()
+
+		// Everything fits in memory.
+		if len(self.runs) == 0 {
+			for _, item := range self.items {
+				select {
+				case <-ctx.Done():
+					return
+				case output_chan <- item:
+				}
+			}
+			return
+		}
+
+		sub_ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		merger := &_SortMerger{sorter: self}
+		for _, run := range self.runs {
+			merger.add(run.Items(sub_ctx, self.scope))
+		}
+
+		memory_chan := make(chan *_SortItem)
+		go func() {
+			defer close(memory_chan)
+
+			for _, item := range self.items {
+				select {
+				case <-sub_ctx.Done():
+					return
+				case memory_chan <- item:
+				}
+			}
+		}()
+		merger.add(memory_chan)
+
+		for merger.Len() > 0 {
+			head := merger.heads[0]
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- head.item:
+			}
+
+			item, ok := <-head.source
+			if ok {
+				head.item = item
+				heap.Fix(merger, 0)
+			} else {
+				heap.Pop(merger)
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+// Remove any temporary files.
+func (self *_ExternalSorter) Close() {
+	for _, run := range self.runs {
+		run.Close()
+	}
+	self.runs = nil
+	self.items = nil
+}
+
+type _MergeHead struct {
+	item   *_SortItem
+	source <-chan *_SortItem
+}
+
+// A heap of the next item from each sorted run.
+type _SortMerger struct {
+	sorter *_ExternalSorter
+	heads  []*_MergeHead
+}
+
+func (self *_SortMerger) add(source <-chan *_SortItem) {
+	item, ok := <-source
+	if ok {
+		heap.Push(self, &_MergeHead{item: item, source: source})
+	}
+}
+
+func (self *_SortMerger) Len() int {
+	return len(self.heads)
+}
+
+func (self *_SortMerger) Less(i, j int) bool {
+	return self.sorter.less(self.heads[i].item, self.heads[j].item)
+}
+
+func (self *_SortMerger) Swap(i, j int) {
+	self.heads[i], self.heads[j] = self.heads[j], self.heads[i]
+}
+
+func (self *_SortMerger) Push(x interface{}) {
+	self.heads = append(self.heads, x.(*_MergeHead))
+}
+
+func (self *_SortMerger) Pop() interface{} {
+	last := self.heads[len(self.heads)-1]
+	self.heads = self.heads[:len(self.heads)-1]
+	return last
+}
+
+// Rows for groups which did not fit in memory, split into partitions
+// by the hash of their group by keys.
+type _GroupPartitions struct {
+	scope *Scope
+	level int
+	files [spill_partitions]*_SpillFile
+}
+
+func newGroupPartitions(scope *Scope, level int) *_GroupPartitions {
+	return &_GroupPartitions{scope: scope, level: level}
+}
+
+// Returns false if the item could not be spilled.
+func (self *_GroupPartitions) Add(ctx context.Context,
+	bin_hash string, item *_SortItem) bool {
+	// Mix in the level so a partition is split differently when
+	// it is partitioned again.
+	hasher := fnv.New32a()
+	hasher.Write([]byte(strconv.Itoa(self.level) + bin_hash))
+	idx := hasher.Sum32() % spill_partitions
+
+	if self.files[idx] == nil {
+		file, err := newSpillFile(self.scope)
+		if err != nil {
+			self.scope.Log("Unable to spill rows to disk: %v", err)
+			return false
+		}
+		self.files[idx] = file
+	}
+
+	err := self.files[idx].Write(self.scope, item)
+	if err != nil {
+		self.scope.Log("Unable to spill rows to disk: %v", err)
+		return false
+	}
+	return true
+}
+
+func (self *_GroupPartitions) Close() {
+	for idx, file := range self.files {
+		if file != nil {
+			file.Close()
+			self.files[idx] = nil
+		}
+	}
+}
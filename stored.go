@@ -23,6 +23,9 @@ package vfilter
 import (
 	"context"
 	"reflect"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
 )
 
 // A plugin like object which takes no arguments but may be inserted
@@ -188,3 +191,151 @@ func Materialize(ctx context.Context, scope *Scope, stored_query StoredQuery) []
 
 	return result
 }
+
+// Bind the args passed to a user defined function or query to its
+// parameter names. The function body is evaluated in a sub scope of
+// the caller so it may also refer to any variables visible to the
+// caller.
+func bindParameters(scope *Scope,
+	parameters []string, args *ordereddict.Dict) *Scope {
+	vars := ordereddict.NewDict()
+
+	// Parameters which are not passed are NULL.
+	for _, parameter := range parameters {
+		vars.Set(parameter, Null{})
+	}
+
+	for _, name := range args.Keys() {
+		value, _ := args.Get(name)
+
+		// Positional args bind to the parameters in order.
+		for idx, parameter := range parameters {
+			if name == positionalArg(idx) {
+				if _, pres := args.Get(parameter); pres {
+					scope.Log("Parameter %s is given both by position and by name.",
+						parameter)
+					scope.recordError(newQueryError(ArgumentError,
+						"Parameter %s is given both by position and by name.",
+						parameter))
+				}
+				name = parameter
+				break
+			}
+		}
+
+		if !InString(&parameters, name) {
+			scope.Log("Extra unrecognized arg: %s", name)
+			scope.recordError(newQueryError(ArgumentError,
+				"Extra unrecognized arg: %s", name))
+			continue
+		}
+
+		lazy_arg, ok := value.(LazyExpr)
+		if ok {
+			value = lazy_arg.Reduce()
+		}
+		vars.Set(name, value)
+	}
+
+	return scope.Copy().AppendVars(vars)
+}
+
+// User defined functions and queries may not be nested deeper than
+// this.
+const max_call_depth = 100
+
+// Returns false if calling a user defined function or query would
+// nest more than max_call_depth calls, for example when it calls
+// itself without terminating.
+func checkCallDepth(scope *Scope, name string) bool {
+	if scope.call_depth < max_call_depth {
+		return true
+	}
+
+	scope.ReportError(newQueryError(RecursionError,
+		"Calling %v: nested more than %v calls deep", name, max_call_depth))
+	return false
+}
+
+// A user defined function created by a LET statement with an
+// expression, e.g.:
+
+// LET is_big(f) = f.Size > 1000
+// SELECT * FROM glob() WHERE is_big(f=FileInfo)
+
+// Parameters are bound to the args passed in the call and the
+// expression is then reduced.
+type _StoredExpression struct {
+	name       string
+	parameters []string
+	expr       *_AndExpression
+}
+
+func (self *_StoredExpression) Call(
+	ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	if !checkCallDepth(scope, self.name) {
+		return Null{}
+	}
+
+	sub_scope := bindParameters(scope, self.parameters, args)
+	sub_scope.call_depth++
+	return self.expr.Reduce(ctx, sub_scope)
+}
+
+func (self *_StoredExpression) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name: self.name,
+		Doc:  "User defined function: " + self.ToString(scope),
+	}
+}
+
+func (self *_StoredExpression) ToString(scope *Scope) string {
+	return self.name + "(" + strings.Join(self.parameters, ", ") +
+		") = " + self.expr.ToString(scope)
+}
+
+// A stored query with parameters created by a LET statement, e.g.:
+
+// LET files(root) = SELECT * FROM glob(root=root)
+// SELECT * FROM files(root="/tmp")
+
+// It behaves like a plugin which binds its args to the parameter
+// names before evaluating the query. It may also be used as a
+// regular stored query in which case all parameters are NULL.
+type _ParameterizedQuery struct {
+	name       string
+	parameters []string
+	query      *_Select
+}
+
+func (self *_ParameterizedQuery) Call(
+	ctx context.Context, scope *Scope, args *ordereddict.Dict) <-chan Row {
+	if !checkCallDepth(scope, self.name) {
+		output_chan := make(chan Row)
+		close(output_chan)
+		return output_chan
+	}
+
+	sub_scope := bindParameters(scope, self.parameters, args)
+	sub_scope.call_depth++
+	return self.query.Eval(ctx, sub_scope)
+}
+
+func (self *_ParameterizedQuery) Info(scope *Scope, type_map *TypeMap) *PluginInfo {
+	return &PluginInfo{
+		Name: self.name,
+		Doc:  "User defined query: " + self.ToString(scope),
+	}
+}
+
+func (self *_ParameterizedQuery) Eval(ctx context.Context, scope *Scope) <-chan Row {
+	return self.Call(ctx, scope, ordereddict.NewDict())
+}
+
+func (self *_ParameterizedQuery) Columns(scope *Scope) *[]string {
+	return NewStoredQuery(self.query).Columns(scope)
+}
+
+func (self *_ParameterizedQuery) ToString(scope *Scope) string {
+	return self.query.ToString(scope)
+}
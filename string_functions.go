@@ -0,0 +1,468 @@
+package vfilter
+
+// A pack of string functions. These are not registered by NewScope()
+// - callers opt in with:
+
+// scope.AppendFunctions(vfilter.StringFunctions()...)
+
+// Regular expressions follow the same rules as the =~ operator (they
+// are case insensitive) and share the scope's regexp cache.
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+// The functions in the string function pack.
+func StringFunctions() []FunctionInterface {
+	return []FunctionInterface{
+		_FormatFunction{},
+		_UpperFunction{},
+		_LowerFunction{},
+		_StripFunction{},
+		_SubstrFunction{},
+		_ReplaceFunction{},
+		_RegexReplaceFunction{},
+		_RegexExtractFunction{},
+		_LenFunction{},
+		_JoinFunction{},
+		_StartsWithFunction{},
+		_EndsWithFunction{},
+		_PadFunction{},
+	}
+}
+
+type _FormatFunctionArgs struct {
+	Format string `vfilter:"required,field=format"`
+	Args   []Any  `vfilter:"optional,field=args,rest"`
+}
+
+type _FormatFunction struct{}
+
+func (self _FormatFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "format",
+		Doc:     "Format the args using a Go style format string (e.g. format('%v-%d', x, 5)).",
+		ArgType: type_map.AddType(scope, _FormatFunctionArgs{}),
+	}
+}
+
+func (self _FormatFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_FormatFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("format: %s", err.Error())
+		return Null{}
+	}
+
+	var format_args []interface{}
+	for _, item := range arg.Args {
+		format_args = append(format_args, item)
+	}
+
+	return fmt.Sprintf(arg.Format, format_args...)
+}
+
+type _StringFunctionArgs struct {
+	String string `vfilter:"required,field=string"`
+}
+
+type _UpperFunction struct{}
+
+func (self _UpperFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "upper",
+		Doc:     "Convert a string to upper case.",
+		ArgType: type_map.AddType(scope, _StringFunctionArgs{}),
+	}
+}
+
+func (self _UpperFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_StringFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("upper: %s", err.Error())
+		return Null{}
+	}
+
+	return strings.ToUpper(arg.String)
+}
+
+type _LowerFunction struct{}
+
+func (self _LowerFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "lower",
+		Doc:     "Convert a string to lower case.",
+		ArgType: type_map.AddType(scope, _StringFunctionArgs{}),
+	}
+}
+
+func (self _LowerFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_StringFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("lower: %s", err.Error())
+		return Null{}
+	}
+
+	return strings.ToLower(arg.String)
+}
+
+type _StripFunctionArgs struct {
+	String string `vfilter:"required,field=string"`
+	Cutset string `vfilter:"optional,field=cutset"`
+}
+
+type _StripFunction struct{}
+
+func (self _StripFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "strip",
+		Doc:     "Remove the characters in cutset (by default whitespace) from both ends of the string.",
+		ArgType: type_map.AddType(scope, _StripFunctionArgs{}),
+	}
+}
+
+func (self _StripFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_StripFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("strip: %s", err.Error())
+		return Null{}
+	}
+
+	if arg.Cutset == "" {
+		return strings.TrimSpace(arg.String)
+	}
+
+	return strings.Trim(arg.String, arg.Cutset)
+}
+
+type _SubstrFunctionArgs struct {
+	String string `vfilter:"required,field=string"`
+	Start  Any    `vfilter:"optional,field=start"`
+	End    Any    `vfilter:"optional,field=end"`
+}
+
+type _SubstrFunction struct{}
+
+func (self _SubstrFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "substr",
+		Doc:     "Characters from start up to (not including) end. Negative offsets count from the end of the string.",
+		ArgType: type_map.AddType(scope, _SubstrFunctionArgs{}),
+	}
+}
+
+func (self _SubstrFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_SubstrFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("substr: %s", err.Error())
+		return Null{}
+	}
+
+	if arg.Start == nil {
+		arg.Start = Null{}
+	}
+
+	if arg.End == nil {
+		arg.End = Null{}
+	}
+
+	return scope.Slice(arg.String, arg.Start, arg.End)
+}
+
+type _ReplaceFunctionArgs struct {
+	String string `vfilter:"required,field=string"`
+	Old    string `vfilter:"required,field=old"`
+	New    string `vfilter:"optional,field=new"`
+}
+
+type _ReplaceFunction struct{}
+
+func (self _ReplaceFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "replace",
+		Doc:     "Replace all occurrences of old with new.",
+		ArgType: type_map.AddType(scope, _ReplaceFunctionArgs{}),
+	}
+}
+
+func (self _ReplaceFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_ReplaceFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("replace: %s", err.Error())
+		return Null{}
+	}
+
+	return strings.Replace(arg.String, arg.Old, arg.New, -1)
+}
+
+type _RegexReplaceFunctionArgs struct {
+	Source  string `vfilter:"required,field=source"`
+	Re      string `vfilter:"required,field=re"`
+	Replace string `vfilter:"optional,field=replace"`
+}
+
+type _RegexReplaceFunction struct{}
+
+func (self _RegexReplaceFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "regex_replace",
+		Doc:     "Replace all matches of the regex re in source. The replacement may refer to groups (e.g. $1 or ${name}).",
+		ArgType: type_map.AddType(scope, _RegexReplaceFunctionArgs{}),
+	}
+}
+
+func (self _RegexReplaceFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_RegexReplaceFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("regex_replace: %s", err.Error())
+		return Null{}
+	}
+
+	re, err := compileRegex(scope, arg.Re)
+	if err != nil {
+		scope.Log("regex_replace: %s", err.Error())
+		return Null{}
+	}
+
+	return re.ReplaceAllString(arg.Source, arg.Replace)
+}
+
+type _RegexExtractFunctionArgs struct {
+	Source string `vfilter:"required,field=source"`
+	Re     string `vfilter:"required,field=re"`
+}
+
+type _RegexExtractFunction struct{}
+
+func (self _RegexExtractFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name: "regex_extract",
+		Doc: "Match the regex re against source. If the regex has named groups, " +
+			"returns a dict of the groups, otherwise a list of the match " +
+			"followed by its groups. Returns NULL if there is no match.",
+		ArgType: type_map.AddType(scope, _RegexExtractFunctionArgs{}),
+	}
+}
+
+func (self _RegexExtractFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_RegexExtractFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("regex_extract: %s", err.Error())
+		return Null{}
+	}
+
+	re, err := compileRegex(scope, arg.Re)
+	if err != nil {
+		scope.Log("regex_extract: %s", err.Error())
+		return Null{}
+	}
+
+	matches := re.FindStringSubmatch(arg.Source)
+	if matches == nil {
+		return Null{}
+	}
+
+	named := false
+	result := ordereddict.NewDict()
+	for idx, name := range re.SubexpNames() {
+		if name != "" {
+			named = true
+			result.Set(name, matches[idx])
+		}
+	}
+
+	if named {
+		return result
+	}
+
+	return matches
+}
+
+type _LenFunctionArgs struct {
+	Item Any `vfilter:"required,field=item"`
+}
+
+type _LenFunction struct{}
+
+func (self _LenFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "len",
+		Doc:     "The number of characters in a string, items in a list or query or members of a dict.",
+		ArgType: type_map.AddType(scope, _LenFunctionArgs{}),
+	}
+}
+
+func (self _LenFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_LenFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("len: %s", err.Error())
+		return Null{}
+	}
+
+	switch t := arg.Item.(type) {
+	case string:
+		return int64(utf8.RuneCountInString(t))
+
+	case []byte:
+		return int64(len(t))
+
+	case StoredQuery:
+		return int64(len(Materialize(ctx, scope, t)))
+
+	case *ordereddict.Dict:
+		return int64(t.Len())
+	}
+
+	if is_null_obj(arg.Item) {
+		return int64(0)
+	}
+
+	value := reflect.Indirect(reflect.ValueOf(arg.Item))
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return int64(value.Len())
+	}
+
+	return int64(len(scope.GetMembers(arg.Item)))
+}
+
+type _JoinFunctionArgs struct {
+	Array []string `vfilter:"required,field=array"`
+	Sep   string   `vfilter:"optional,field=sep"`
+}
+
+type _JoinFunction struct{}
+
+func (self _JoinFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "join",
+		Doc:     "Join the items of an array into a string separated by sep.",
+		ArgType: type_map.AddType(scope, _JoinFunctionArgs{}),
+	}
+}
+
+func (self _JoinFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_JoinFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("join: %s", err.Error())
+		return Null{}
+	}
+
+	return strings.Join(arg.Array, arg.Sep)
+}
+
+type _StartsWithFunctionArgs struct {
+	String string `vfilter:"required,field=string"`
+	Prefix string `vfilter:"required,field=prefix"`
+}
+
+type _StartsWithFunction struct{}
+
+func (self _StartsWithFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "startswith",
+		Doc:     "True if the string starts with prefix.",
+		ArgType: type_map.AddType(scope, _StartsWithFunctionArgs{}),
+	}
+}
+
+func (self _StartsWithFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_StartsWithFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("startswith: %s", err.Error())
+		return Null{}
+	}
+
+	return strings.HasPrefix(arg.String, arg.Prefix)
+}
+
+type _EndsWithFunctionArgs struct {
+	String string `vfilter:"required,field=string"`
+	Suffix string `vfilter:"required,field=suffix"`
+}
+
+type _EndsWithFunction struct{}
+
+func (self _EndsWithFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:    "endswith",
+		Doc:     "True if the string ends with suffix.",
+		ArgType: type_map.AddType(scope, _EndsWithFunctionArgs{}),
+	}
+}
+
+func (self _EndsWithFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_EndsWithFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("endswith: %s", err.Error())
+		return Null{}
+	}
+
+	return strings.HasSuffix(arg.String, arg.Suffix)
+}
+
+type _PadFunctionArgs struct {
+	String string `vfilter:"required,field=string"`
+	Width  int64  `vfilter:"required,field=width"`
+	Fill   string `vfilter:"optional,field=fill"`
+}
+
+type _PadFunction struct{}
+
+func (self _PadFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name: "pad",
+		Doc: "Pad the string to width characters using fill (by default a space). " +
+			"A positive width pads on the left, a negative width pads on the right.",
+		ArgType: type_map.AddType(scope, _PadFunctionArgs{}),
+	}
+}
+
+func (self _PadFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	arg := &_PadFunctionArgs{}
+	err := ExtractArgs(scope, args, arg)
+	if err != nil {
+		scope.Log("pad: %s", err.Error())
+		return Null{}
+	}
+
+	fill := " "
+	if arg.Fill != "" {
+		fill = arg.Fill
+	}
+
+	width := arg.Width
+	if width < 0 {
+		width = -width
+	}
+
+	// Only whole copies of fill are added.
+	missing := (width - int64(utf8.RuneCountInString(arg.String))) /
+		int64(utf8.RuneCountInString(fill))
+	if missing <= 0 {
+		return arg.String
+	}
+
+	padding := strings.Repeat(fill, int(missing))
+	if arg.Width < 0 {
+		return arg.String + padding
+	}
+	return padding + arg.String
+}
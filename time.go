@@ -0,0 +1,382 @@
+package vfilter
+
+// Time and duration protocols.
+
+// Times are represented as time.Time and durations as
+// time.Duration. Wherever a time is expected, the other operand may
+// also be given as epoch seconds or a string in one of the common
+// formats below, and wherever a duration is expected it may be given
+// as seconds, a Go duration (e.g. "1h30m") or a human readable
+// duration (e.g. "5 days" or "1 week 2 hours"). This allows queries
+// like:
+
+// SELECT * FROM glob() WHERE Mtime > now() - "5 days"
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+// Layouts tried in order when parsing a time from a string.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC850,
+	time.RFC822Z,
+	time.RFC822,
+	time.RubyDate,
+	time.UnixDate,
+	time.ANSIC,
+}
+
+var durationUnits = map[string]time.Duration{
+	"ns":           time.Nanosecond,
+	"us":           time.Microsecond,
+	"ms":           time.Millisecond,
+	"msec":         time.Millisecond,
+	"msecs":        time.Millisecond,
+	"millisecond":  time.Millisecond,
+	"milliseconds": time.Millisecond,
+	"s":            time.Second,
+	"sec":          time.Second,
+	"secs":         time.Second,
+	"second":       time.Second,
+	"seconds":      time.Second,
+	"m":            time.Minute,
+	"min":          time.Minute,
+	"mins":         time.Minute,
+	"minute":       time.Minute,
+	"minutes":      time.Minute,
+	"h":            time.Hour,
+	"hr":           time.Hour,
+	"hrs":          time.Hour,
+	"hour":         time.Hour,
+	"hours":        time.Hour,
+	"d":            24 * time.Hour,
+	"day":          24 * time.Hour,
+	"days":         24 * time.Hour,
+	"w":            7 * 24 * time.Hour,
+	"week":         7 * 24 * time.Hour,
+	"weeks":        7 * 24 * time.Hour,
+}
+
+var durationRegex = regexp.MustCompile(
+	`^\s*([-+]?[0-9]+(?:\.[0-9]+)?)\s*([a-zA-Z]+)\s*,?`)
+
+func is_time(a Any) bool {
+	switch a.(type) {
+	case time.Time, *time.Time:
+		return true
+	}
+	return false
+}
+
+func is_duration(a Any) bool {
+	switch a.(type) {
+	case time.Duration, *time.Duration:
+		return true
+	}
+	return false
+}
+
+// Convert seconds into a time.
+func epochToTime(value float64) time.Time {
+	sec, frac := math.Modf(value)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+// Convert a value into a time. Numbers are taken to be seconds since
+// the epoch. All times are returned in UTC.
+func to_time(a Any) (time.Time, bool) {
+	switch t := a.(type) {
+	case time.Time:
+		return t.UTC(), true
+
+	case *time.Time:
+		return t.UTC(), true
+	}
+
+	if value, ok := to_float(a); ok && !is_duration(a) {
+		return epochToTime(value), true
+	}
+
+	str, ok := to_string(a)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	str = strings.TrimSpace(str)
+	if value, err := strconv.ParseFloat(str, 64); err == nil {
+		return epochToTime(value), true
+	}
+
+	for _, layout := range timeLayouts {
+		result, err := time.Parse(layout, str)
+		if err == nil {
+			return result.UTC(), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// Convert a value into a duration. Numbers are taken to be seconds.
+func to_duration(a Any) (time.Duration, bool) {
+	switch t := a.(type) {
+	case time.Duration:
+		return t, true
+
+	case *time.Duration:
+		return *t, true
+	}
+
+	if value, ok := to_float(a); ok {
+		return time.Duration(value * float64(time.Second)), true
+	}
+
+	str, ok := to_string(a)
+	if !ok {
+		return 0, false
+	}
+
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return 0, false
+	}
+
+	result, err := time.ParseDuration(str)
+	if err == nil {
+		return result, true
+	}
+
+	// A sequence of human readable parts like "1 day, 2 hours".
+	result = 0
+	for str != "" {
+		match := durationRegex.FindStringSubmatch(str)
+		if match == nil {
+			return 0, false
+		}
+
+		unit, pres := durationUnits[strings.ToLower(match[2])]
+		if !pres {
+			return 0, false
+		}
+
+		value, err := strconv.ParseFloat(match[1], 64)
+		if err != nil {
+			return 0, false
+		}
+
+		result += time.Duration(value * float64(unit))
+		str = strings.TrimSpace(str[len(match[0]):])
+	}
+
+	return result, true
+}
+
+type _TimeLt struct{}
+
+func (self _TimeLt) Applicable(a Any, b Any) bool {
+	if !is_time(a) && !is_time(b) {
+		return false
+	}
+
+	_, a_ok := to_time(a)
+	_, b_ok := to_time(b)
+	return a_ok && b_ok
+}
+
+func (self _TimeLt) Lt(scope *Scope, a Any, b Any) bool {
+	a_time, _ := to_time(a)
+	b_time, _ := to_time(b)
+	return a_time.Before(b_time)
+}
+
+type _TimeEq struct{}
+
+func (self _TimeEq) Applicable(a Any, b Any) bool {
+	return _TimeLt{}.Applicable(a, b)
+}
+
+func (self _TimeEq) Eq(scope *Scope, a Any, b Any) bool {
+	a_time, _ := to_time(a)
+	b_time, _ := to_time(b)
+	return a_time.Equal(b_time)
+}
+
+type _DurationLt struct{}
+
+func (self _DurationLt) Applicable(a Any, b Any) bool {
+	if !is_duration(a) && !is_duration(b) {
+		return false
+	}
+
+	_, a_ok := to_duration(a)
+	_, b_ok := to_duration(b)
+	return a_ok && b_ok
+}
+
+func (self _DurationLt) Lt(scope *Scope, a Any, b Any) bool {
+	a_val, _ := to_duration(a)
+	b_val, _ := to_duration(b)
+	return a_val < b_val
+}
+
+type _DurationEq struct{}
+
+func (self _DurationEq) Applicable(a Any, b Any) bool {
+	return _DurationLt{}.Applicable(a, b)
+}
+
+func (self _DurationEq) Eq(scope *Scope, a Any, b Any) bool {
+	a_val, _ := to_duration(a)
+	b_val, _ := to_duration(b)
+	return a_val == b_val
+}
+
+// Times hash to their epoch seconds so they agree with _TimeEq,
+// which considers a time equal to the same epoch given as a
+// number. Times which a float can not represent exactly are hashed
+// to the nanosecond instead.
+//
+// Strings are not parsed when hashing because any string may look
+// like a time, so a time and an equal string (e.g. "2020-09-13T12:26:40Z")
+// hash differently even though they are Eq. GROUP BY and DISTINCT
+// still place them in the same group (see _HashIndex).
+type _TimeHash struct{}
+
+func (self _TimeHash) Applicable(a Any) bool {
+	return is_time(a)
+}
+
+func (self _TimeHash) Hash(scope *Scope, a Any) string {
+	value, _ := to_time(a)
+	seconds := float64(value.Unix()) + float64(value.Nanosecond())/1e9
+	if epochToTime(seconds).Equal(value) {
+		return strconv.FormatFloat(seconds, 'g', -1, 64)
+	}
+
+	return strconv.FormatInt(value.Unix(), 10) + "." +
+		strings.TrimRight(fmt.Sprintf("%09d", value.Nanosecond()), "0")
+}
+
+// Durations hash to their seconds for the same reason.
+type _DurationHash struct{}
+
+func (self _DurationHash) Applicable(a Any) bool {
+	return is_duration(a)
+}
+
+func (self _DurationHash) Hash(scope *Scope, a Any) string {
+	value, _ := to_duration(a)
+	return strconv.FormatFloat(value.Seconds(), 'g', -1, 64)
+}
+
+// Subtracting a time from a time gives a duration while subtracting
+// a duration from a time gives an earlier time.
+type _TimeSub struct{}
+
+func (self _TimeSub) Applicable(a Any, b Any) bool {
+	if !is_time(a) {
+		return false
+	}
+
+	if _, ok := to_duration(b); ok {
+		return true
+	}
+
+	_, ok := to_time(b)
+	return ok
+}
+
+func (self _TimeSub) Sub(scope *Scope, a Any, b Any) Any {
+	a_time, _ := to_time(a)
+	if !is_time(b) {
+		duration, ok := to_duration(b)
+		if ok {
+			return a_time.Add(-duration)
+		}
+	}
+
+	b_time, _ := to_time(b)
+	return a_time.Sub(b_time)
+}
+
+// Adding a duration to a time (in either order) gives a later time.
+type _TimeAdd struct{}
+
+func (self _TimeAdd) Applicable(a Any, b Any) bool {
+	if is_time(a) {
+		_, ok := to_duration(b)
+		return ok
+	}
+
+	if is_time(b) {
+		_, ok := to_duration(a)
+		return ok
+	}
+
+	return false
+}
+
+func (self _TimeAdd) Add(scope *Scope, a Any, b Any) Any {
+	if !is_time(a) {
+		a, b = b, a
+	}
+
+	a_time, _ := to_time(a)
+	duration, _ := to_duration(b)
+	return a_time.Add(duration)
+}
+
+type _DurationAdd struct{}
+
+func (self _DurationAdd) Applicable(a Any, b Any) bool {
+	return _DurationLt{}.Applicable(a, b)
+}
+
+func (self _DurationAdd) Add(scope *Scope, a Any, b Any) Any {
+	a_val, _ := to_duration(a)
+	b_val, _ := to_duration(b)
+	return a_val + b_val
+}
+
+type _DurationSub struct{}
+
+func (self _DurationSub) Applicable(a Any, b Any) bool {
+	return _DurationLt{}.Applicable(a, b)
+}
+
+func (self _DurationSub) Sub(scope *Scope, a Any, b Any) Any {
+	a_val, _ := to_duration(a)
+	b_val, _ := to_duration(b)
+	return a_val - b_val
+}
+
+type _NowFunction struct{}
+
+func (self _NowFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name: "now",
+		Doc:  "Returns the current time.",
+	}
+}
+
+func (self _NowFunction) Call(ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	return time.Now().UTC()
+}
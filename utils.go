@@ -1,6 +1,7 @@
 package vfilter
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"sort"
@@ -163,7 +164,23 @@ func GetID(obj Any) string {
 	return fmt.Sprintf("%p", obj)
 }
 
+// Convert the row into a dict. The cells are converted with the
+// Marshal protocol so the result can be serialized.
 func RowToDict(scope *Scope, row Row) *ordereddict.Dict {
+	ctx := context.Background()
+	result := ordereddict.NewDict()
+	for _, column := range scope.GetMembers(row) {
+		value, pres := scope.Associative(row, column)
+		if pres {
+			result.Set(column, scope.Marshal(ctx, value))
+		}
+	}
+
+	return result
+}
+
+// Like RowToDict but the cells are kept as they are.
+func rowToDict(scope *Scope, row Row) *ordereddict.Dict {
 	// If the row is already a dict nothing to do:
 	result, ok := row.(*ordereddict.Dict)
 	if ok {
@@ -132,7 +132,6 @@ import (
 	"context"
 	"fmt"
 	"reflect"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -151,41 +150,186 @@ var (
 			`|(?P<SQLComment>^--.*?$)` + // SQL style one line comment.
 			`|(?P<Comment>^//.*?$)` + // C++ style one line comment.
 			`|(?ims)(?P<SELECT>\bSELECT\b)` +
+			`|(?ims)(?P<DISTINCT>\bDISTINCT\b)` +
 			`|(?ims)(?P<WHERE>\bWHERE\b)` +
 			`|(?ims)(?P<AND>\bAND\b)` +
 			`|(?ims)(?P<OR>\bOR\b)` +
 			`|(?ims)(?P<FROM>\bFROM\b)` +
+			`|(?ims)(?P<NOTIN>\bNOT\s+IN\b)` +
+			`|(?ims)(?P<NOTLIKE>\bNOT\s+LIKE\b)` +
+			`|(?ims)(?P<NOTBETWEEN>\bNOT\s+BETWEEN\b)` +
 			`|(?ims)(?P<NOT>\bNOT\b)` +
 			`|(?ims)(?P<AS>\bAS\b)` +
 			`|(?ims)(?P<IN>\bIN\b)` +
+			`|(?ims)(?P<LIKE>\bLIKE\b)` +
+			`|(?ims)(?P<BETWEEN>\bBETWEEN\b)` +
+			`|(?ims)(?P<ISNOTNULL>\bIS\s+NOT\s+NULL\b)` +
+			`|(?ims)(?P<ISNULL>\bIS\s+NULL\b)` +
 			`|(?ims)(?P<LIMIT>\bLIMIT\b)` +
+			`|(?ims)(?P<OFFSET>\bOFFSET\b)` +
+			`|(?ims)(?P<NULLSFIRST>\bNULLS\s+FIRST\b)` +
+			`|(?ims)(?P<NULLSLAST>\bNULLS\s+LAST\b)` +
 			`|(?ims)(?P<NULL>\bNULL\b)` +
 			`|(?ims)(?P<DESC>\bDESC\b)` +
+			`|(?ims)(?P<ASC>\bASC\b)` +
 			`|(?ims)(?P<GROUPBY>\bGROUP\s+BY\b)` +
 			`|(?ims)(?P<ORDERBY>\bORDER\s+BY\b)` +
+			`|(?ims)(?P<PARTITIONBY>\bPARTITION\s+BY\b)` +
 			`|(?ims)(?P<BOOL>\bTRUE\b|\bFALSE\b)` +
 			`|(?ims)(?P<LET>\bLET\b)` +
-			`|(?P<Ident>[a-zA-Z_][a-zA-Z0-9_]*)` +
+			`|(?ims)(?P<CASE>\bCASE\b)` +
+			`|(?ims)(?P<LEFTJOIN>\bLEFT\s+JOIN\b)` +
+			`|(?ims)(?P<INNERJOIN>\bINNER\s+JOIN\b)` +
+			`|(?ims)(?P<ON>\bON\b)` +
+			`|(?P<Ident>[a-zA-Z_][a-zA-Z0-9_]*|` + "`[^`\n]+`" + `)` +
 			`|(?P<String>'([^'\\]*(\\.[^'\\]*)*)'|"([^"\\]*(\\.[^"\\]*)*)")` +
 			`|(?P<Number>[-+]?(0x)?\d*\.?\d+([eE][-+]?\d+)?)` +
-			`|(?P<Operators><>|!=|<=|>=|=~|[-+*/%,.()=<>{}\[\]])`,
+			`|(?P<Operators><<|>>|<>|!=|<=|>=|=~|[-+*/%&|^~,.:()=<>{}\[\];])`,
 	))
 
 	sqlParser = participle.MustBuild(
 		&VQL{},
 		participle.Lexer(sqlLexer),
-		participle.Upper("IN", "DESC"),
+		participle.Map(canonicalKeyword, "NOTIN", "NOTLIKE",
+			"NOTBETWEEN", "ISNULL", "ISNOTNULL"),
+		participle.Map(unquoteIdent, "Ident"),
+		participle.CaseInsensitive("Ident"),
 		participle.Elide("Comment", "MLineComment", "SQLComment"),
 	// Need to solve left recursion detection first, if possible.
 	// participle.UseLookahead(),
 	)
+
+	multiVQLParser = participle.MustBuild(
+		&_MultiVQL{},
+		participle.Lexer(sqlLexer),
+		participle.Map(canonicalKeyword, "NOTIN", "NOTLIKE",
+			"NOTBETWEEN", "ISNULL", "ISNOTNULL"),
+		participle.Map(unquoteIdent, "Ident"),
+		participle.CaseInsensitive("Ident"),
+		participle.Elide("Comment", "MLineComment", "SQLComment"),
+	)
 )
 
+// Identifiers may be quoted with backticks (e.g. `Offset`) so that
+// columns, fields and args named like a keyword may still be used.
+func unquoteIdent(token lexer.Token) (lexer.Token, error) {
+	if strings.HasPrefix(token.Value, "`") {
+		token.Value = strings.Trim(token.Value, "`")
+	}
+	return token, nil
+}
+
+// The token types of identifiers already lexed by quoteIdent().
+// Column names are produced by ToString() for every row so lexing
+// them each time is too slow. The cache is cleared once it holds
+// max_quoted_idents identifiers.
+const max_quoted_idents = 10000
+
+var (
+	quoted_idents_mu sync.Mutex
+	quoted_idents    = make(map[string]string)
+)
+
+// Keywords which may also be used unquoted as arg names, column
+// aliases and after "." (see the _Args, _AliasedExpression and
+// _OpMembershipTerm grammar).
+var name_keywords = []string{"SELECT", "DISTINCT", "WHERE", "AND", "OR",
+	"FROM", "NOT", "AS", "IN", "LIKE", "BETWEEN", "LIMIT", "OFFSET", "DESC",
+	"ASC", "LET", "CASE", "ON"}
+
+// Returns the type of the token the name is lexed as, or "" if it is
+// not lexed as a single token.
+func identTokenType(name string) string {
+	quoted_idents_mu.Lock()
+	defer quoted_idents_mu.Unlock()
+
+	result, pres := quoted_idents[name]
+	if pres {
+		return result
+	}
+
+	lex, err := sqlLexer.Lex(strings.NewReader(name))
+	if err == nil {
+		tokens, err := lexer.ConsumeAll(lex)
+		if err == nil && len(tokens) == 2 && tokens[0].Value == name {
+			for symbol, token_type := range sqlLexer.Symbols() {
+				if token_type == tokens[0].Type {
+					result = symbol
+				}
+			}
+		}
+	}
+
+	if len(quoted_idents) >= max_quoted_idents {
+		quoted_idents = make(map[string]string)
+	}
+	quoted_idents[name] = result
+	return result
+}
+
+// Quote the identifier with backticks if it would not be lexed as an
+// identifier (e.g. because it is a keyword), so ToString() produces
+// VQL which parses to the same query.
+func quoteIdent(name string) string {
+	if identTokenType(name) == "Ident" {
+		return name
+	}
+	return "`" + name + "`"
+}
+
+// Like quoteIdent() but for the positions where keywords may also be
+// used as names.
+func quoteName(name string) string {
+	token_type := identTokenType(name)
+	if token_type == "Ident" || InString(&name_keywords, token_type) {
+		return name
+	}
+	return "`" + name + "`"
+}
+
+// Keywords made of several words (e.g. "is  not null") are normalized
+// to upper case with single spaces so they can be compared directly.
+func canonicalKeyword(token lexer.Token) (lexer.Token, error) {
+	token.Value = strings.Join(strings.Fields(strings.ToUpper(token.Value)), " ")
+	return token, nil
+}
+
 // Parse the VQL expression. Returns a VQL object which may be
 // evaluated.
 func Parse(expression string) (*VQL, error) {
 	sql := &VQL{}
 	err := sqlParser.ParseString(expression, sql)
+	if err != nil {
+		return sql, wrapParseError(expression, err)
+	}
+
+	return sql, sql.validate()
+}
+
+// Parse a VQL script consisting of multiple LET and SELECT
+// statements. Statements may optionally be separated by ";". The
+// statements are returned in the order they appear in the script.
+func ParseMultiVQL(expression string) ([]*VQLStatement, error) {
+	multi_vql := &_MultiVQL{}
+	err := multiVQLParser.ParseString(expression, multi_vql)
+	if err != nil {
+		return multi_vql.Statements, wrapParseError(expression, err)
+	}
+
+	for _, statement := range multi_vql.Statements {
+		err := statement.VQL.validate()
+		if err != nil {
+			return multi_vql.Statements, errors.Wrap(
+				err, statement.Pos.String())
+		}
+	}
+
+	return multi_vql.Statements, nil
+}
+
+// Add some context around the position of lexer errors so users can
+// see where in the expression the error occured.
+func wrapParseError(expression string, err error) error {
 	switch t := err.(type) {
 	case *lexer.Error:
 		end := t.Pos.Offset + 10
@@ -210,20 +354,91 @@ func Parse(expression string) (*VQL, error) {
 			pos = 0
 		}
 
-		return sql, errors.Wrap(
+		return errors.Wrap(
 			err,
 			expression[start:pos]+"|"+expression[pos:end])
 	default:
 
-		return sql, err
+		return err
 	}
 }
 
+// A VQL script is a sequence of statements.
+type _MultiVQL struct {
+	Statements []*VQLStatement `{ @@ [ ";" ] }`
+}
+
+// A single statement within a VQL script. Pos is populated by the
+// parser with the position of the start of the statement within the
+// script.
+type VQLStatement struct {
+	Pos lexer.Position
+	VQL *VQL `@@`
+}
+
+// A row emitted by ScriptEval(). Statement is the index of the
+// statement (as returned by ParseMultiVQL()) which produced the row.
+type ScriptRow struct {
+	Statement int
+	Row       Row
+}
+
+// Evaluate the statements in order against the same scope. Since
+// all statements share the scope, LET statements define stored
+// queries which may be used by later statements. Each statement is
+// run to completion before the next one starts.
+func ScriptEval(ctx context.Context, scope *Scope,
+	statements []*VQLStatement) <-chan *ScriptRow {
+	output_chan := make(chan *ScriptRow)
+
+	go func() {
+		defer close(output_chan)
+
+		for idx, statement := range statements {
+			for row := range statement.VQL.Eval(ctx, scope) {
+				select {
+				case <-ctx.Done():
+					return
+				case output_chan <- &ScriptRow{Statement: idx, Row: row}:
+				}
+			}
+		}
+	}()
+
+	return output_chan
+}
+
 // An opaque object representing the VQL expression.
 type VQL struct {
-	Let         string   `{ LET  @Ident `
-	LetOperator string   ` ( @"=" | @"<=" ) }`
-	Query       *_Select ` @@ `
+	Let         string          `{ LET  @Ident `
+	Call        bool            ` [ @"("`
+	Parameters  []string        `   [ @Ident { "," @Ident } ] ")" ]`
+	LetOperator string          ` ( @"=" | @"<=" ) }`
+	Query       *_Select        ` ( @@ `
+	Expression  *_AndExpression ` | @@ )`
+}
+
+// The grammar is more permissive than the language so we check the
+// parsed query for constructs which are not allowed.
+func (self *VQL) validate() error {
+	if self.Expression != nil && self.Let == "" {
+		return errors.New("An expression is only allowed in a LET statement.")
+	}
+
+	if self.Call && self.LetOperator == "<=" {
+		return errors.New("A materialized LET can not take parameters.")
+	}
+
+	// Check all the queries including subqueries.
+	var err error
+	walkAST(self, func(node Any) bool {
+		if query, ok := node.(*_Select); ok && err == nil {
+			err = query.validateWindows()
+		}
+		return err == nil
+	})
+
+	return err
 }
 
 // Evaluate the expression. Returns a channel which emits a series of
@@ -247,12 +462,38 @@ func (self VQL) Eval(ctx context.Context, scope *Scope) <-chan Row {
 
 		switch self.LetOperator {
 		case "=":
-			stored_query := NewStoredQuery(self.Query)
-			scope.AppendVars(ordereddict.NewDict().Set(self.Let, stored_query))
+			var stored Any
+
+			// LET name(args) = expression defines a
+			// function while LET name(args) = SELECT
+			// defines a plugin. Without parameters an
+			// expression is reduced each time it is
+			// referenced.
+			if self.Expression != nil {
+				stored = &_StoredExpression{
+					name:       self.Let,
+					parameters: self.Parameters,
+					expr:       self.Expression,
+				}
+			} else if self.Call {
+				stored = &_ParameterizedQuery{
+					name:       self.Let,
+					parameters: self.Parameters,
+					query:      self.Query,
+				}
+			} else {
+				stored = NewStoredQuery(self.Query)
+			}
+			scope.AppendVars(ordereddict.NewDict().Set(self.Let, stored))
 
 		case "<=":
-			scope.AppendVars(ordereddict.NewDict().Set(
-				self.Let, Materialize(ctx, scope, self.Query)))
+			var value Any
+			if self.Expression != nil {
+				value = self.Expression.Reduce(ctx, scope)
+			} else {
+				value = Materialize(ctx, scope, self.Query)
+			}
+			scope.AppendVars(ordereddict.NewDict().Set(self.Let, value))
 		}
 
 		close(output_chan)
@@ -272,27 +513,87 @@ func (self VQL) ToString(scope *Scope) string {
 			operator = self.LetOperator
 		}
 
-		result += "LET " + self.Let + operator
+		result += "LET " + quoteIdent(self.Let)
+		if self.Call {
+			var parameters []string
+			for _, parameter := range self.Parameters {
+				parameters = append(parameters, quoteIdent(parameter))
+			}
+			result += "(" + strings.Join(parameters, ", ") + ")"
+		}
+		result += operator
+	}
+
+	if self.Expression != nil {
+		return result + self.Expression.ToString(scope)
 	}
 
 	return result + self.Query.ToString(scope)
 }
 
+// Evaluate the expression while recording any errors in the
+// collector. The collector is installed in a copy of the scope so the
+// caller's scope is left unchanged, but variables defined by LET
+// statements are still added to the caller's scope. If the collector
+// is strict the query is cancelled on the first error.
+func (self VQL) EvalWithErrors(ctx context.Context, scope *Scope,
+	collector *ErrorCollector) <-chan Row {
+	output_chan := make(chan Row)
+
+	sub_scope := scope.Copy().SetErrorCollector(collector)
+	sub_ctx, cancel := collector.WithContext(ctx)
+
+	// LET statements are evaluated before returning so the
+	// variable can be copied into the caller's scope.
+	if len(self.Let) > 0 {
+		defer cancel()
+		defer close(output_chan)
+
+		for range self.Eval(sub_ctx, sub_scope) {
+		}
+
+		value, pres := sub_scope.Resolve(self.Let)
+		if pres {
+			scope.AppendVars(ordereddict.NewDict().Set(self.Let, value))
+		}
+		return output_chan
+	}
+
+	go func() {
+		defer close(output_chan)
+		defer cancel()
+
+		for row := range self.Eval(sub_ctx, sub_scope) {
+			select {
+			case <-sub_ctx.Done():
+				return
+			case output_chan <- row:
+			}
+		}
+	}()
+
+	return output_chan
+}
+
 // Provides a list of column names from this query. These columns will
 // serve as Row keys for rows that are published on the output channel
 // by Eval().
 func (self *VQL) Columns(scope *Scope) *[]string {
+	if self.Query == nil {
+		return &[]string{}
+	}
 	return self.Query.Columns(scope)
 }
 
 type _Select struct {
-	SelectExpression *_SelectExpression `SELECT @@`
+	Distinct         bool               `SELECT [ @DISTINCT ]`
+	SelectExpression *_SelectExpression `@@`
 	From             *_From             `FROM @@`
 	Where            *_CommaExpression  `[ WHERE @@ ]`
-	GroupBy          *string            `[ GROUPBY @Ident ]`
-	OrderBy          *string            `[ ORDERBY @Ident `
-	OrderByDesc      *bool              ` [ @DESC ] ]`
+	GroupBy          []*_AndExpression  `[ GROUPBY @@ { "," @@ } ]`
+	OrderBy          []*_OrderByTerm    `[ ORDERBY @@ { "," @@ } ]`
 	Limit            *int64             `[ LIMIT @Number ]`
+	Offset           *int64             `[ OFFSET @Number ]`
 }
 
 // Provides a list of column names from this query. These columns will
@@ -300,7 +601,7 @@ type _Select struct {
 // by Eval().
 func (self _Select) Columns(scope *Scope) *[]string {
 	if self.SelectExpression.All {
-		return self.From.Plugin.Columns(scope)
+		return self.From.Columns(scope)
 	}
 
 	return self.SelectExpression.Columns(scope)
@@ -308,6 +609,10 @@ func (self _Select) Columns(scope *Scope) *[]string {
 
 func (self _Select) ToString(scope *Scope) string {
 	result := "SELECT "
+	if self.Distinct {
+		result += "DISTINCT "
+	}
+
 	if self.SelectExpression != nil {
 		result += self.SelectExpression.ToString(scope)
 	}
@@ -322,21 +627,28 @@ func (self _Select) ToString(scope *Scope) string {
 		result += " WHERE " + self.Where.ToString(scope)
 	}
 
-	if self.GroupBy != nil {
-		result += " GROUP BY " + *self.GroupBy
+	if len(self.GroupBy) > 0 {
+		var group_by []string
+		for _, expr := range self.GroupBy {
+			group_by = append(group_by, expr.ToString(scope))
+		}
+		result += " GROUP BY " + strings.Join(group_by, ", ")
 	}
 
-	if self.OrderBy != nil {
-		result += " ORDER BY " + *self.OrderBy
-
-		if self.OrderByDesc != nil && *self.OrderByDesc {
-			result += " DESC "
+	if len(self.OrderBy) > 0 {
+		var order_by []string
+		for _, term := range self.OrderBy {
+			order_by = append(order_by, term.ToString(scope))
 		}
+		result += " ORDER BY " + strings.Join(order_by, ", ")
 	}
 
 	if self.Limit != nil {
-		result += fmt.Sprintf(
-			" LIMIT %d ", int(*self.Limit))
+		result += fmt.Sprintf(" LIMIT %d", int(*self.Limit))
+	}
+
+	if self.Offset != nil {
+		result += fmt.Sprintf(" OFFSET %d", int(*self.Offset))
 	}
 
 	return result
@@ -345,144 +657,96 @@ func (self _Select) ToString(scope *Scope) string {
 func (self _Select) Eval(ctx context.Context, scope *Scope) <-chan Row {
 	output_chan := make(chan Row)
 
-	if self.GroupBy != nil {
+	// Aggregate functions without a GROUP BY clause operate over
+	// the whole result set, as if all rows were in the same group.
+	if len(self.GroupBy) > 0 || self.SelectExpression.hasAggregate(scope) {
 		go func() {
 			defer close(output_chan)
 
-			group_by := *self.GroupBy
-
-			// Aggregate functions (count, sum etc)
-			// operate by storing data in the scope
-			// context between rows. When we group by we
-			// create a different scope context for each
-			// bin - all the rows with the same group by
-			// value are placed in the same bin and share
-			// the same context.
-			type AggregateContext struct {
-				row     Row
-				context *ordereddict.Dict
+			// Which functions are aggregates is only known
+			// when the query runs.
+			if len(findWindows(self.SelectExpression)) > 0 {
+				scope.ReportError(newQueryError(InvalidQueryError,
+					"Window functions are not allowed with aggregates."))
+				return
 			}
 
-			// Collect all the rows with the same group_by
-			// member. This is a map between unique group
-			// by values and an aggregate context.
-			bins := make(map[Any]*AggregateContext)
-
-			sub_ctx, cancel := context.WithCancel(ctx)
-			defer cancel()
-
-			new_scope := scope.Copy()
-
-			// Append this row to a bin based on a unique
-			// value of the group by column.
-			for row := range self.From.Eval(sub_ctx, scope) {
-				transformed_row := self.SelectExpression.Transform(
-					ctx, scope, row)
-
-				if self.Where != nil {
-					new_scope := scope.Copy()
-
-					// Order matters - transformed
-					// row may mask original row.
-					new_scope.AppendVars(row)
-					new_scope.AppendVars(transformed_row)
-
-					expression := self.Where.Reduce(ctx, new_scope)
-					// If the filtered expression returns
-					// a bool false, then skip the row.
-					if expression == nil || !scope.Bool(expression) {
-						scope.Trace("During Groupby: Row rejected")
-						continue
-					}
-				}
-
-				gb_element, pres := scope.Associative(
-					transformed_row, group_by)
-				if !pres {
-					// This should not happen -
-					// the group by column is not
-					// present in the row.
-					gb_element = Null{}
-				}
+			self.evalGroupBy(ctx, scope, output_chan)
+		}()
 
-				// We can not aggregate by arrays. Should we serialize them?
-				if is_array(gb_element) {
-					gb_element = Null{}
-				}
+		return output_chan
+	}
 
-				aggregate_ctx, pres := bins[gb_element]
-				// No previous aggregate_row - initialize with a new context.
-				if !pres {
-					aggregate_ctx = &AggregateContext{
-						context: ordereddict.NewDict(),
-					}
-					bins[gb_element] = aggregate_ctx
-				}
+	if self.Limit != nil || self.Offset != nil {
+		go func() {
+			defer close(output_chan)
 
-				// The transform function receives
-				// its own unique context for the
-				// specific aggregate group.
-				new_scope.context = aggregate_ctx.context
-
-				// Update the row with the transformed
-				// columns. Note we must materialize
-				// these rows because evaluating the
-				// row may have side effects (e.g. for
-				// aggregate functions).
-				aggregate_ctx.row = MaterializedLazyRow(
-					self.SelectExpression.Transform(
-						ctx, new_scope, row), scope)
+			limit := -1
+			if self.Limit != nil {
+				limit = int(*self.Limit)
 			}
 
-			result_set := &ResultSet{
-				OrderBy: group_by,
-				scope:   scope,
+			offset := 0
+			if self.Offset != nil {
+				offset = int(*self.Offset)
 			}
 
-			if self.OrderBy != nil {
-				result_set.OrderBy = *self.OrderBy
-			}
+			count := 1
+			self.Limit = nil
+			self.Offset = nil
 
-			if self.OrderByDesc != nil {
-				result_set.Desc = *self.OrderByDesc
-			}
+			// Cancel the query when we hit the limit.
+			sub_ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
 
-			// Emit the binned set as a new result set.
-			for _, aggregate_ctx := range bins {
-				result_set.Items = append(result_set.Items, aggregate_ctx.row)
-			}
+			for row := range self.Eval(sub_ctx, scope) {
+				// Skip the first offset rows.
+				if offset > 0 {
+					offset--
+					continue
+				}
 
-			// Sort the results based on the OrderBy
-			sort.Sort(result_set)
+				// Discard rows which arrive while the
+				// query is being cancelled.
+				if limit >= 0 && count > limit {
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case output_chan <- row:
+				}
+				count += 1
 
-			for idx, row := range result_set.Items {
-				if self.Limit != nil && idx >= int(*self.Limit) {
-					break
+				// Cancel the query and wait for it to
+				// finish (e.g. removing spill files).
+				if limit >= 0 && count > limit {
+					cancel()
 				}
-				output_chan <- MaterializedLazyRow(row, new_scope)
 			}
 		}()
 
 		return output_chan
 	}
 
-	if self.Limit != nil {
+	if self.Distinct {
 		go func() {
 			defer close(output_chan)
 
-			limit := int(*self.Limit)
-			count := 1
-			self.Limit = nil
+			self.Distinct = false
+			distinct := newDistinctFilter(true)
 
-			// Cancel the query when we hit the limit.
 			sub_ctx, cancel := context.WithCancel(ctx)
 			defer cancel()
 
 			for row := range self.Eval(sub_ctx, scope) {
-				output_chan <- row
-				count += 1
-				if count > limit {
-					return
+				if distinct.Check(scope, row) {
+					select {
+					case <-ctx.Done():
+						return
+					case output_chan <- row:
+					}
 				}
 			}
 		}()
@@ -490,110 +754,173 @@ func (self _Select) Eval(ctx context.Context, scope *Scope) <-chan Row {
 		return output_chan
 	}
 
-	if self.OrderBy != nil {
-		result_set := &ResultSet{
-			OrderBy: *self.OrderBy,
-			scope:   scope,
-		}
-
-		if self.OrderByDesc != nil {
-			result_set.Desc = *self.OrderByDesc
-		}
-
-		self.OrderBy = nil
-
-		for row := range self.Eval(ctx, scope) {
-			result_set.Items = append(result_set.Items, row)
-		}
-
-		// Sort the results based on the
-		sort.Sort(result_set)
-
+	if len(self.OrderBy) > 0 {
 		go func() {
 			defer close(output_chan)
 
-			for _, row := range result_set.Items {
-				output_chan <- row
+			order_by := self.OrderBy
+			self.OrderBy = nil
+
+			// Sort the results based on the OrderBy
+			sorter := newExternalSorter(scope, func(a []Any, b []Any) int {
+				return compareTerms(scope, order_by, a, b)
+			})
+			defer sorter.Close()
+
+			// The keys may refer to the source row as well as
+			// the aliases of the output row (e.g. the
+			// members of a JOIN).
+			seq := int64(0)
+			self.evalRows(ctx, scope, func(source Row, row Row) bool {
+				sorter.Add(ctx, seq,
+					orderByKeys(ctx, scope, order_by, source, row), row)
+				seq++
+				return true
+			})
+
+			for row := range sorter.Rows(ctx) {
+				select {
+				case <-ctx.Done():
+					return
+				case output_chan <- row:
+				}
 			}
 		}()
 		return output_chan
 	}
 
+	go func() {
+		defer close(output_chan)
+
+		self.evalRows(ctx, scope, func(source Row, row Row) bool {
+			select {
+			case <-ctx.Done():
+				return false
+			case output_chan <- row:
+				return true
+			}
+		})
+	}()
+
+	return output_chan
+}
+
+// Passes each row of the query to emit together with the source row
+// it was transformed from. Stops when emit returns false.
+func (self _Select) evalRows(ctx context.Context, scope *Scope,
+	emit func(source Row, row Row) bool) {
+	windows := findWindows(self.SelectExpression)
+	if len(windows) > 0 {
+		self.evalWindows(ctx, scope, windows, emit)
+		return
+	}
+
 	// Gets a row from the FROM clause, then transforms it
 	// according to the SelectExpression. After transformation,
 	// apply the WHERE clause to the row to determine if it should
 	// be relayed. NOTE: We need to transform the row first in
 	// order to assign aliases.
-	go func() {
-		from_chan := self.From.Eval(ctx, scope)
+	from_chan := self.From.Eval(ctx, scope)
+	for {
+		select {
+		// Are we cancelled?
+		case <-ctx.Done():
+			return
 
-		defer close(output_chan)
-		for {
-			select {
-			// Are we cancelled?
-			case <-ctx.Done():
+			// Get a row
+		case row, ok := <-from_chan:
+			if !ok {
 				return
+			}
+
+			transformed_row := self.SelectExpression.Transform(
+				ctx, scope, row)
 
-				// Get a row
-			case row, ok := <-from_chan:
-				if !ok {
+			if self.Where == nil {
+				if !emit(row, MaterializedLazyRow(transformed_row, scope)) {
 					return
 				}
+				continue
+			}
 
-				transformed_row := self.SelectExpression.Transform(
-					ctx, scope, row)
+			// If there is a filter clause, we need to filter
+			// the row using a new scope.
+			new_scope := scope.Copy()
 
-				if self.Where == nil {
-					output_chan <- MaterializedLazyRow(transformed_row, scope)
-				} else {
-					// If there is a filter clause, we
-					// need to filter the row using a new
-					// scope.
-					new_scope := scope.Copy()
-
-					// Filters can access both the
-					// untransformed row and the
-					// transformed row. This
-					// allows WHERE clause to
-					// refer to both the raw
-					// plugin output as well as
-					// aliases of transformations
-					// on the row.
-					new_scope.AppendVars(row)
-					new_scope.AppendVars(transformed_row)
-
-					expression := self.Where.Reduce(ctx, new_scope)
-					// If the filtered expression returns
-					// a bool true, then pass the row to
-					// the output.
-					if expression != nil && scope.Bool(expression) {
-						output_chan <- MaterializedLazyRow(
-							transformed_row, new_scope)
-					} else {
-						scope.Trace("Row rejected")
-					}
+			// Filters can access both the untransformed row
+			// and the transformed row. This allows WHERE
+			// clause to refer to both the raw plugin output as
+			// well as aliases of transformations on the row.
+			new_scope.AppendVars(row)
+			new_scope.AppendVars(transformed_row)
+
+			expression := self.Where.Reduce(ctx, new_scope)
+			// If the filtered expression returns a bool true,
+			// then pass the row to the output.
+			if expression != nil && scope.Bool(expression) {
+				if !emit(row, MaterializedLazyRow(transformed_row, new_scope)) {
+					return
 				}
+			} else {
+				scope.Trace("Row rejected")
 			}
 		}
-	}()
+	}
+}
 
-	return output_chan
+// A single ORDER BY key. By default NULLs sort after all other values
+// (i.e. last in ascending order and first in descending order).
+type _OrderByTerm struct {
+	Expression *_AndExpression `@@`
+	Desc       bool            `[ @DESC | ASC ]`
+	NullsFirst bool            `[ @NULLSFIRST`
+	NullsLast  bool            ` | @NULLSLAST ]`
+}
+
+func (self *_OrderByTerm) ToString(scope *Scope) string {
+	result := self.Expression.ToString(scope)
+	if self.Desc {
+		result += " DESC"
+	}
+
+	if self.NullsFirst {
+		result += " NULLS FIRST"
+	} else if self.NullsLast {
+		result += " NULLS LAST"
+	}
+
+	return result
 }
 
 type _From struct {
-	Plugin _Plugin ` @@ `
+	Plugin _Plugin  ` @@ `
+	Alias  string   `[ AS @Ident ]`
+	Joins  []*_Join `{ @@ }`
+}
+
+// A plain JOIN is matched as an identifier so join() may still be
+// used as a function name.
+type _Join struct {
+	Left   bool            `( @LEFTJOIN | INNERJOIN | "JOIN" )`
+	Plugin _Plugin         `@@`
+	Alias  string          `[ AS @Ident ]`
+	On     *_AndExpression `ON @@`
 }
 
 type _Plugin struct {
+	Pos lexer.Position
+
 	Name string   `@Ident { @"." @Ident } `
 	Call bool     `[ @"("`
 	Args []*_Args ` [ @@  { "," @@ } ] ")" ]`
 }
 
+// Arguments are usually named (name=value) but may also be passed by
+// position. Positional args are passed to the function or plugin
+// with the names "$0", "$1" etc (see ExtractArgs()).
 type _Args struct {
-	Left      string            `@Ident "=" `
+	Left      string            `[ @(Ident | SELECT | DISTINCT | WHERE | AND | OR | FROM | NOT | AS | IN | LIKE | BETWEEN | LIMIT | OFFSET | DESC | ASC | LET | CASE | ON) "=" ]`
 	SubSelect *_Select          `( "{" @@ "}" | `
-	Array     *_CommaExpression ` "[" @@ "]" | `
 	Right     *_AndExpression   ` @@ )`
 }
 
@@ -606,14 +933,21 @@ type _AliasedExpression struct {
 	SubSelect  *_Select        `( "{" @@ "}" |`
 	Expression *_AndExpression ` @@ )`
 
-	As string `[ AS @Ident ]`
+	As string `[ AS @(Ident | SELECT | DISTINCT | WHERE | AND | OR | FROM | NOT | AS | IN | LIKE | BETWEEN | LIMIT | OFFSET | DESC | ASC | LET | CASE | ON) ]`
 }
 
 func (self *_AliasedExpression) GetName(scope *Scope) string {
 	if self.As != "" {
 		return self.As
 	}
-	return self.ToString(scope)
+
+	// A quoted column is named without the quotes.
+	name := self.ToString(scope)
+	if strings.HasPrefix(name, "`") && strings.HasSuffix(name, "`") &&
+		strings.Count(name, "`") == 2 {
+		return strings.Trim(name, "`")
+	}
+	return name
 }
 
 func (self *_AliasedExpression) IsAggregate(scope *Scope) bool {
@@ -666,7 +1000,7 @@ func (self *_AliasedExpression) ToString(scope *Scope) string {
 	if self.Expression != nil {
 		result := self.Expression.ToString(scope)
 		if self.As != "" {
-			result += " AS " + self.As
+			result += " AS " + quoteName(self.As)
 		}
 		return result
 
@@ -674,7 +1008,7 @@ func (self *_AliasedExpression) ToString(scope *Scope) string {
 		result := self.SubSelect.ToString(scope)
 		result = "{ " + result + " }"
 		if self.As != "" {
-			result += " AS " + self.As
+			result += " AS " + quoteName(self.As)
 		}
 		return result
 	} else {
@@ -689,32 +1023,40 @@ type _AdditionExpression struct {
 }
 
 type _OpAddTerm struct {
-	Operator string                     `@("+" | "-")`
+	Operator string                     `@("+" | "-" | "|" | "^")`
 	Term     *_MultiplicationExpression `@@`
 }
 
-// Expressions separated by multiplication or division.
+// Expressions separated by multiplication, division, modulo, shifts
+// or bitwise AND.
 type _MultiplicationExpression struct {
 	Left  *_MemberExpression `@@`
 	Right []*_OpFactor       `{ @@ }`
 }
 
 type _OpFactor struct {
-	Operator string  `@("*" | "/")`
+	Operator string  `@("*" | "/" | "%" | "<<" | ">>" | "&")`
 	Factor   *_Value `@@`
 }
 
-// Expression for membership access (dot operator).
-// e.g. x.y.z
+// Expression for membership access (dot operator), subscripts and
+// slices.
+// e.g. x.y.z, x[0].y, x["key"], x[-1], x[1:3]
 type _MemberExpression struct {
 	Left  *_Value              `@@`
 	Right []*_OpMembershipTerm `[{ @@ }] `
-	Index *int64               `[ "[" @Number "]"]`
 }
 
 type _OpMembershipTerm struct {
-	Operator string `@"."`
-	Term     string `@Ident`
+	Term      string      `( "." @(Ident | SELECT | DISTINCT | WHERE | AND | OR | FROM | NOT | AS | IN | LIKE | BETWEEN | LIMIT | OFFSET | DESC | ASC | LET | CASE | ON)`
+	Subscript *_Subscript `| "[" @@ "]" )`
+}
+
+// x[start] or x[start:end] - either side of a slice may be omitted.
+type _Subscript struct {
+	Start *_AndExpression `[ @@ ]`
+	Slice bool            `[ @":"`
+	End   *_AndExpression `  [ @@ ] ]`
 }
 
 // ---------------------------------------
@@ -723,8 +1065,8 @@ type _OpMembershipTerm struct {
 // 1) , (Array)
 // 2) AND
 // 3) OR
-// 4) * /
-// 5) + -
+// 4) * / % << >> &
+// 5) + - | ^
 // 6) . (dereference operator)
 
 // Comma separated expressions create a list.
@@ -768,9 +1110,27 @@ type _ConditionOperand struct {
 	Right *_OpComparison       `{ @@ }`
 }
 
+// Keywords which may also be used as names (e.g. IN and LIKE) keep
+// their case when lexed, so the operator is normalized once parsed.
+type _ComparisonOperator string
+
+func (self *_ComparisonOperator) Capture(values []string) error {
+	*self = _ComparisonOperator(strings.ToUpper(strings.Join(values, "")))
+	return nil
+}
+
 type _OpComparison struct {
-	Operator string               `@( "<>" | "<=" | ">=" | "=" | "<" | ">" | "!=" | IN | "=~")`
-	Right    *_AdditionExpression `@@`
+	Operator _ComparisonOperator  `( @( "<>" | "<=" | ">=" | "=" | "<" | ">" | "!=" | IN | NOTIN | "=~" | LIKE | NOTLIKE )`
+	Right    *_AdditionExpression `  @@`
+	Between  *_Between            `| @@`
+	IsNull   string               `| @( ISNULL | ISNOTNULL ) )`
+}
+
+// x BETWEEN low AND high (inclusive).
+type _Between struct {
+	Not  bool                 `( BETWEEN | @NOTBETWEEN )`
+	Low  *_AdditionExpression `@@ AND`
+	High *_AdditionExpression `@@`
 }
 
 type _Term struct {
@@ -781,17 +1141,24 @@ type _Term struct {
 }
 
 type _SymbolRef struct {
+	Pos lexer.Position
+
 	Symbol     string   `@Ident`
-	Parameters []*_Args `[ "(" [ @@ { "," @@ } ] ")" ] `
+	Parameters []*_Args `[ "(" [ @@ { "," @@ } ] ")"`
+	Window     *_Window `  [ @@ ] ]`
 
 	mu       sync.Mutex
 	function FunctionInterface
 }
 
 type _Value struct {
+	Complement    bool              `[ @"~" ]`
 	Negated       bool              `[ "-" | "+" ]`
-	SymbolRef     *_SymbolRef       `( @@ `
+	Case          *_CaseExpression  `( @@ `
+	SymbolRef     *_SymbolRef       `| @@ `
 	Subexpression *_CommaExpression `| "(" @@ ")"`
+	Array         *_ArrayLiteral    `| @@`
+	Dict          *_DictLiteral     `| @@`
 
 	String *string ` | @String`
 
@@ -804,6 +1171,37 @@ type _Value struct {
 	Null    bool    ` | @NULL)`
 }
 
+// JSON style literals: [1, 2, "a"] and {"key": value}. A dict
+// literal can not be confused with a subselect ({ SELECT ... })
+// because its keys must be strings.
+type _ArrayLiteral struct {
+	Items []*_AndExpression `"[" [ @@ { "," @@ } ] "]"`
+}
+
+type _DictLiteral struct {
+	Items []*_DictLiteralItem `"{" [ @@ { "," @@ } ] "}"`
+}
+
+type _DictLiteralItem struct {
+	Key   string          `@String ":"`
+	Value *_AndExpression `@@`
+}
+
+// CASE WHEN cond THEN value [ WHEN ... ] [ ELSE value ] END
+//
+// Only CASE is a keyword - WHEN, THEN, ELSE and END are matched as
+// identifiers so they may still be used as names elsewhere
+// (e.g. if(condition=x, then=1, else=2)).
+type _CaseExpression struct {
+	Whens []*_CaseWhen    `CASE @@ { @@ }`
+	Else  *_AndExpression `[ "ELSE" @@ ] "END"`
+}
+
+type _CaseWhen struct {
+	Condition *_AndExpression `"WHEN" @@`
+	Result    *_AndExpression `"THEN" @@`
+}
+
 // A Generic object which may be returned in a row from a plugin.
 type Any interface{}
 
@@ -859,12 +1257,7 @@ func (self _SelectExpression) Transform(
 		expr := expr_
 
 		// Figure out the column name.
-		var column_name string
-		if expr.As != "" {
-			column_name = expr.As
-		} else {
-			column_name = expr.ToString(scope)
-		}
+		column_name := expr.GetName(scope)
 
 		new_row.AddColumn(
 			column_name,
@@ -886,15 +1279,21 @@ func (self *_SelectExpression) Columns(scope *Scope) *[]string {
 	var result []string
 
 	for _, expr := range self.Expressions {
-		if expr.As != "" {
-			result = append(result, expr.As)
-		} else {
-			result = append(result, expr.ToString(scope))
-		}
+		result = append(result, expr.GetName(scope))
 	}
 	return &result
 }
 
+// Does any column call an aggregate function?
+func (self *_SelectExpression) hasAggregate(scope *Scope) bool {
+	for _, expr := range self.Expressions {
+		if expr.Expression != nil && expr.Expression.IsAggregate(scope) {
+			return true
+		}
+	}
+	return false
+}
+
 func (self _SelectExpression) ToString(scope *Scope) string {
 	var substrings []string
 	if self.All {
@@ -912,7 +1311,12 @@ func (self _SelectExpression) ToString(scope *Scope) string {
 func (self _From) Eval(ctx context.Context, scope *Scope) <-chan Row {
 	output_chan := make(chan Row)
 
-	input_chan := self.Plugin.Eval(ctx, scope)
+	var input_chan <-chan Row
+	if self.Alias == "" && len(self.Joins) == 0 {
+		input_chan = self.Plugin.Eval(ctx, scope)
+	} else {
+		input_chan = self.evalJoins(ctx, scope)
+	}
 	go func() {
 		defer close(output_chan)
 		for {
@@ -925,7 +1329,11 @@ func (self _From) Eval(ctx context.Context, scope *Scope) <-chan Row {
 					if !ok {
 						return
 					}
-					output_chan <- row
+					select {
+					case <-ctx.Done():
+						return
+					case output_chan <- row:
+					}
 				}
 			}
 		}
@@ -936,6 +1344,13 @@ func (self _From) Eval(ctx context.Context, scope *Scope) <-chan Row {
 
 func (self _From) ToString(scope *Scope) string {
 	result := self.Plugin.ToString(scope)
+	if self.Alias != "" {
+		result += " AS " + quoteIdent(self.Alias)
+	}
+
+	for _, join := range self.Joins {
+		result += " " + join.ToString(scope)
+	}
 	return result
 }
 
@@ -944,6 +1359,16 @@ func (self _Plugin) getPlugin(scope *Scope, plugin_name string) (
 	components := strings.Split(plugin_name, ".")
 	// Single plugin reference.
 	if len(components) == 1 {
+		// Plugins defined by LET in the scope shadow
+		// built in plugins.
+		value, pres := scope.Resolve(plugin_name)
+		if pres {
+			plugin, ok := value.(PluginGeneratorInterface)
+			if ok {
+				return plugin, true
+			}
+		}
+
 		plugin, pres := scope.plugins[plugin_name]
 		return plugin, pres
 	}
@@ -986,20 +1411,38 @@ func (self _Plugin) Eval(ctx context.Context, scope *Scope) <-chan Row {
 				if ok {
 					from_chan := stored_query.Eval(ctx, scope)
 					for row := range from_chan {
-						output_chan <- row
+						select {
+						case <-ctx.Done():
+							return
+						case output_chan <- row:
+						}
 					}
 
 				} else if is_array(variable) {
 					var_slice := reflect.ValueOf(variable)
 					for i := 0; i < var_slice.Len(); i++ {
-						output_chan <- var_slice.Index(i).Interface()
+						select {
+						case <-ctx.Done():
+							return
+						case output_chan <- var_slice.Index(i).Interface():
+						}
 					}
 				} else {
-					output_chan <- variable
+					select {
+					case <-ctx.Done():
+						return
+					case output_chan <- variable:
+					}
 				}
 			} else {
-				scope.Log("SELECTing from %v failed! No such var in scope",
-					self.Name)
+				scope.ReportError(&QueryError{
+					Type: UnknownSymbolError,
+					Message: fmt.Sprintf(
+						"SELECTing from %v failed! No such var in scope",
+						self.Name),
+					Node: self.toString(scope),
+					Pos:  self.Pos,
+				})
 			}
 			return
 		}
@@ -1008,26 +1451,24 @@ func (self _Plugin) Eval(ctx context.Context, scope *Scope) <-chan Row {
 		// plugin implementation can extract these using the
 		// ExtractArgs() helper.
 		args := ordereddict.NewDict()
-		for _, arg := range self.Args {
+		for idx, arg := range self.Args {
+			name := arg.name(self.Args, idx)
 			if arg.Right != nil {
-				args.Set(arg.Left, LazyExpr{arg.Right, ctx, scope})
+				args.Set(name, LazyExpr{arg.Right, ctx, scope})
 
-			} else if arg.Array != nil {
-				value := arg.Array.Reduce(ctx, scope)
-				if value == nil {
-					output_chan <- Null{}
-					return
-				}
-				args.Set(arg.Left, value)
 
 			} else if arg.SubSelect != nil {
-				args.Set(arg.Left, arg.SubSelect)
+				args.Set(name, arg.SubSelect)
 			}
 		}
 
 		if plugin, pres := self.getPlugin(scope, self.Name); pres {
-			for row := range plugin.Call(ctx, scope, args) {
-				output_chan <- row
+			for row := range plugin.Call(ctx, scope.withCallSite(self), args) {
+				select {
+				case <-ctx.Done():
+					return
+				case output_chan <- row:
+				}
 			}
 		} else {
 			options := getSimilarPlugins(scope, self.Name)
@@ -1046,7 +1487,12 @@ func (self _Plugin) Eval(ctx context.Context, scope *Scope) <-chan Row {
 						"function instead?", self.Name)
 			}
 
-			scope.Log("%v", message)
+			scope.ReportError(&QueryError{
+				Type:    UnknownPluginError,
+				Message: message,
+				Node:    self.toString(scope),
+				Pos:     self.Pos,
+			})
 		}
 	}()
 
@@ -1090,7 +1536,16 @@ func (self *_Plugin) Columns(scope *Scope) *[]string {
 }
 
 func (self _Plugin) ToString(scope *Scope) string {
-	result := self.Name
+	return self.toString(scope)
+}
+
+func (self _Plugin) toString(scope *Scope) string {
+	var names []string
+	for _, name := range strings.Split(self.Name, ".") {
+		names = append(names, quoteIdent(name))
+	}
+
+	result := strings.Join(names, ".")
 	if self.Call {
 		var substrings []string
 		for _, arg := range self.Args {
@@ -1103,13 +1558,40 @@ func (self _Plugin) ToString(scope *Scope) string {
 	return result
 }
 
+func (self _Plugin) position() lexer.Position {
+	return self.Pos
+}
+
+// The name the arg is passed with. Positional args are numbered in
+// the order they appear among the other positional args.
+func (self _Args) name(all_args []*_Args, idx int) string {
+	if self.Left != "" {
+		return self.Left
+	}
+
+	position := 0
+	for _, arg := range all_args[:idx] {
+		if arg.Left == "" {
+			position++
+		}
+	}
+
+	return positionalArg(position)
+}
+
 func (self _Args) ToString(scope *Scope) string {
+	prefix := ""
+	if self.Left != "" {
+		prefix = quoteName(self.Left) + "= "
+	}
+
 	if self.Right != nil {
-		return self.Left + "=" + self.Right.ToString(scope)
+		if self.Left == "" {
+			return self.Right.ToString(scope)
+		}
+		return quoteName(self.Left) + "=" + self.Right.ToString(scope)
 	} else if self.SubSelect != nil {
-		return self.Left + "= { " + self.SubSelect.ToString(scope) + "}"
-	} else if self.Array != nil {
-		return self.Left + "= [" + self.Array.ToString(scope) + "]"
+		return prefix + "{ " + self.SubSelect.ToString(scope) + "}"
 	}
 	return ""
 }
@@ -1119,23 +1601,25 @@ func (self _MemberExpression) IsAggregate(scope *Scope) bool {
 		return true
 	}
 
+	for _, term := range self.Right {
+		if term.Subscript != nil && term.Subscript.IsAggregate(scope) {
+			return true
+		}
+	}
+
 	return false
 }
 
 func (self _MemberExpression) Reduce(ctx context.Context, scope *Scope) Any {
 	lhs := self.Left.Reduce(ctx, scope)
 	for _, term := range self.Right {
-		var pres bool
-		lhs, pres = scope.Associative(lhs, term.Term)
-		if !pres {
-			return Null{}
+		if term.Subscript != nil {
+			lhs = term.Subscript.Reduce(ctx, scope, lhs)
+			continue
 		}
-	}
 
-	// Slice index implementation via Associative protocol.
-	if self.Index != nil {
 		var pres bool
-		lhs, pres = scope.Associative(lhs, self.Index)
+		lhs, pres = scope.Associative(lhs, term.Term)
 		if !pres {
 			return Null{}
 		}
@@ -1145,19 +1629,81 @@ func (self _MemberExpression) Reduce(ctx context.Context, scope *Scope) Any {
 }
 
 func (self _MemberExpression) ToString(scope *Scope) string {
-	result_comp := []string{self.Left.ToString(scope)}
+	result := self.Left.ToString(scope)
 	for _, right := range self.Right {
-		result_comp = append(result_comp, right.Term)
+		if right.Subscript != nil {
+			result += right.Subscript.ToString(scope)
+		} else {
+			result += "." + quoteName(right.Term)
+		}
+	}
+
+	return result
+}
+
+func (self *_Subscript) IsAggregate(scope *Scope) bool {
+	return (self.Start != nil && self.Start.IsAggregate(scope)) ||
+		(self.End != nil && self.End.IsAggregate(scope))
+}
+
+func (self *_Subscript) Reduce(ctx context.Context, scope *Scope, value Any) Any {
+	if self.Slice {
+		var start, end Any = Null{}, Null{}
+		if self.Start != nil {
+			start = self.Start.Reduce(ctx, scope)
+		}
+
+		if self.End != nil {
+			end = self.End.Reduce(ctx, scope)
+		}
+
+		return scope.Slice(value, start, end)
+	}
+
+	if self.Start == nil {
+		return Null{}
 	}
 
-	result := strings.Join(result_comp, ".")
-	if self.Index != nil {
-		result += fmt.Sprintf("[%d]", *self.Index)
+	key := self.Start.Reduce(ctx, scope)
+
+	// Numeric indexes are passed to the Associative protocol as
+	// *int64. Negative indexes count from the end of arrays.
+	if is_integral(key) {
+		idx, _ := to_int64(key)
+		if idx < 0 {
+			length, ok := sliceLength(value)
+			if !ok {
+				return Null{}
+			}
+			idx += int64(length)
+		}
+		key = &idx
+	}
+
+	result, pres := scope.Associative(value, key)
+	if !pres {
+		return Null{}
 	}
 
 	return result
 }
 
+func (self *_Subscript) ToString(scope *Scope) string {
+	result := "["
+	if self.Start != nil {
+		result += self.Start.ToString(scope)
+	}
+
+	if self.Slice {
+		result += ":"
+		if self.End != nil {
+			result += self.End.ToString(scope)
+		}
+	}
+
+	return result + "]"
+}
+
 func (self _CommaExpression) IsAggregate(scope *Scope) bool {
 	if self.Left != nil && self.Left.IsAggregate(scope) {
 		return true
@@ -1307,6 +1853,10 @@ func (self _AdditionExpression) Reduce(ctx context.Context, scope *Scope) Any {
 			result = scope.Add(result, term_value)
 		case "-":
 			result = scope.Sub(result, term_value)
+		case "|":
+			result = scope.BitwiseOr(result, term_value)
+		case "^":
+			result = scope.BitwiseXor(result, term_value)
 		}
 	}
 
@@ -1337,6 +1887,12 @@ func (self _ConditionOperand) IsAggregate(scope *Scope) bool {
 		return true
 	}
 
+	if self.Right != nil && self.Right.Between != nil &&
+		(self.Right.Between.Low.IsAggregate(scope) ||
+			self.Right.Between.High.IsAggregate(scope)) {
+		return true
+	}
+
 	return false
 }
 
@@ -1351,6 +1907,17 @@ func (self _ConditionOperand) Reduce(ctx context.Context, scope *Scope) Any {
 		return lhs
 	}
 
+	switch self.Right.IsNull {
+	case "IS NULL":
+		return scope.IsNull(lhs)
+	case "IS NOT NULL":
+		return !scope.IsNull(lhs)
+	}
+
+	if self.Right.Between != nil {
+		return self.Right.Between.Reduce(ctx, scope, lhs)
+	}
+
 	rhs := self.Right.Right.Reduce(ctx, scope)
 
 	var result Any = false
@@ -1358,6 +1925,12 @@ func (self _ConditionOperand) Reduce(ctx context.Context, scope *Scope) Any {
 	switch self.Right.Operator {
 	case "IN":
 		result = scope.membership.Membership(scope, lhs, rhs)
+	case "NOT IN":
+		result = !scope.membership.Membership(scope, lhs, rhs)
+	case "LIKE":
+		result = scope.Like(rhs, lhs)
+	case "NOT LIKE":
+		result = !scope.Like(rhs, lhs)
 	case "<":
 		result = scope.Lt(lhs, rhs)
 	case "=":
@@ -1392,14 +1965,48 @@ func (self _ConditionOperand) ToString(scope *Scope) string {
 
 	result := self.Left.ToString(scope)
 
-	if self.Right != nil {
-		result += " " + self.Right.Operator + " " +
-			self.Right.Right.ToString(scope)
+	if self.Right == nil {
+		return result
+	}
+
+	if self.Right.IsNull != "" {
+		return result + " " + self.Right.IsNull
+	}
+
+	if self.Right.Between != nil {
+		return result + " " + self.Right.Between.ToString(scope)
 	}
 
+	return result + " " + string(self.Right.Operator) + " " +
+		self.Right.Right.ToString(scope)
+}
+
+func (self _Between) Reduce(ctx context.Context, scope *Scope, value Any) Any {
+	low := self.Low.Reduce(ctx, scope)
+	high := self.High.Reduce(ctx, scope)
+
+	result := (scope.Lt(low, value) || scope.Eq(low, value)) &&
+		(scope.Lt(value, high) || scope.Eq(value, high))
+
+	scope.Trace("Operation %v BETWEEN %v AND %v gave %v",
+		value, low, high, result)
+
+	if self.Not {
+		return !result
+	}
 	return result
 }
 
+func (self _Between) ToString(scope *Scope) string {
+	result := "BETWEEN "
+	if self.Not {
+		result = "NOT BETWEEN "
+	}
+
+	return result + self.Low.ToString(scope) + " AND " +
+		self.High.ToString(scope)
+}
+
 func (self _MultiplicationExpression) IsAggregate(scope *Scope) bool {
 	if self.Left != nil && self.Left.IsAggregate(scope) {
 		return true
@@ -1422,6 +2029,14 @@ func (self _MultiplicationExpression) Reduce(ctx context.Context, scope *Scope)
 			result = scope.Mul(result, term_value)
 		case "/":
 			result = scope.Div(result, term_value)
+		case "%":
+			result = scope.Mod(result, term_value)
+		case "<<":
+			result = scope.LeftShift(result, term_value)
+		case ">>":
+			result = scope.RightShift(result, term_value)
+		case "&":
+			result = scope.BitwiseAnd(result, term_value)
 		}
 	}
 
@@ -1438,6 +2053,10 @@ func (self _MultiplicationExpression) ToString(scope *Scope) string {
 }
 
 func (self _Value) IsAggregate(scope *Scope) bool {
+	if self.Case != nil && self.Case.IsAggregate(scope) {
+		return true
+	}
+
 	if self.SymbolRef != nil && self.SymbolRef.IsAggregate(scope) {
 		return true
 	}
@@ -1446,6 +2065,14 @@ func (self _Value) IsAggregate(scope *Scope) bool {
 		return true
 	}
 
+	if self.Array != nil && self.Array.IsAggregate(scope) {
+		return true
+	}
+
+	if self.Dict != nil && self.Dict.IsAggregate(scope) {
+		return true
+	}
+
 	return false
 }
 
@@ -1489,12 +2116,23 @@ func unquote(s string) (string, error) {
 }
 
 func (self _Value) Reduce(ctx context.Context, scope *Scope) Any {
+	if self.Complement {
+		self.Complement = false
+		return scope.BitwiseNot(self.Reduce(ctx, scope))
+	}
+
 	self.maybeParseStrNumber(scope)
 
-	if self.Subexpression != nil {
+	if self.Case != nil {
+		return self.Case.Reduce(ctx, scope)
+	} else if self.Subexpression != nil {
 		return self.Subexpression.Reduce(ctx, scope)
 	} else if self.SymbolRef != nil {
 		return self.SymbolRef.Reduce(ctx, scope)
+	} else if self.Array != nil {
+		return self.Array.Reduce(ctx, scope)
+	} else if self.Dict != nil {
+		return self.Dict.Reduce(ctx, scope)
 	}
 
 	if self.String != nil {
@@ -1519,6 +2157,11 @@ func (self _Value) Reduce(ctx context.Context, scope *Scope) Any {
 }
 
 func (self _Value) ToString(scope *Scope) string {
+	if self.Complement {
+		self.Complement = false
+		return "~" + self.ToString(scope)
+	}
+
 	self.maybeParseStrNumber(scope)
 
 	factor := 1.0
@@ -1526,10 +2169,16 @@ func (self _Value) ToString(scope *Scope) string {
 		factor = -1.0
 	}
 
-	if self.SymbolRef != nil {
+	if self.Case != nil {
+		return self.Case.ToString(scope)
+	} else if self.SymbolRef != nil {
 		return self.SymbolRef.ToString(scope)
 	} else if self.Subexpression != nil {
 		return "(" + self.Subexpression.ToString(scope) + ")"
+	} else if self.Array != nil {
+		return self.Array.ToString(scope)
+	} else if self.Dict != nil {
+		return self.Dict.ToString(scope)
 
 	} else if self.String != nil {
 		return *self.String
@@ -1559,12 +2208,109 @@ func (self _Value) ToString(scope *Scope) string {
 	}
 }
 
+func (self *_ArrayLiteral) IsAggregate(scope *Scope) bool {
+	for _, item := range self.Items {
+		if item.IsAggregate(scope) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *_ArrayLiteral) Reduce(ctx context.Context, scope *Scope) Any {
+	result := make([]Any, 0, len(self.Items))
+	for _, item := range self.Items {
+		result = append(result, item.Reduce(ctx, scope))
+	}
+	return result
+}
+
+func (self *_ArrayLiteral) ToString(scope *Scope) string {
+	var items []string
+	for _, item := range self.Items {
+		items = append(items, item.ToString(scope))
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+func (self *_DictLiteral) IsAggregate(scope *Scope) bool {
+	for _, item := range self.Items {
+		if item.Value.IsAggregate(scope) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *_DictLiteral) Reduce(ctx context.Context, scope *Scope) Any {
+	result := ordereddict.NewDict()
+	for _, item := range self.Items {
+		key, err := unquote(item.Key)
+		if err != nil {
+			scope.Log("Invalid dict key %v: %v", item.Key, err)
+			continue
+		}
+		result.Set(key, item.Value.Reduce(ctx, scope))
+	}
+	return result
+}
+
+func (self *_DictLiteral) ToString(scope *Scope) string {
+	var items []string
+	for _, item := range self.Items {
+		items = append(items, item.Key+": "+item.Value.ToString(scope))
+	}
+	return "{" + strings.Join(items, ", ") + "}"
+}
+
+func (self *_CaseExpression) IsAggregate(scope *Scope) bool {
+	for _, when := range self.Whens {
+		if when.Condition.IsAggregate(scope) ||
+			when.Result.IsAggregate(scope) {
+			return true
+		}
+	}
+
+	return self.Else != nil && self.Else.IsAggregate(scope)
+}
+
+// Only the branch which is selected is evaluated.
+func (self *_CaseExpression) Reduce(ctx context.Context, scope *Scope) Any {
+	for _, when := range self.Whens {
+		if scope.Bool(when.Condition.Reduce(ctx, scope)) {
+			return when.Result.Reduce(ctx, scope)
+		}
+	}
+
+	if self.Else != nil {
+		return self.Else.Reduce(ctx, scope)
+	}
+
+	return Null{}
+}
+
+func (self *_CaseExpression) ToString(scope *Scope) string {
+	result := "CASE"
+	for _, when := range self.Whens {
+		result += " WHEN " + when.Condition.ToString(scope) +
+			" THEN " + when.Result.ToString(scope)
+	}
+
+	if self.Else != nil {
+		result += " ELSE " + self.Else.ToString(scope)
+	}
+
+	return result + " END"
+}
+
 func (self *_SymbolRef) IsAggregate(scope *Scope) bool {
 	self.mu.Lock()
 	defer self.mu.Unlock()
 
-	// If it is not a function then it can not be an aggregate.
-	if self.Parameters == nil {
+	// If it is not a function then it can not be an
+	// aggregate. Aggregates over a window are evaluated for each
+	// row.
+	if self.Parameters == nil || self.Window != nil {
 		return false
 	}
 
@@ -1577,51 +2323,108 @@ func (self *_SymbolRef) IsAggregate(scope *Scope) bool {
 	return value.Info(scope, NewTypeMap()).IsAggregate
 }
 
-func (self *_SymbolRef) Reduce(ctx context.Context, scope *Scope) Any {
-	self.mu.Lock()
-	defer self.mu.Unlock()
-
-	// Build up the args to pass to the function.
+// Build up the args to pass to the function.
+func (self *_SymbolRef) args(ctx context.Context, scope *Scope) *ordereddict.Dict {
 	args := ordereddict.NewDict()
-	for _, arg := range self.Parameters {
+	for idx, arg := range self.Parameters {
+		name := arg.name(self.Parameters, idx)
 		if arg.Right != nil {
 			// Lazily evaluate right hand side.
-			args.Set(arg.Left, LazyExpr{arg.Right, ctx, scope})
+			args.Set(name, LazyExpr{arg.Right, ctx, scope})
 
-		} else if arg.Array != nil {
-			value := arg.Array.Reduce(ctx, scope)
-			args.Set(arg.Left, value)
 
 		} else if arg.SubSelect != nil {
-			args.Set(arg.Left, arg.SubSelect)
+			args.Set(name, arg.SubSelect)
+		}
+	}
+
+	return args
+}
+
+func (self *_SymbolRef) Reduce(ctx context.Context, scope *Scope) Any {
+	// Window functions are evaluated over all the rows before
+	// the columns are (see _Select.evalWindows()).
+	if self.Window != nil {
+		value, pres := scope.Resolve(windowKey(self))
+		if !pres {
+			scope.Log("%v: Window functions may only be used in the "+
+				"columns of a query.", self.Symbol)
+			return Null{}
+		}
+		return value
+	}
+
+	// Functions defined by LET in the scope shadow built in
+	// functions. These may change between scopes so are never
+	// cached.
+	value, pres := scope.Resolve(self.Symbol)
+	if pres && self.Parameters != nil {
+		user_function, ok := value.(FunctionInterface)
+		if ok {
+			return user_function.Call(ctx, scope.withCallSite(self),
+				self.args(ctx, scope))
 		}
 	}
 
 	// If this AST node previously called a function, we use the
-	// same function copy to ensure it may store internal state.
-	if self.function != nil {
-		return self.function.Call(ctx, scope, args)
+	// same function copy to ensure it may store internal
+	// state. NOTE: We must not hold the lock while calling the
+	// function since it may recursively reduce this node.
+	self.mu.Lock()
+	function := self.function
+	if function == nil {
+		// Lookup the symbol in the scope. Functions take
+		// precedence over symbols.
+		func_obj, pres := scope.functions[self.Symbol]
+		if pres {
+			// Make a copy of the function for next time.
+			self.function = func_obj
+			function = func_obj
+		}
 	}
+	self.mu.Unlock()
 
-	// Lookup the symbol in the scope. Functions take
-	// precedence over symbols.
+	if function != nil {
+		// Aggregates keep a separate state for each call site.
+		aggregate, ok := function.(_AggregateFunction)
+		if ok {
+			if scope.GetContext(aggregate_final_key) != nil {
+				return aggregate.result(
+					scope.withCallSite(self), GetID(self))
+			}
 
-	// The symbol is a function.
-	func_obj, pres := scope.functions[self.Symbol]
-	if pres {
-		// Make a copy of the function for next time.
-		self.function = func_obj
-		return self.function.Call(ctx, scope, args)
+			return aggregate.accumulate(
+				ctx, scope.withCallSite(self), GetID(self),
+				self.args(ctx, scope))
+		}
+
+		return function.Call(ctx, scope.withCallSite(self),
+			self.args(ctx, scope))
 	}
 
 	// The symbol is just a constant in the scope.
-	value, pres := scope.Resolve(self.Symbol)
 	if pres {
+		// A stored expression (LET without parameters) is
+		// reduced every time it is referenced.
+		stored_expression, ok := value.(*_StoredExpression)
+		if ok {
+			return stored_expression.Call(ctx, scope, self.args(ctx, scope))
+		}
 		return value
 	}
 
-	scope.Log("Symbol %v not found. %s", self.Symbol,
-		scope.PrintVars())
+	error_type := UnknownSymbolError
+	if self.Parameters != nil {
+		error_type = UnknownFunctionError
+	}
+
+	scope.ReportError(&QueryError{
+		Type: error_type,
+		Message: fmt.Sprintf("Symbol %v not found. %s", self.Symbol,
+			scope.PrintVars()),
+		Node: self.toString(scope),
+		Pos:  self.Pos,
+	})
 	return Null{}
 }
 
@@ -1629,8 +2432,16 @@ func (self *_SymbolRef) ToString(scope *Scope) string {
 	self.mu.Lock()
 	defer self.mu.Unlock()
 
-	symbol := self.Symbol
-	if self.Parameters == nil {
+	return self.toString(scope)
+}
+
+func (self *_SymbolRef) position() lexer.Position {
+	return self.Pos
+}
+
+func (self *_SymbolRef) toString(scope *Scope) string {
+	symbol := quoteIdent(self.Symbol)
+	if self.Parameters == nil && self.Window == nil {
 		return symbol
 	}
 
@@ -1639,5 +2450,10 @@ func (self *_SymbolRef) ToString(scope *Scope) string {
 		substrings = append(substrings, arg.ToString(scope))
 	}
 
-	return symbol + "(" + strings.Join(substrings, ", ") + ")"
+	result := symbol + "(" + strings.Join(substrings, ", ") + ")"
+	if self.Window != nil {
+		result += " " + self.Window.ToString(scope)
+	}
+
+	return result
 }
@@ -1,13 +1,23 @@
 package vfilter
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Velocidex/ordereddict"
+	"github.com/alecthomas/participle/lexer"
 	"github.com/sebdah/goldie"
 	"github.com/stretchr/testify/assert"
 )
@@ -154,6 +164,93 @@ var execTestsSerialization = []execTest{
 	{"(my_list_obj.my_list[3]).Foo", "Bar"},
 	{"dict(x=(my_list_obj.my_list[3]).Foo + 'a')",
 		ordereddict.NewDict().Set("x", "Bara")},
+
+	// IS NULL, BETWEEN, LIKE and NOT IN
+	{"NULL IS NULL", true},
+	{"1 IS NULL", false},
+	{"1 is not null", true},
+	{"NULL IS NOT NULL", false},
+	{"2 BETWEEN 1 AND 3", true},
+	{"3 BETWEEN 1 AND 3", true},
+	{"4 between 1 and 3", false},
+	{"4 NOT BETWEEN 1 AND 3", true},
+	{"2 BETWEEN 1 AND 3 AND FALSE", false},
+	{"1 + 1 BETWEEN 0 + 1 AND 2 * 1", true},
+	{"'hello' LIKE 'h%o'", true},
+	{"'hello' like 'H_LLO'", true},
+	{"'hello' LIKE 'h_o'", false},
+	{"'hello' NOT LIKE '%z%'", true},
+	{"'a.c' LIKE 'a.c'", true},
+	{"'abc' LIKE 'a.c'", false},
+	{"'50%' LIKE '50\\\\%'", true},
+	{"'500' LIKE '50\\\\%'", false},
+	{"2 NOT IN (1, 3)", true},
+	{"2 not in (1, 2)", false},
+
+	// Modulo, bitwise and shift operators
+	{"7 % 3", 1},
+	{"7.5 % 2", 1.5},
+	{"1 + 7 % 3 * 2", 3},
+	{"15 & 60", 12},
+	{"15 | 48", 63},
+	{"15 ^ 60", 51},
+	{"1 << 4", 16},
+	{"256 >> 4", 16},
+	{"~0", -1},
+	{"~15 & 255", 240},
+	{"1 | 2 & 0", 1},
+	{"(1 | 2) & 3", 3},
+	{"16 & 16 = 16", true},
+	{"7 % 0", false},
+
+	// Subscripts and slices
+	{"my_list_obj.my_list[3].Foo", "Bar"},
+	{"my_list_obj.my_list[-1].Foo", "Bar"},
+	{"my_list_obj.my_list[1 + 1]", 3},
+	{"my_list_obj['my_list'][-3]", 2},
+	{"foo['bar'].baz", 5},
+	{"dict(foo=5)['foo']", 5},
+	{"my_list_obj.my_list[10] IS NULL", true},
+	{"my_list_obj.my_list[-10] IS NULL", true},
+	{"my_list_obj.my_list[0:2]", []Any{1, 2}},
+	{"my_list_obj.my_list[:2]", []Any{1, 2}},
+	{"my_list_obj.my_list[-2:][0]", 3},
+	{"my_list_obj.my_list[2:1]", []Any{}},
+	{"my_list_obj.my_list[-10:1]", []Any{1}},
+	{"'hello'[1:3]", "el"},
+	{"'hello'[-3:]", "llo"},
+	{"'hello'[:]", "hello"},
+
+	// Array and dict literals
+	{"[1, 2, 'a']", []Any{1, 2, "a"}},
+	{"[]", []Any{}},
+	{"[1, [2, 3]][1][0]", 2},
+	{"2 IN [1, 2]", true},
+	{"{}", ordereddict.NewDict()},
+	{`{"a": 1, 'b c': 1 + 1}`, ordereddict.NewDict().
+		Set("a", int64(1)).Set("b c", int64(2))},
+	{`{"a": {"b": [1, 2]}}['a'].b[1]`, 2},
+	{`{"a": 1 = 1 AND 2 = 2}`, ordereddict.NewDict().Set("a", true)},
+
+	// Array literals as args are expressions.
+	{"dict(x=[1, 2][0]).x", 1},
+	{"dict(x=[1] + [2]).x", []Any{1, 2}},
+	{"dict(x=[1, 2] = [1, 2]).x", true},
+	{"dict(x=[1]).x", []Any{1}},
+
+	// Times and durations
+	{"timestamp(epoch=1600000000) = '2020-09-13T12:26:40Z'", true},
+	{"timestamp(epoch='2020-09-13 12:26:40') = 1600000000", true},
+	{"timestamp(epoch='1600000000') = timestamp(epoch=1600000000)", true},
+	{"timestamp(epoch=0)", Null{}},
+	{"timestamp(epoch=1600000000) - timestamp(epoch=1599913600)", 24 * time.Hour},
+	{"timestamp(epoch=1600000000) - '1 day' = timestamp(epoch=1599913600)", true},
+	{"timestamp(epoch=1600000000) - 60 = timestamp(epoch=1599999940)", true},
+	{"'1h30m' + timestamp(epoch=1600000000) > timestamp(epoch=1600005000)", true},
+	{"timestamp(epoch=1600000000) - timestamp(epoch=1599913600) > '23 hours'", true},
+	{"now() > timestamp(epoch=1600000000)", true},
+	{"now() - '1 week, 2 days' < now()", true},
+	{"now() < '5 days'", false},
 }
 
 // These tests are excluded from serialization tests.
@@ -321,7 +418,7 @@ func TestSerializaition(t *testing.T) {
 				vql_string, err, test.clause)
 		}
 
-		if !reflect.DeepEqual(parsed_vql, vql) {
+		if !reflect.DeepEqual(clearPositions(parsed_vql), clearPositions(vql)) {
 			Debug(vql)
 			t.Fatalf("Parsed generated VQL not equivalent: %v vs %v.",
 				preamble+test.clause, vql_string)
@@ -329,6 +426,39 @@ func TestSerializaition(t *testing.T) {
 	}
 }
 
+// Source positions depend on the formatting of the query so we
+// ignore them when comparing ASTs.
+func clearPositions(node Any) Any {
+	position_type := reflect.TypeOf(lexer.Position{})
+
+	var walk func(value reflect.Value)
+	walk = func(value reflect.Value) {
+		switch value.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			if !value.IsNil() {
+				walk(value.Elem())
+			}
+		case reflect.Slice:
+			for i := 0; i < value.Len(); i++ {
+				walk(value.Index(i))
+			}
+		case reflect.Struct:
+			if value.Type() == position_type {
+				if value.CanSet() {
+					value.Set(reflect.Zero(position_type))
+				}
+				return
+			}
+			for i := 0; i < value.NumField(); i++ {
+				walk(value.Field(i))
+			}
+		}
+	}
+	walk(reflect.ValueOf(node))
+
+	return node
+}
+
 type vqlTest struct {
 	name string
 	vql  string
@@ -457,7 +587,6 @@ select * from test() limit 1`},
 
 	{"Group by enumrate of string",
 		"select baz, bar, enumerate(items=baz) from groupbytest() GROUP BY bar"},
-
 	{"Lazy row evaluation (Shoud panic if foo=2",
 		"select foo, panic(column=foo, value=2) from test() where foo = 4"},
 	{"Quotes strings",
@@ -478,6 +607,187 @@ select * from test() limit 1`},
 		"SELECT (1,2) + if(condition=0, then=(3,4)) AS Field FROM scope()"},
 	{"Spurious line feeds and tabs",
 		"SELECT  \n1\n+\n2\tAS\nFooBar\t\n FROM\n scope(\n)\nWHERE\n FooBar >\n1\nAND\nTRUE\n"},
+	{"LET user defined function",
+		"LET is_big(x) = x > 2"},
+	{"Call user defined function",
+		"SELECT foo, is_big(x=foo) AS Big FROM test()"},
+	{"LET user defined function with several parameters",
+		"LET add_up(x, y) = x + y"},
+	{"Call user defined function with missing parameter",
+		"SELECT add_up(x=1, y=2), add_up(x=(1, 2)) FROM scope()"},
+	{"LET recursive user defined function",
+		"LET fact(n) = if(condition=n <= 1, then=1, else=n * fact(n=n - 1))"},
+	{"Call recursive user defined function",
+		"SELECT fact(n=5) AS Fact FROM scope()"},
+	{"LET user defined function shadows built in function",
+		"LET encode(string, type) = string + type"},
+	{"Call shadowed function",
+		"SELECT encode(string='a', type='hex') FROM scope()"},
+	{"LET parameterized query",
+		"LET greater(value) = SELECT * FROM test() WHERE foo > value"},
+	{"Select from parameterized query",
+		"SELECT * FROM greater(value=1)"},
+	{"Parameterized query as a stored query",
+		"SELECT * FROM greater"},
+	{"LET expression without parameters",
+		"LET constant = 1 + 2"},
+	{"LET materialized expression",
+		"LET materialized_constant <= 1 + 3"},
+	{"Refer to LET expressions",
+		"SELECT constant, materialized_constant FROM scope()"},
+	{"JOIN plugins",
+		"SELECT a.foo, b.value FROM test() AS a JOIN range(start=1, end=4) AS b ON a.foo = b.value"},
+	{"LEFT JOIN plugins",
+		"SELECT a.foo, b.value FROM test() AS a LEFT JOIN range(start=1, end=4) AS b ON a.foo = b.value"},
+	{"LET stored query for JOIN",
+		"LET numbers = SELECT value, value * 2 AS doubled FROM range(start=0, end=4)"},
+	{"JOIN stored queries with unqualified columns",
+		"SELECT * FROM test() JOIN numbers ON test.bar = numbers.value"},
+	{"JOIN with non equality condition",
+		"SELECT test.foo, numbers.value FROM test() JOIN numbers ON test.foo < numbers.value AND numbers.value < 3"},
+	{"JOIN with equality and additional condition",
+		"SELECT test.foo, numbers.doubled FROM test() JOIN numbers ON numbers.doubled = test.foo AND test.bar > 0"},
+	{"Chained JOIN",
+		"SELECT a.foo, b.value, c.doubled FROM test() AS a JOIN numbers AS b ON a.bar = b.value LEFT JOIN numbers AS c ON b.value = c.doubled"},
+	{"Group by multiple columns",
+		"select bar, foo > 1 AS big, count(items=foo) AS Count from groupbytest() GROUP BY bar, big"},
+	{"Group by expression",
+		"select bar, enumerate(items=foo) AS Foos from groupbytest() GROUP BY foo < 3"},
+	{"Group by array",
+		"select bar, enumerate(items=baz) AS Bazs from groupbytest() GROUP BY (bar, 1)"},
+	{"Group by dict",
+		"select bar, enumerate(items=baz) AS Bazs from groupbytest() GROUP BY dict(x=bar)"},
+	{"Select distinct",
+		"select DISTINCT bar from groupbytest()"},
+	{"Select distinct with limit",
+		"select distinct bar, foo > 1 AS big from groupbytest() LIMIT 2"},
+	{"Select distinct with group by",
+		"select distinct count(items=foo) AS Count from groupbytest() GROUP BY baz"},
+	{"Order by multiple keys",
+		"select foo, bar from groupbytest() order by bar, foo DESC"},
+	{"Order by with explicit ASC",
+		"select foo, bar from groupbytest() order by bar ASC, foo ASC"},
+	{"Order by expression",
+		"select foo from test() order by 0 - foo"},
+	{"Order by with NULLs sorts them last",
+		"select foo, get(item=dict(x=foo), member=if(condition=foo > 0, then='x')) AS x from test() order by x"},
+	{"Order by desc with NULLS LAST",
+		"select foo, get(item=dict(x=foo), member=if(condition=foo > 0, then='x')) AS x from test() order by x DESC NULLS LAST"},
+	{"Order by with NULLS FIRST",
+		"select foo, get(item=dict(x=foo), member=if(condition=foo > 0, then='x')) AS x from test() order by x NULLS FIRST"},
+	{"Order by is stable",
+		"select foo, bar from groupbytest() order by bar"},
+	{"Group by with multi-key order by",
+		"select bar, count(items=foo) AS Count from groupbytest() group by bar order by Count DESC, bar"},
+	{"Limit with offset",
+		"select * from range(start=0, end=9) limit 3 offset 2"},
+	{"Offset without limit",
+		"select * from range(start=0, end=9) offset 7"},
+	{"Offset past the end",
+		"select * from range(start=0, end=9) limit 3 offset 20"},
+	{"Offset with order by",
+		"select * from range(start=0, end=9) order by value desc limit 2 offset 1"},
+	{"Offset with group by",
+		"select bar, count(items=foo) AS Count from groupbytest() group by bar limit 1 offset 1"},
+	{"CASE WHEN",
+		"select foo, CASE WHEN foo = 0 THEN 'zero' WHEN foo = 2 THEN 'two' ELSE 'many' END AS Name from test()"},
+	{"CASE WHEN without ELSE",
+		"select foo, case when foo > 1 then foo * 10 end AS Big from test()"},
+	{"Nested CASE WHEN",
+		"select CASE WHEN foo > 0 THEN CASE WHEN bar = 1 THEN 'one' ELSE 'other' END ELSE 'none' END AS Nested from test()"},
+	{"CASE WHEN in WHERE clause",
+		"select foo from test() where CASE WHEN bar = 1 THEN FALSE ELSE TRUE END"},
+	{"then and else are still valid argument names",
+		"select if(condition=foo, then='yes', else='no') AS If from test()"},
+	{"IS NULL on a missing column",
+		"select foo, Missing IS NULL AS A, foo IS NOT NULL AS B from test()"},
+	{"BETWEEN in WHERE clause",
+		"select * from range(start=0, end=9) where value between 3 and 5"},
+	{"NOT BETWEEN in WHERE clause",
+		"select * from range(start=0, end=9) where value not between 3 and 5 and value > 1"},
+	{"LIKE on strings",
+		"select env_var LIKE 'environment%' AS A, env_var LIKE 'env' AS B, env_var NOT LIKE '_nv%' AS C from scope()"},
+	{"NOT IN in WHERE clause",
+		"select * from test() where foo NOT IN (2, 4)"},
+	{"Bitwise operators",
+		"select value, value & 1 AS Odd, value << 2 AS Shifted, ~value AS Complement, value % 3 AS Mod from range(start=0, end=4) where value & 4 = 0"},
+	{"Subscripts and slices",
+		"select (1, 2, 3, 4)[1:3] AS Slice, (1, 2, 3)[-1] AS Last, dict(a=dict(b=(5, 6)))['a'].b[0] AS Chain, 'hello'[:2] AS Prefix from scope()"},
+	{"Array and dict literals",
+		`select {"Foo": foo, "Double": foo * 2} AS Dict, [foo, bar, 'x'] AS List from test()`},
+	{"Dict literal as a plugin argument",
+		`select * from dict(x={"a": 1}, y=[1, 2], z={ select foo from test() limit 1})`},
+	{"Positional plugin args",
+		"select * from range(0, 2)"},
+	{"Mixed positional and named plugin args",
+		"select * from range(1, end=2)"},
+	{"Positional args to user defined functions",
+		"SELECT add_up(1, 2) AS A, add_up(1, y=5) AS B, fact(4) AS F FROM scope()"},
+	{"Positional args to parameterized query",
+		"SELECT * FROM greater(2)"},
+	{"Time and duration arithmetic",
+		"SELECT timestamp(epoch=1600000000) AS T, " +
+			"timestamp(epoch='2020-09-13') + '1 day' AS Tomorrow, " +
+			"timestamp(epoch=1600000000) - timestamp(epoch=1599913600) AS Delta " +
+			"FROM scope()"},
+	{"Aggregates over the whole result set",
+		"SELECT count(items=foo) AS Count, sum(items=foo) AS Sum, avg(items=foo) AS Avg, " +
+			"variance(items=foo) AS Var, stddev(items=foo) AS Stddev, " +
+			"percentile(foo, 50) AS Median, count_distinct(items=bar) AS Bars, " +
+			"first(items=baz) AS First, last(items=baz) AS Last FROM groupbytest()"},
+	{"Aggregates in group by bins",
+		"SELECT bar, sum(items=foo) AS Sum, percentile(items=foo, p=100) AS Max, " +
+			"histogram(items=baz) AS Bazs FROM groupbytest() GROUP BY bar"},
+	{"Histogram with buckets",
+		"SELECT histogram(items=value, bucket=4) AS Hist FROM range(start=0, end=10)"},
+	{"Aggregates over an empty result set",
+		"SELECT count(items=foo) AS Count FROM groupbytest() WHERE foo > 100"},
+	{"Window functions over partitions",
+		"SELECT foo, bar, row_number() OVER (PARTITION BY bar ORDER BY foo DESC) AS Row, " +
+			"rank() OVER (ORDER BY bar) AS Rank, dense_rank() OVER (ORDER BY bar) AS Dense, " +
+			"lag(foo) OVER (PARTITION BY bar ORDER BY foo) AS Prev, " +
+			"lead(foo, 2, 'none') OVER (ORDER BY foo) AS Next " +
+			"FROM groupbytest()"},
+	{"Aggregates over windows",
+		"SELECT foo, bar, sum(items=foo) OVER (PARTITION BY bar) AS Total, " +
+			"sum(items=foo) OVER (ORDER BY foo) AS Running, " +
+			"count(items=foo) OVER (ORDER BY foo ROWS BETWEEN 1 PRECEDING AND 1 FOLLOWING) AS Count, " +
+			"enumerate(items=foo) OVER (ORDER BY foo ROWS 1 PRECEDING) AS Pairs " +
+			"FROM groupbytest() WHERE foo > 1 ORDER BY foo DESC"},
+	{"Window function without OVER",
+		"SELECT lag(foo) AS Prev FROM groupbytest() LIMIT 1"},
+	{"DISTINCT keeps bools and numbers apart",
+		"SELECT DISTINCT if(condition=value > 1, then=value - 1, else=value = 1) AS x " +
+			"FROM range(start=0, end=3)"},
+	{"Set flags for JOIN",
+		"LET flags = SELECT value = 1 AS flag FROM range(start=0, end=2)"},
+	{"JOIN on keys of different kinds",
+		"SELECT numbers.value, flags.flag FROM numbers JOIN flags " +
+			"ON numbers.value = flags.flag"},
+	{"Set times",
+		"LET times = SELECT bar, timestamp(epoch=1600000000 + " +
+			"if(condition=bar > 0, then=60, else=0)) AS t FROM test()"},
+	{"DISTINCT on times", "SELECT DISTINCT t FROM times"},
+	{"GROUP BY times", "SELECT t, count(items=bar) AS c FROM times GROUP BY t"},
+	{"JOIN times on times",
+		"SELECT a.bar, b.bar FROM times AS a JOIN times AS b ON a.t = b.t"},
+	{"JOIN times on epochs",
+		"SELECT a.foo, b.t FROM test() AS a JOIN times AS b ON a.bar * 60 + 1600000000 = b.t"},
+	{"Aggregates over no rows",
+		"SELECT count(items=foo) AS c, sum(items=foo) AS s, min(items=foo) AS m, " +
+			"enumerate(items=foo) AS e, count(items=foo) + 1 AS c1, bar " +
+			"FROM test() WHERE foo > 100"},
+	{"Aggregates over no rows with GROUP BY",
+		"SELECT count(items=foo) AS c FROM test() WHERE foo > 100 GROUP BY bar"},
+	{"Set keyword names",
+		"LET `Offset` = SELECT foo AS `Distinct`, dict(`On`=bar) AS `Case` FROM test()"},
+	{"Quoted keyword names",
+		"SELECT `Distinct`, `Case`.`On` AS `Limit` FROM `Offset` AS `Asc` " +
+			"WHERE `Distinct` > 0 ORDER BY `Distinct`"},
+	{"ORDER BY a JOIN member",
+		"SELECT * FROM test() AS a JOIN numbers AS b ON a.foo < b.value ORDER BY b.value DESC, a.foo"},
+	{"ORDER BY a JOIN member with WHERE",
+		"SELECT a.foo AS Foo FROM test() AS a JOIN numbers AS b ON a.foo < b.value WHERE b.value > 1 ORDER BY b.value DESC, Foo"},
 }
 
 type _RangeArgs struct {
@@ -629,7 +939,7 @@ func TestVQLSerializaition(t *testing.T) {
 				vql_string, err, test.vql)
 		}
 
-		if !reflect.DeepEqual(parsed_vql, vql) {
+		if !reflect.DeepEqual(clearPositions(parsed_vql), clearPositions(vql)) {
 			Debug(vql)
 			t.Fatalf("Parsed generated VQL not equivalent: %v vs %v.",
 				test.vql, vql_string)
@@ -637,6 +947,51 @@ func TestVQLSerializaition(t *testing.T) {
 	}
 }
 
+// Keywords added to the language break queries which used them as
+// plain names. They may be used as arg names, column aliases and
+// after "." as before, and elsewhere when quoted.
+func TestReservedWordCompatibility(t *testing.T) {
+	for _, keyword := range []string{"Distinct", "Like", "Between", "Asc",
+		"Offset", "Case", "On", "In", "Desc"} {
+		_, err := Parse("SELECT x, " + keyword + " FROM scope()")
+		assert.Error(t, err, keyword)
+
+		scope := makeTestScope().AppendVars(
+			ordereddict.NewDict().Set(keyword, ordereddict.NewDict().Set(keyword, 1)))
+		query := fmt.Sprintf("SELECT `%v`.%v, dict(%v=2).%v AS %v FROM scope()",
+			keyword, keyword, keyword, keyword, keyword)
+		vql, err := Parse(query)
+		if !assert.NoError(t, err, keyword) {
+			continue
+		}
+
+		// Names are only quoted where they have to be when
+		// serialized.
+		assert.Equal(t, query, vql.ToString(scope))
+
+		// A quoted column is named without the quotes.
+		assert.Equal(t, &[]string{fmt.Sprintf("`%v`.%v", keyword, keyword),
+			keyword}, vql.Columns(scope))
+
+		for row := range vql.Eval(context.Background(), scope) {
+			value, _ := scope.Associative(row, fmt.Sprintf("`%v`.%v", keyword, keyword))
+			assert.Equal(t, 1, value, keyword)
+
+			value, _ = scope.Associative(row, keyword)
+			assert.Equal(t, int64(2), value, keyword)
+		}
+
+		vql, err = Parse(fmt.Sprintf("SELECT `%v` FROM scope()", keyword))
+		assert.NoError(t, err, keyword)
+		assert.Equal(t, &[]string{keyword}, vql.Columns(scope))
+	}
+
+	// Names which are not keywords are not quoted.
+	vql, err := Parse("SELECT `Join`, `When`.`End` FROM scope()")
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT Join, When.End FROM scope()", vql.ToString(makeTestScope()))
+}
+
 var columnTests = []vqlTest{
 	{"Columns from env", "select Field from TestDict"},
 	{"Columns from env wildcard", "select * from TestDict"},
@@ -662,3 +1017,1321 @@ func TestColumns(t *testing.T) {
 	result_json, _ := json.MarshalIndent(result, "", " ")
 	goldie.Assert(t, "columns", result_json)
 }
+
+func TestMultiVQL(t *testing.T) {
+	scope := makeTestScope()
+
+	statements, err := ParseMultiVQL(`
+LET X = SELECT * FROM test() WHERE foo > 0;
+SELECT foo FROM X
+
+-- Statements do not need to be separated by ;
+SELECT bar FROM X LIMIT 1
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(statements))
+	assert.Equal(t, 2, statements[0].Pos.Line)
+	assert.Equal(t, 3, statements[1].Pos.Line)
+	assert.Equal(t, 6, statements[2].Pos.Line)
+
+	ctx := context.Background()
+	var result []Any
+	for row := range ScriptEval(ctx, scope, statements) {
+		result = append(result, []Any{row.Statement, row.Row})
+	}
+
+	result_json, _ := json.Marshal(result)
+	assert.Equal(t, `[[1,{"foo":2}],[1,{"foo":4}],[2,{"bar":1}]]`,
+		string(result_json))
+
+	// Parse errors are reported.
+	_, err = ParseMultiVQL("SELECT * FROM test(); SELECT FROM")
+	assert.Error(t, err)
+}
+
+func TestQueryErrors(t *testing.T) {
+	run_query := func(query string, strict bool) []*QueryError {
+		scope := makeTestScope()
+		vql, err := Parse(query)
+		assert.NoError(t, err)
+
+		collector := NewErrorCollector(strict)
+		for range vql.EvalWithErrors(context.Background(), scope, collector) {
+		}
+		return collector.Errors()
+	}
+
+	// Queries which do not fail produce no errors.
+	assert.Equal(t, 0, len(run_query("SELECT * FROM test()", false)))
+
+	errors := run_query("SELECT * FROM no_such_plugin()", false)
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, UnknownPluginError, errors[0].Type)
+	assert.Equal(t, "no_such_plugin()", errors[0].Node)
+	assert.Equal(t, 15, errors[0].Pos.Column)
+
+	errors = run_query("SELECT no_such_func(x=1) FROM scope()", false)
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, UnknownFunctionError, errors[0].Type)
+
+	// Argument errors are attributed to the call site.
+	errors = run_query("SELECT split(string='a') FROM scope()", false)
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, ArgumentError, errors[0].Type)
+	assert.Equal(t, "split(string='a')", errors[0].Node)
+
+	errors = run_query("SELECT * FROM foreach(row=1, query=2)", false)
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, TypeError, errors[0].Type)
+
+	// Argument errors are only collected once.
+	errors = run_query("SELECT count(itemz=1) FROM scope()", false)
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, ArgumentError, errors[0].Type)
+	assert.Equal(t, "count(itemz=1)", errors[0].Node)
+
+	errors = run_query("SELECT percentile(items=1, p=200) FROM scope()", false)
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, ArgumentError, errors[0].Type)
+
+	errors = run_query("SELECT timestamp(epoch='yesterday') FROM scope()", false)
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, TypeError, errors[0].Type)
+
+	// In strict mode the first error cancels the query.
+	errors = run_query("SELECT no_such_column FROM range(start=1, end=100)", true)
+	assert.True(t, len(errors) >= 1)
+	assert.True(t, len(errors) < 100)
+	assert.Equal(t, UnknownSymbolError, errors[0].Type)
+}
+
+// EvalWithErrors does not install the collector in the caller's scope
+// and releases the contexts it tracks.
+func TestEvalWithErrorsScope(t *testing.T) {
+	scope := makeTestScope()
+	collector := NewErrorCollector(true)
+
+	statements, err := ParseMultiVQL(
+		"LET X = SELECT no_such_func(x=1) FROM scope() SELECT * FROM X")
+	assert.NoError(t, err)
+
+	for _, statement := range statements {
+		for range statement.VQL.EvalWithErrors(context.Background(), scope, collector) {
+		}
+	}
+	assert.Equal(t, 1, len(collector.Errors()))
+
+	// The variable defined by LET is visible in the caller's scope.
+	_, pres := scope.Resolve("X")
+	assert.True(t, pres)
+
+	scope.Lock()
+	assert.Nil(t, scope.errors)
+	scope.Unlock()
+
+	collector.mu.Lock()
+	assert.Equal(t, 0, len(collector.cancels))
+	collector.mu.Unlock()
+}
+
+// Window functions are only allowed where they can be evaluated.
+func TestWindowErrors(t *testing.T) {
+	_, err := Parse("SELECT foo FROM test() WHERE row_number() OVER (ORDER BY foo) > 1")
+	assert.Error(t, err)
+
+	_, err = Parse("SELECT bar, row_number() OVER (ORDER BY bar) AS R, " +
+		"count(items=foo) FROM groupbytest() GROUP BY bar")
+	assert.Error(t, err)
+
+	// Subqueries are checked too.
+	_, err = Parse("SELECT { SELECT foo FROM test() " +
+		"WHERE rank() OVER (ORDER BY foo) > 1 } FROM scope()")
+	assert.Error(t, err)
+
+	run_query := func(query string) []*QueryError {
+		collector := NewErrorCollector(false)
+		scope := makeTestScope().SetErrorCollector(collector)
+		vql, err := Parse(query)
+		assert.NoError(t, err)
+
+		for _ = range vql.Eval(context.Background(), scope) {
+		}
+		return collector.Errors()
+	}
+
+	errors := run_query("SELECT row_number() OVER (ORDER BY foo) AS R, " +
+		"count(items=foo) AS C FROM test()")
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, InvalidQueryError, errors[0].Type)
+
+	errors = run_query("SELECT lag(foo, 'x') OVER (ORDER BY foo) AS L FROM test()")
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, ArgumentError, errors[0].Type)
+}
+
+// The args of lag() and lead() may be named.
+func TestLagNamedArgs(t *testing.T) {
+	scope := makeTestScope()
+	vql, err := Parse("SELECT foo, lag(items=foo, offset=2, default='none') " +
+		"OVER (ORDER BY foo) AS Prev, lead(foo, 2, 'none') OVER (ORDER BY foo) AS Next " +
+		"FROM groupbytest()")
+	assert.NoError(t, err)
+
+	var prev, next []Any
+	for row := range vql.Eval(context.Background(), scope) {
+		value, _ := scope.Associative(row, "Prev")
+		prev = append(prev, value)
+		value, _ = scope.Associative(row, "Next")
+		next = append(next, value)
+	}
+
+	assert.Equal(t, []Any{"none", "none", 1, 2}, prev)
+	assert.Equal(t, []Any{3, 4, "none", "none"}, next)
+}
+
+// Runaway recursion in user defined functions and queries is
+// reported instead of exhausting the stack.
+func TestRecursionLimit(t *testing.T) {
+	for _, query := range []string{
+		"LET f(x) = f(x=x) SELECT f(x=1) AS X FROM scope()",
+		"LET q(x) = SELECT * FROM q(x=x) SELECT * FROM q(x=1)",
+	} {
+		collector := NewErrorCollector(false)
+		scope := makeTestScope().SetErrorCollector(collector)
+
+		statements, err := ParseMultiVQL(query)
+		assert.NoError(t, err)
+
+		for _ = range ScriptEval(context.Background(), scope, statements) {
+		}
+
+		errors := collector.Errors()
+		assert.Equal(t, 1, len(errors), query)
+		assert.Equal(t, RecursionError, errors[0].Type, query)
+	}
+}
+
+func TestHash(t *testing.T) {
+	scope := makeScope()
+
+	// Values which are equal have the same hash.
+	assert.Equal(t, scope.Hash(1), scope.Hash(1.0))
+	assert.Equal(t, scope.Hash([]Any{1, "a"}), scope.Hash([]Any{int64(1), "a"}))
+	assert.Equal(t, scope.Hash(map[string]int{"a": 1, "b": 2}),
+		scope.Hash(map[string]int{"b": 2, "a": 1}))
+	assert.Equal(t, scope.Hash(ordereddict.NewDict().Set("a", []Any{1})),
+		scope.Hash(ordereddict.NewDict().Set("a", []Any{1.0})))
+	assert.Equal(t, scope.Hash(Null{}), scope.Hash(nil))
+
+	// Values which are not equal have different hashes.
+	assert.NotEqual(t, scope.Hash(1), scope.Hash("1"))
+	assert.NotEqual(t, scope.Hash([]Any{1, 2}), scope.Hash([]Any{2, 1}))
+	assert.NotEqual(t, scope.Hash([]Any{"a,b"}), scope.Hash([]Any{"a", "b"}))
+
+	// Structs without exported fields are hashed by their
+	// unexported fields.
+	assert.NotEqual(t, scope.Hash(big.NewInt(1)), scope.Hash(big.NewInt(2)))
+	assert.Equal(t, scope.Hash(big.NewInt(1)), scope.Hash(big.NewInt(1)))
+}
+
+// Spilling to disk must not change the results.
+func TestSpillToDisk(t *testing.T) {
+	queries := []string{
+		"SELECT * FROM range(start=0, end=100) ORDER BY value DESC",
+		"SELECT value FROM range(start=0, end=100) ORDER BY value > 50, value DESC LIMIT 20",
+		"SELECT value, count(items=value) AS Count FROM range(start=0, end=100) GROUP BY value",
+		"SELECT value > 30 AS Big, count(items=value) AS Count, enumerate(items=value) AS Values " +
+			"FROM range(start=0, end=100) GROUP BY value > 30, value > 60",
+		"SELECT value, count(items=value) AS Count FROM range(start=0, end=100) " +
+			"GROUP BY value > 80, value ORDER BY Count DESC, value LIMIT 30",
+		"SELECT bar, count(items=foo) AS Count, enumerate(items=baz) AS Baz " +
+			"FROM groupbytest() GROUP BY bar ORDER BY Count DESC",
+		"SELECT DISTINCT value > 50 AS Big FROM range(start=0, end=100) ORDER BY Big",
+		"SELECT value, NULL AS X FROM range(start=0, end=2) ORDER BY value",
+		"SELECT value, NULL AS X FROM range(start=0, end=2) GROUP BY value",
+		"SELECT value, row_number() OVER (PARTITION BY value % 3 ORDER BY value DESC) AS R, " +
+			"sum(items=value) OVER (ORDER BY value) AS S, lag(value) OVER (ORDER BY value) AS L " +
+			"FROM range(start=0, end=100)",
+		"SELECT a.bar, count(items=b.foo) AS Count FROM groupbytest() AS a " +
+			"JOIN groupbytest() AS b ON a.foo = b.foo GROUP BY a.bar",
+		"SELECT a.bar, count(items=b.value) AS Count FROM groupbytest() AS a " +
+			"LEFT JOIN range(start=0, end=3) AS b ON a.foo = b.value GROUP BY a.bar",
+		"SELECT a.foo, row_number() OVER (PARTITION BY b.bar ORDER BY a.foo) AS R " +
+			"FROM groupbytest() AS a JOIN groupbytest() AS b ON a.foo = b.foo",
+		"SELECT a.foo, b.value, lag(a.foo) OVER (ORDER BY a.foo DESC) AS L " +
+			"FROM groupbytest() AS a LEFT JOIN range(start=0, end=3) AS b ON a.foo = b.value",
+		"SELECT * FROM groupbytest() AS a JOIN range(start=0, end=3) AS b " +
+			"ON a.foo > b.value ORDER BY b.value DESC, a.foo",
+		"SELECT a.bar, count(items=a.foo) AS Count FROM groupbytest() AS a " +
+			"JOIN range(start=0, end=3) AS b ON a.foo > b.value GROUP BY a.bar ORDER BY b.value",
+	}
+
+	spill_dir, err := ioutil.TempDir("", "vfilter_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spill_dir)
+
+	for _, query := range queries {
+		vql, err := Parse(query)
+		assert.NoError(t, err)
+
+		ctx := context.Background()
+		expected, err := OutputJSON(vql, ctx, makeTestScope())
+		assert.NoError(t, err)
+
+		// A tiny budget spills every row.
+		scope := makeTestScope().SetMemoryBudget(1).
+			SetSpillDirectory(spill_dir)
+		actual, err := OutputJSON(vql, ctx, scope)
+		assert.NoError(t, err)
+
+		assert.Equal(t, string(expected), string(actual), query)
+
+		// All spill files are removed.
+		files, err := ioutil.ReadDir(spill_dir)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(files), query)
+	}
+}
+
+// Rows are kept in memory when they can not be spilled.
+func TestSpillFailure(t *testing.T) {
+	spill_dir, err := ioutil.TempDir("", "vfilter_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spill_dir)
+
+	scope := makeTestScope().SetSpillDirectory(spill_dir)
+	compare := func(a []Any, b []Any) int {
+		return compareKeys(scope, a, b)
+	}
+	ctx := context.Background()
+
+	// A failed write keeps the items and removes the partial run.
+	sorter := newExternalSorter(scope, compare)
+	for i := 0; i < 10; i++ {
+		sorter.Add(ctx, int64(i), []Any{int64(-i)}, ordereddict.NewDict().Set("i", i))
+	}
+
+	run, err := newSpillFile(scope)
+	assert.NoError(t, err)
+	run.fd.Close()
+
+	assert.Error(t, sorter.writeRun(run))
+	assert.Equal(t, 10, len(sorter.items))
+	assert.Equal(t, 0, len(sorter.runs))
+
+	files, err := ioutil.ReadDir(spill_dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(files))
+
+	// When no spill file can be created all the rows are still
+	// returned.
+	vql, err := Parse("SELECT * FROM range(start=0, end=100) ORDER BY value DESC")
+	assert.NoError(t, err)
+
+	expected, err := OutputJSON(vql, ctx, makeTestScope())
+	assert.NoError(t, err)
+
+	actual, err := OutputJSON(vql, ctx, makeTestScope().SetMemoryBudget(1).
+		SetSpillDirectory(filepath.Join(spill_dir, "missing")))
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+}
+
+type _SpillStruct struct {
+	Name   string
+	hidden int
+}
+
+// Spilled values are read back as the same Go types.
+func TestSpillToDiskTypes(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.FixedZone("X", 3600))
+	plugin := GenericListPlugin{
+		PluginName: "values",
+		Function: func(scope *Scope, args *ordereddict.Dict) []Row {
+			var result []Row
+			for i := 0; i < 10; i++ {
+				result = append(result, ordereddict.NewDict().
+					Set("Idx", i).
+					Set("Null", Null{}).
+					Set("Nil", nil).
+					Set("Time", now.Add(time.Duration(i)*time.Hour)).
+					Set("UTC", now.Add(time.Duration(i)*time.Hour).UTC()).
+					Set("Duration", time.Duration(i)*time.Second).
+					Set("Big", uint64(1<<63)+uint64(i)).
+					Set("Float", float64(i)/3).
+					Set("Nested", ordereddict.NewDict().
+						Set("A", []Any{int64(i), "x", Null{}}).
+						Set("B", ordereddict.NewDict().Set("C", true))).
+					Set("Strings", []string{"a", "b"}).
+					Set("Struct", _SpillStruct{Name: "s", hidden: i}))
+			}
+			return result
+		},
+	}
+
+	queries := []string{
+		"SELECT * FROM values() ORDER BY Idx DESC",
+		"SELECT Idx, Null, Nil, Time, UTC, Duration, Big, Float, Nested, Strings, " +
+			"Struct FROM values() GROUP BY Idx",
+		"SELECT * FROM values() ORDER BY UTC DESC, Big",
+	}
+
+	spill_dir, err := ioutil.TempDir("", "vfilter_test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(spill_dir)
+
+	collect := func(vql *VQL, scope *Scope) []Row {
+		var result []Row
+		for row := range vql.Eval(context.Background(), scope) {
+			result = append(result, row)
+		}
+		return result
+	}
+
+	for _, query := range queries {
+		vql, err := Parse(query)
+		assert.NoError(t, err)
+
+		expected := collect(vql, makeScope().AppendPlugins(plugin))
+		actual := collect(vql, makeScope().AppendPlugins(plugin).
+			SetMemoryBudget(1).SetSpillDirectory(spill_dir))
+
+		assert.Equal(t, 10, len(actual), query)
+		assert.Equal(t, expected, actual, query)
+	}
+}
+
+// Produces rows until the query is cancelled.
+type _EndlessPlugin struct{}
+
+func (self _EndlessPlugin) Call(
+	ctx context.Context,
+	scope *Scope,
+	args *ordereddict.Dict) <-chan Row {
+	output_chan := make(chan Row)
+
+	go func() {
+		defer close(output_chan)
+
+		for i := 0; ; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- ordereddict.NewDict().Set("value", i):
+			}
+		}
+	}()
+
+	return output_chan
+}
+
+func (self _EndlessPlugin) Info(scope *Scope, type_map *TypeMap) *PluginInfo {
+	return &PluginInfo{
+		Name: "endless",
+	}
+}
+
+func TestPaginatedQuery(t *testing.T) {
+	scope := makeTestScope()
+	vql, err := Parse("SELECT * FROM range(start=0, end=9)")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	pager := NewPaginatedQuery(vql, ctx, scope, 3, 10)
+
+	var parts []*VFilterJsonResult
+	for part := range pager.GetResponseChannel(ctx, 0) {
+		parts = append(parts, part)
+	}
+
+	// Each part holds at most maxrows+1 rows.
+	assert.Equal(t, 3, len(parts))
+	total := 0
+	for idx, part := range parts {
+		assert.Equal(t, idx, part.Part)
+		total += part.TotalRows
+	}
+	assert.Equal(t, 10, total)
+
+	// Resuming returns the same parts without running the query
+	// again.
+	var resumed []*VFilterJsonResult
+	for part := range pager.GetResponseChannel(ctx, 1) {
+		resumed = append(resumed, part)
+	}
+	assert.Equal(t, parts[1:], resumed)
+
+	part, err := pager.GetPart(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, parts[0], part)
+
+	_, err = pager.GetPart(ctx, 5)
+	assert.Equal(t, ErrNoSuchPart, err)
+
+	// Closing releases the parts.
+	pager.Close()
+	_, err = pager.GetPart(ctx, 0)
+	assert.Equal(t, ErrPartExpired, err)
+
+	// Only the last part is retained.
+	pager = NewPaginatedQuery(vql, ctx, scope, 3, 10).SetMaxParts(1)
+	defer pager.Close()
+
+	part, err = pager.GetPart(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, part.Part)
+	assert.Equal(t, 2, pager.FirstPart())
+
+	_, err = pager.GetPart(ctx, 1)
+	assert.Equal(t, ErrPartExpired, err)
+
+	// A reader which fell behind skips to the retained part.
+	resumed = nil
+	for part := range pager.GetResponseChannel(ctx, 0) {
+		resumed = append(resumed, part)
+	}
+	assert.Equal(t, 1, len(resumed))
+	assert.Equal(t, 2, resumed[0].Part)
+
+	// Closing stops a query which would otherwise run for a long
+	// time and wakes up waiting readers.
+	vql, err = Parse("SELECT * FROM endless()")
+	assert.NoError(t, err)
+
+	pager = NewPaginatedQuery(
+		vql, ctx, scope.AppendPlugins(_EndlessPlugin{}), 3, 10)
+	_, err = pager.GetPart(ctx, 0)
+	assert.NoError(t, err)
+
+	waiting := pager.GetResponseChannel(ctx, 1000000000)
+	pager.Close()
+	for _ = range waiting {
+		t.Fatalf("Part received after Close()")
+	}
+}
+
+// Only the selected branch of a CASE is evaluated.
+func TestCaseWhenIsLazy(t *testing.T) {
+	scope := makeTestScope()
+	vql, err := Parse("SELECT CASE WHEN foo = 2 THEN counter() " +
+		"WHEN counter() > 0 THEN 1 ELSE counter() END FROM test()")
+	assert.NoError(t, err)
+
+	start := CounterFunctionCount
+	_, err = OutputJSON(vql, context.Background(), scope)
+	assert.NoError(t, err)
+
+	// The second WHEN condition is evaluated for foo=0 and foo=4
+	// and the THEN branch for foo=2. The ELSE is never reached.
+	assert.Equal(t, 3, CounterFunctionCount-start)
+}
+
+// A type which reports itself as NULL and matches LIKE patterns
+// against its name.
+type _NamedMissing struct {
+	Name string
+}
+
+type _NamedMissingProtocol struct{}
+
+func (self _NamedMissingProtocol) Applicable(a Any) bool {
+	_, ok := a.(_NamedMissing)
+	return ok
+}
+
+func (self _NamedMissingProtocol) IsNull(scope *Scope, a Any) bool {
+	return true
+}
+
+type _NamedMissingLike struct{}
+
+func (self _NamedMissingLike) Applicable(pattern Any, target Any) bool {
+	_, ok := target.(_NamedMissing)
+	return ok
+}
+
+func (self _NamedMissingLike) Like(scope *Scope, pattern Any, target Any) bool {
+	return scope.Like(pattern, target.(_NamedMissing).Name)
+}
+
+// Custom types may implement slicing.
+type _Reversed struct {
+	items []int
+}
+
+type _ReversedSlice struct{}
+
+func (self _ReversedSlice) Applicable(a Any) bool {
+	_, ok := a.(_Reversed)
+	return ok
+}
+
+func (self _ReversedSlice) Slice(scope *Scope, a Any, start Any, end Any) Any {
+	items := a.(_Reversed).items
+	start_idx, end_idx, _ := sliceBounds(len(items), start, end)
+
+	var result []Any
+	for i := end_idx - 1; i >= start_idx; i-- {
+		result = append(result, items[i])
+	}
+	return result
+}
+
+func TestSubscripts(t *testing.T) {
+	scope := makeTestScope().AppendVars(ordereddict.NewDict().
+		Set("Data", ordereddict.NewDict().
+			Set("key with spaces", []Any{"a", "b", "c"})).
+		Set("Reversed", _Reversed{items: []int{1, 2, 3, 4}}))
+	scope.AddProtocolImpl(_ReversedSlice{})
+
+	vql, err := Parse("SELECT Data['key with spaces'][-1] AS A, " +
+		"Data[\"key with spaces\"][1:] AS B, Reversed[1:3] AS C FROM scope()")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	count := 0
+	for row := range vql.Eval(ctx, scope) {
+		assert.Equal(t, ordereddict.NewDict().
+			Set("A", "c").
+			Set("B", []Any{"b", "c"}).
+			Set("C", []Any{3, 2}),
+			RowToDict(scope, row))
+		count++
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestNullAndLikeProtocols(t *testing.T) {
+	scope := makeTestScope().AppendVars(ordereddict.NewDict().
+		Set("Missing", _NamedMissing{Name: "SomeValue"}))
+	scope.AddProtocolImpl(_NamedMissingProtocol{}, _NamedMissingLike{})
+
+	vql, err := Parse("SELECT Missing IS NULL AS A, Missing IS NOT NULL AS B, " +
+		"Missing LIKE 'some%' AS C FROM scope()")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	count := 0
+	for row := range vql.Eval(ctx, scope) {
+		assert.Equal(t, ordereddict.NewDict().
+			Set("A", true).Set("B", false).Set("C", true),
+			RowToDict(scope, row))
+		count++
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestPositionalArgs(t *testing.T) {
+	type ordered struct {
+		Name  string `vfilter:"required,field=name"`
+		Count int64  `vfilter:"optional,field=count"`
+	}
+
+	type explicit struct {
+		Name  string `vfilter:"optional,field=name,pos=1"`
+		Count int64  `vfilter:"optional,field=count,pos=0"`
+		Other string `vfilter:"optional,field=other"`
+	}
+
+	type variadic struct {
+		Sep   string `vfilter:"required,field=sep"`
+		Items []Any  `vfilter:"optional,field=items,rest"`
+	}
+
+	scope := NewScope()
+
+	args := ordereddict.NewDict().Set("$0", "a").Set("$1", 2)
+	result := &ordered{}
+	assert.NoError(t, ExtractArgs(scope, args, result))
+	assert.Equal(t, &ordered{Name: "a", Count: 2}, result)
+
+	// Positional args may be mixed with named args.
+	args = ordereddict.NewDict().Set("$0", "a").Set("count", 3)
+	result = &ordered{}
+	assert.NoError(t, ExtractArgs(scope, args, result))
+	assert.Equal(t, &ordered{Name: "a", Count: 3}, result)
+
+	// But not for the same field.
+	args = ordereddict.NewDict().Set("$0", "a").Set("name", "b")
+	assert.Error(t, ExtractArgs(scope, args, &ordered{}))
+
+	// Too many positional args.
+	args = ordereddict.NewDict().Set("$0", "a").Set("$1", 2).Set("$2", 3)
+	assert.Error(t, ExtractArgs(scope, args, &ordered{}))
+
+	// pos tags override the declaration order and only tagged
+	// fields may be passed by position.
+	args = ordereddict.NewDict().Set("$0", 5).Set("$1", "x")
+	explicit_result := &explicit{}
+	assert.NoError(t, ExtractArgs(scope, args, explicit_result))
+	assert.Equal(t, &explicit{Name: "x", Count: 5}, explicit_result)
+
+	args = ordereddict.NewDict().Set("$0", 5).Set("$1", "x").Set("$2", "y")
+	assert.Error(t, ExtractArgs(scope, args, &explicit{}))
+
+	// A rest field collects the remaining positional args.
+	args = ordereddict.NewDict().Set("$0", ",").Set("$1", "a").Set("$2", 1)
+	variadic_result := &variadic{}
+	assert.NoError(t, ExtractArgs(scope, args, variadic_result))
+	assert.Equal(t, &variadic{Sep: ",", Items: []Any{"a", 1}}, variadic_result)
+
+	args = ordereddict.NewDict().Set("$0", ",").Set("$1", "a").
+		Set("items", []Any{"b"})
+	assert.Error(t, ExtractArgs(scope, args, &variadic{}))
+
+	// The mapping of each type is only parsed once.
+	assert.Equal(t, getPositionalFields(reflect.TypeOf(variadic{})),
+		getPositionalFields(reflect.TypeOf(variadic{})))
+	assert.Equal(t, "items", getPositionalFields(reflect.TypeOf(variadic{})).rest)
+
+	// Functions reading their args directly do not see positional
+	// keys as names.
+	collector := NewErrorCollector(false)
+	test_scope := makeTestScope().SetErrorCollector(collector)
+	vql, err := Parse("SELECT dict(1, x=2) AS D FROM scope()")
+	assert.NoError(t, err)
+	for row := range vql.Eval(context.Background(), test_scope) {
+		value, _ := test_scope.Associative(row, "D")
+		assert.Equal(t, Null{}, value)
+	}
+	assert.Equal(t, 1, len(collector.Errors()))
+
+	// Positional queries are chained in order.
+	chained := []Any{}
+	vql, err = Parse("SELECT * FROM chain(" +
+		"{SELECT 0 AS X FROM scope()}, {SELECT 1 AS X FROM scope()}, " +
+		"{SELECT 2 AS X FROM scope()}, {SELECT 3 AS X FROM scope()}, " +
+		"{SELECT 4 AS X FROM scope()}, {SELECT 5 AS X FROM scope()}, " +
+		"{SELECT 6 AS X FROM scope()}, {SELECT 7 AS X FROM scope()}, " +
+		"{SELECT 8 AS X FROM scope()}, {SELECT 9 AS X FROM scope()}, " +
+		"{SELECT 10 AS X FROM scope()})")
+	assert.NoError(t, err)
+	for row := range vql.Eval(context.Background(), makeTestScope()) {
+		value, _ := test_scope.Associative(row, "X")
+		chained = append(chained, value)
+	}
+	assert.Equal(t, []Any{int64(0), int64(1), int64(2), int64(3), int64(4),
+		int64(5), int64(6), int64(7), int64(8), int64(9), int64(10)}, chained)
+}
+
+var stringFunctionTests = []execTest{
+	{"format('%v-%03d', 'a', 5)", "a-005"},
+	{"format(format='%v', args='x')", "x"},
+	{"upper('Hello')", "HELLO"},
+	{"lower(string='Hello')", "hello"},
+	{"strip('  hi \\n')", "hi"},
+	{"strip('xxhixx', 'x')", "hi"},
+	{"substr('hello', 1, 3)", "el"},
+	{"substr('hello', -3)", "llo"},
+	{"substr('hello', end=2)", "he"},
+	{"replace('a.b.c', '.', '-')", "a-b-c"},
+	{"regex_replace('Foo123bar45', '[0-9]+', '#')", "Foo#bar#"},
+	{"regex_replace('john smith', '(\\\\w+) (\\\\w+)', '$2 $1')", "smith john"},
+	{"regex_extract('user=bob id=5', 'user=(?P<User>\\\\w+) id=(?P<Id>\\\\d+)')",
+		ordereddict.NewDict().Set("User", "bob").Set("Id", "5")},
+	{"regex_extract('ab12', '([a-z]+)([0-9]+)')", []string{"ab12", "ab", "12"}},
+	{"regex_extract('ab', '[0-9]+') IS NULL", true},
+	{"len('héllo')", 5},
+	{"len([1, 2, 3])", 3},
+	{"len({'a': 1})", 1},
+	{"len(NULL)", 0},
+	{"join([1, 'a', 2], ',')", "1,a,2"},
+	{"join(array=('a', 'b'))", "ab"},
+	{"startswith('hello', 'he')", true},
+	{"endswith('hello', 'he')", false},
+	{"pad('5', 3, '0')", "005"},
+	{"pad('ab', -4)", "ab  "},
+	{"pad('abcd', 2)", "abcd"},
+}
+
+func TestStringFunctions(t *testing.T) {
+	scope := makeScope().AppendFunctions(StringFunctions()...)
+	for _, test := range stringFunctionTests {
+		vql, err := Parse("select * from plugin() where " + test.clause)
+		if err != nil {
+			t.Fatalf("Failed to parse %v: %v", test.clause, err)
+		}
+
+		value := vql.Query.Where.Reduce(context.Background(), scope)
+		if !scope.Eq(value, test.result) {
+			t.Fatalf("%v: Expected %v, got %v", test.clause, test.result, value)
+		}
+	}
+}
+
+// Joins the items into a string, to test third party aggregators.
+type _JoinAggregator struct{}
+
+func (self _JoinAggregator) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{Name: "join_all"}
+}
+
+func (self _JoinAggregator) Init(scope *Scope) Any {
+	return ""
+}
+
+func (self _JoinAggregator) Accumulate(
+	ctx context.Context, scope *Scope, state Any, args *ordereddict.Dict) Any {
+	item, _ := args.Get("$0")
+	if lazy_arg, ok := item.(LazyExpr); ok {
+		item = lazy_arg.Reduce()
+	}
+	return self.Merge(scope, state, fmt.Sprintf("%v", item))
+}
+
+func (self _JoinAggregator) Result(scope *Scope, state Any) Any {
+	return state
+}
+
+func (self _JoinAggregator) Merge(scope *Scope, a Any, b Any) Any {
+	return a.(string) + b.(string)
+}
+
+func TestAggregators(t *testing.T) {
+	scope := makeTestScope().AppendAggregators(_JoinAggregator{})
+
+	// Each call site keeps its own state, even when calling the
+	// same aggregate or nested in a subquery.
+	vql, err := Parse(`SELECT join_all(foo) AS A, join_all(baz) AS B,
+           count(items=foo) AS C, count(items=1) AS D,
+           { SELECT join_all(value) AS Inner FROM range(start=1, end=3) } AS E
+        FROM groupbytest()`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	var rows []Row
+	for row := range vql.Eval(context.Background(), scope) {
+		rows = append(rows, RowToDict(scope, row))
+	}
+
+	assert.Equal(t, 1, len(rows))
+	expected := ordereddict.NewDict().
+		Set("A", "1234").Set("B", "abcd").
+		Set("C", uint64(4)).Set("D", uint64(4)).
+		Set("E", "123")
+	if !scope.Eq(rows[0], expected) {
+		t.Fatalf("Expected %v, got %v", expected, rows[0])
+	}
+}
+
+// An aggregate implemented directly as a function. Its state can not
+// be merged so queries calling it are always aggregated serially.
+type _LegacyCountFunction struct{}
+
+func (self _LegacyCountFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name:        "legacy_count",
+		IsAggregate: true,
+	}
+}
+
+func (self _LegacyCountFunction) Call(
+	ctx context.Context, scope *Scope, args *ordereddict.Dict) Any {
+	count, _ := scope.GetContext("legacy_count").(int64)
+	count++
+	scope.SetContext("legacy_count", count)
+	return count
+}
+
+func TestParallelAggregation(t *testing.T) {
+	defer func(size int) { aggregate_chunk_size = size }(aggregate_chunk_size)
+	aggregate_chunk_size = 7
+
+	queries := []string{
+		"SELECT value % 7 AS Bin, count(items=value) AS Count, sum(items=value) AS Sum, " +
+			"min(items=value) AS Min, max(items=value) AS Max, enumerate(items=value) AS All, " +
+			"first(items=value) AS First, last(items=value) AS Last, " +
+			"avg(items=value) AS Avg, stddev(items=value) AS Stddev, " +
+			"percentile(value, 90) AS P90, count_distinct(items=value % 3) AS Mod3, " +
+			"histogram(items=value, bucket=50) AS Hist " +
+			"FROM range(start=0, end=300) GROUP BY Bin",
+		"SELECT count(items=value) AS Count, enumerate(items=value) AS All " +
+			"FROM range(start=0, end=100) WHERE value > 10",
+		"SELECT value > 30 AS Big, value, count(items=value) AS Count " +
+			"FROM range(start=0, end=100) GROUP BY Big ORDER BY Count LIMIT 1",
+		"SELECT count(items=value) AS Count, sum(items=value) AS Sum " +
+			"FROM range(start=0, end=100) WHERE value > 1000",
+		"SELECT value % 7 AS Bin, legacy_count(items=value) AS Legacy, count(items=value) AS Count " +
+			"FROM range(start=0, end=300) GROUP BY Bin",
+	}
+
+	for _, query := range queries {
+		vql, err := Parse(query)
+		if err != nil {
+			t.Fatalf("Failed to parse %v: %v", query, err)
+		}
+
+		ctx := context.Background()
+		serial, err := OutputJSON(vql, ctx, makeTestScope().
+			AppendFunctions(_LegacyCountFunction{}))
+		assert.NoError(t, err)
+
+		parallel, err := OutputJSON(vql, ctx, makeTestScope().
+			AppendFunctions(_LegacyCountFunction{}).SetAggregateWorkers(4))
+		assert.NoError(t, err)
+
+		assert.Equal(t, string(serial), string(parallel), query)
+	}
+}
+
+func TestEncoders(t *testing.T) {
+	scope := makeTestScope()
+	vql, err := Parse(`SELECT foo, bar, "a,b|c" AS Str, dict(x=1) AS D FROM groupbytest() LIMIT 2`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	encode := func(format string) string {
+		buf := &bytes.Buffer{}
+		encoder, err := NewEncoder(format, buf)
+		assert.NoError(t, err)
+		assert.NoError(t, Encode(vql, context.Background(), scope, encoder))
+		return buf.String()
+	}
+
+	assert.Equal(t, "foo,bar,Str,D\n"+
+		"1,5,\"a,b|c\",\"{\"\"x\"\":1}\"\n"+
+		"2,5,\"a,b|c\",\"{\"\"x\"\":1}\"\n", encode("csv"))
+
+	assert.Equal(t, "foo\tbar\tStr\tD\n"+
+		"1\t5\ta,b|c\t\"{\"\"x\"\":1}\"\n"+
+		"2\t5\ta,b|c\t\"{\"\"x\"\":1}\"\n", encode("tsv"))
+
+	assert.Equal(t, `{"foo":1,"bar":5,"Str":"a,b|c","D":{"x":1}}`+"\n"+
+		`{"foo":2,"bar":5,"Str":"a,b|c","D":{"x":1}}`+"\n", encode("jsonl"))
+
+	assert.Equal(t, "| foo | bar | Str    | D       |\n"+
+		"| --- | --- | ------ | ------- |\n"+
+		"| 1   | 5   | a,b\\|c | {\"x\":1} |\n"+
+		"| 2   | 5   | a,b\\|c | {\"x\":1} |\n", encode("markdown"))
+
+	assert.Equal(t, "foo  bar  Str    D\n"+
+		"---  ---  -----  -------\n"+
+		"1    5    a,b|c  {\"x\":1}\n"+
+		"2    5    a,b|c  {\"x\":1}\n", encode("table"))
+
+	expected, err := OutputJSON(vql, context.Background(), scope)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), encode("json"))
+
+	_, err = NewEncoder("xml", &bytes.Buffer{})
+	assert.Error(t, err)
+
+	// Columns which only appear in later rows are kept.
+	vql, err = Parse("SELECT * FROM chain(a={SELECT 1 AS A FROM scope()}, " +
+		"b={SELECT 2 AS B FROM scope()})")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"A":1}`+"\n"+`{"B":2}`+"\n", encode("jsonl"))
+	assert.Equal(t, "A\n1\n\n", encode("csv"))
+}
+
+// Encoders may be registered while other queries are encoded.
+func TestRegisterEncoderConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			format := fmt.Sprintf("test_format_%d", i)
+			RegisterEncoder(format, NewJSONLEncoder)
+
+			_, err := NewEncoder(format, ioutil.Discard)
+			assert.NoError(t, err)
+			assert.Contains(t, EncoderFormats(), format)
+		}(i)
+	}
+	wg.Wait()
+}
+
+type _FailingWriter struct{}
+
+func (self _FailingWriter) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("Write failed")
+}
+
+// The query is stopped when the encoder fails.
+func TestEncodeWriteError(t *testing.T) {
+	scope := makeTestScope().AppendPlugins(_EndlessPlugin{})
+	vql, err := Parse("SELECT * FROM endless()")
+	assert.NoError(t, err)
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		encoder, _ := NewEncoder("jsonl", _FailingWriter{})
+		assert.Error(t, Encode(vql, context.Background(), scope, encoder))
+	}
+
+	// Wait for the query goroutines to exit.
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before,
+		"Leaked %v goroutines", runtime.NumGoroutine()-before)
+}
+
+type _Celsius float64
+
+type _CelsiusMarshaller struct{}
+
+func (self _CelsiusMarshaller) Applicable(a Any) bool {
+	_, ok := a.(_Celsius)
+	return ok
+}
+
+func (self _CelsiusMarshaller) Marshal(scope *Scope, a Any) Any {
+	return ordereddict.NewDict().
+		Set("Value", float64(a.(_Celsius))).
+		Set("Unit", "C").
+		Set("Taken", time.Unix(10, 0))
+}
+
+type _MarshalBase struct {
+	ID int
+}
+
+type _MarshalNode struct {
+	_MarshalBase
+	Name     string   `json:"name"`
+	Hidden   string   `json:"-"`
+	Optional string   `json:",omitempty"`
+	Temp     _Celsius `json:"temp"`
+	Next     *_MarshalNode
+	Children map[string]Any
+	private  int
+}
+
+func TestMarshalProtocol(t *testing.T) {
+	scope := makeTestScope()
+	scope.AddProtocolImpl(_CelsiusMarshaller{})
+
+	node := &_MarshalNode{
+		_MarshalBase: _MarshalBase{ID: 1},
+		Name:         "first",
+		Hidden:       "hidden",
+		Temp:         21.5,
+		Children:     map[string]Any{"b": []byte("bytes"), "a": Null{}},
+	}
+
+	// Cycles are replaced by nil but a value which appears twice
+	// is not a cycle.
+	node.Next = node
+	shared := []Any{1, 2}
+	node.Children["c"] = []Any{shared, shared}
+
+	serialized, err := json.Marshal(scope.Marshal(context.Background(), node))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"ID":1,"name":"first",`+
+		`"temp":{"Value":21.5,"Unit":"C","Taken":"1970-01-01T00:00:10Z"},`+
+		`"Next":null,"Children":{"a":null,"b":"bytes","c":[[1,2],[1,2]]}}`,
+		string(serialized))
+
+	// Deeply nested values are truncated.
+	var nested Any = "bottom"
+	for i := 0; i < 50; i++ {
+		nested = []Any{nested}
+	}
+	serialized, err = json.Marshal(scope.Marshal(context.Background(), nested))
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("[", 21)+"null"+strings.Repeat("]", 21),
+		string(serialized))
+
+	// Args hold LazyExpr values which are reduced.
+	expr, err := Parse("LET X = 1 + 2")
+	assert.NoError(t, err)
+
+	args := ordereddict.NewDict().
+		Set("a", LazyExpr{expr.Expression, context.Background(), scope}).
+		Set("b", &LazyExpr{expr.Expression, context.Background(), scope})
+	serialized, err = json.Marshal(scope.Marshal(context.Background(), args))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":3,"b":3}`, string(serialized))
+
+	// The protocol is used by the output encoders and RowToDict.
+	scope.AppendVars(ordereddict.NewDict().Set("Temp", _Celsius(-3)))
+	vql, err := Parse("SELECT Temp FROM scope()")
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	encoder, err := NewEncoder("jsonl", buf)
+	assert.NoError(t, err)
+	assert.NoError(t, Encode(vql, context.Background(), scope, encoder))
+	assert.Equal(t, `{"Temp":{"Value":-3,"Unit":"C","Taken":"1970-01-01T00:00:10Z"}}`+"\n",
+		buf.String())
+
+	for row := range vql.Eval(context.Background(), scope) {
+		temp, _ := RowToDict(scope, row).Get("Temp")
+		unit, _ := temp.(*ordereddict.Dict).Get("Unit")
+		assert.Equal(t, "C", unit)
+	}
+
+	// Map keys are formatted like json.Marshal does.
+	serialized, err = json.Marshal(scope.Marshal(context.Background(),
+		map[int]string{1: "a", 2: "b", 3: "c"}))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"1":"a","2":"b","3":"c"}`, string(serialized))
+
+	serialized, err = json.Marshal(scope.Marshal(context.Background(),
+		map[time.Time]float64{time.Unix(10, 0).UTC(): 1.5}))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"1970-01-01T00:00:10Z":1.5}`, string(serialized))
+
+	var missing_time *time.Time
+	assert.Nil(t, scope.Marshal(context.Background(), missing_time))
+}
+
+func TestParsePlugins(t *testing.T) {
+	ctx := context.Background()
+	scope := makeTestScope()
+
+	// Save the results of a query and query them again.
+	vql, err := Parse("SELECT foo, bar, baz, dict(x=foo) AS D FROM groupbytest()")
+	assert.NoError(t, err)
+
+	saved, err := OutputJSON(vql, ctx, scope)
+	assert.NoError(t, err)
+
+	saved_jsonl := &bytes.Buffer{}
+	encoder, _ := NewEncoder("jsonl", saved_jsonl)
+	assert.NoError(t, Encode(vql, ctx, scope, encoder))
+
+	saved_csv := &bytes.Buffer{}
+	encoder, _ = NewEncoder("csv", saved_csv)
+	assert.NoError(t, Encode(vql, ctx, scope, encoder))
+
+	scope.AppendVars(ordereddict.NewDict().
+		Set("JSON", string(saved)).
+		Set("JSONL", saved_jsonl).
+		Set("CSV", saved_csv.String()).
+		Set("Object", `{"b": 1, "a": [1, 2]}`).
+		Set("TSV", "a\tb\n007\t1.5\n1.50\t-2\nshort\n"))
+
+	for _, query := range []string{
+		"parse_json(data=JSON)",
+		"parse_jsonl(data=JSONL)",
+		"parse_csv(data=CSV)",
+	} {
+		vql, err := Parse("SELECT bar, sum(items=foo) AS Total, " +
+			"enumerate(items=baz) AS Bazs FROM " + query + " GROUP BY bar ORDER BY bar")
+		assert.NoError(t, err)
+
+		result, err := OutputJSON(vql, ctx, scope)
+		assert.NoError(t, err)
+		assert.Equal(t, `[
+ {
+  "bar": 2,
+  "Total": 7,
+  "Bazs": [
+   "c",
+   "d"
+  ]
+ },
+ {
+  "bar": 5,
+  "Total": 3,
+  "Bazs": [
+   "a",
+   "b"
+  ]
+ }
+]`, string(result), query)
+	}
+
+	// Columns keep their order and nested objects are dicts.
+	vql, err = Parse("SELECT * FROM parse_json(data=JSON) LIMIT 1")
+	assert.NoError(t, err)
+	for row := range vql.Eval(ctx, scope) {
+		assert.Equal(t, []string{"foo", "bar", "baz", "D"}, scope.GetMembers(row))
+		d, _ := scope.Associative(row, "D")
+		x, _ := scope.Associative(d, "x")
+		assert.Equal(t, int64(1), x)
+	}
+
+	for query, expected := range map[string]string{
+		"SELECT * FROM parse_json(data=Object)": `[{"b":1,"a":[1,2]}]`,
+		"SELECT * FROM parse_csv(data=TSV, separator='\t')": `[` +
+			`{"a":"007","b":1.5},{"a":"1.50","b":-2},{"a":"short"}]`,
+		"SELECT * FROM parse_jsonl(data='{\"a\": 1}\n\nnot json\n{\"a\": 2}')": `[` +
+			`{"a":1},{"a":2}]`,
+	} {
+		vql, err := Parse(query)
+		assert.NoError(t, err)
+
+		var rows []Row
+		for row := range vql.Eval(ctx, scope) {
+			rows = append(rows, row)
+		}
+		serialized, _ := json.Marshal(rows)
+		assert.Equal(t, expected, string(serialized), query)
+	}
+
+	// Non finite numbers remain strings.
+	vql, err = Parse("SELECT * FROM parse_csv(data='Name,Value\nNaN,+Inf\n-Inf,1')")
+	assert.NoError(t, err)
+	var rows []Row
+	for row := range vql.Eval(ctx, scope) {
+		rows = append(rows, row)
+	}
+	serialized, _ := json.Marshal(rows)
+	assert.Equal(t, `[{"Name":"NaN","Value":"+Inf"},{"Name":"-Inf","Value":1}]`,
+		string(serialized))
+
+	run_query := func(query string) []*QueryError {
+		collector := NewErrorCollector(false)
+		scope := makeTestScope().SetErrorCollector(collector)
+		vql, err := Parse(query)
+		assert.NoError(t, err)
+
+		for _ = range vql.Eval(ctx, scope) {
+		}
+		return collector.Errors()
+	}
+
+	// A truncated array is an error.
+	assert.Equal(t, 0, len(run_query(`SELECT * FROM parse_json(data='[{"a":1}] ')`)))
+	errors := run_query(`SELECT * FROM parse_json(data='[{"a":1},{"a":2}')`)
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, TypeError, errors[0].Type)
+
+	// Bad args are reported.
+	errors = run_query("SELECT * FROM parse_csv()")
+	assert.Equal(t, 1, len(errors))
+	assert.Equal(t, ArgumentError, errors[0].Type)
+}
+
+type _HashedStruct struct {
+	Name  string
+	calls *int
+}
+
+func (self _HashedStruct) Expensive() string {
+	*self.calls++
+	return self.Name
+}
+
+func TestHashStructs(t *testing.T) {
+	scope := NewScope()
+	calls := 0
+
+	// Structs are hashed by their exported fields without calling
+	// any methods.
+	a := scope.Hash(_HashedStruct{Name: "a", calls: &calls})
+	b := scope.Hash(&_HashedStruct{Name: "b", calls: &calls})
+	assert.NotEqual(t, a, b)
+	assert.Equal(t, a, scope.Hash(_HashedStruct{Name: "a"}))
+	assert.Equal(t, 0, calls)
+
+	assert.NotEqual(t, scope.Hash(true), scope.Hash(1))
+	assert.Equal(t, scope.Hash(1), scope.Hash(1.0))
+}
+
+func TestTimeHash(t *testing.T) {
+	scope := NewScope()
+
+	// Times hash like the epoch they are Eq to.
+	assert.Equal(t, scope.Hash(1600000000), scope.Hash(time.Unix(1600000000, 0)))
+	assert.Equal(t, scope.Hash(1.5), scope.Hash(time.Unix(1, 500000000)))
+	assert.NotEqual(t,
+		scope.Hash(time.Unix(1600000000, 1)),
+		scope.Hash(time.Unix(1600000000, 2)))
+	assert.Equal(t, scope.Hash(60), scope.Hash(time.Minute))
+
+}
+
+// A time and strings which are Eq to it are in the same group even
+// though they hash differently.
+func TestTimeStringGroups(t *testing.T) {
+	mixed := "chain(" +
+		"a={SELECT timestamp(epoch=1600000000) AS T, 1 AS X FROM scope()}, " +
+		"b={SELECT '2020-09-13T12:26:40Z' AS T, 1 AS X FROM scope()}, " +
+		"c={SELECT '2020-09-13 12:26:40' AS T, 1 AS X FROM scope()}, " +
+		"d={SELECT '2020-09-13T12:26:41Z' AS T, 1 AS X FROM scope()}, " +
+		"e={SELECT 'other' AS T, 1 AS X FROM scope()})"
+
+	for query, expected := range map[string]int{
+		"SELECT T FROM " + mixed + " GROUP BY T":                   3,
+		"SELECT T FROM " + mixed + " GROUP BY X, T":                3,
+		"SELECT DISTINCT T FROM " + mixed:                          3,
+		"SELECT DISTINCT dict(x=[T]) AS T FROM " + mixed:           3,
+		"SELECT count(items=1) AS C FROM " + mixed + " GROUP BY X": 1,
+
+		// The time is Eq to a string seen before it.
+		"SELECT T FROM chain(" +
+			"a={SELECT '2020-09-13T12:26:40Z' AS T FROM scope()}, " +
+			"b={SELECT timestamp(epoch=1600000000) AS T FROM scope()}) " +
+			"GROUP BY T": 1,
+
+		// Rows after the first are spilled when there is a
+		// memory budget.
+		"SELECT T FROM chain(" +
+			"a={SELECT 'first' AS T FROM scope()}, " +
+			"b={SELECT timestamp(epoch=1600000000) AS T FROM scope()}, " +
+			"c={SELECT '2020-09-13T12:26:40Z' AS T FROM scope()}) " +
+			"GROUP BY T": 2,
+
+		// Different strings for the same time are not Eq.
+		"SELECT DISTINCT T FROM chain(" +
+			"a={SELECT '2020-09-13T12:26:40Z' AS T FROM scope()}, " +
+			"b={SELECT '2020-09-13 12:26:40' AS T FROM scope()})": 2,
+
+		"SELECT * FROM " + mixed + " AS a JOIN chain(" +
+			"a={SELECT timestamp(epoch=1600000000) AS T FROM scope()}) AS b " +
+			"ON a.T = b.T": 3,
+		"SELECT * FROM chain(" +
+			"a={SELECT timestamp(epoch=1600000000) AS T FROM scope()}) AS a " +
+			"JOIN " + mixed + " AS b ON a.T = b.T": 3,
+	} {
+		vql, err := Parse(query)
+		assert.NoError(t, err, query)
+
+		for _, scope := range []*Scope{
+			makeTestScope(),
+			makeTestScope().SetMemoryBudget(1),
+			makeTestScope().SetAggregateWorkers(4),
+		} {
+			rows := []Row{}
+			for row := range vql.Eval(context.Background(), scope) {
+				rows = append(rows, row)
+			}
+			assert.Equal(t, expected, len(rows), query)
+		}
+	}
+}
+
+func TestParsePluginErrors(t *testing.T) {
+	for query, error_type := range map[string]ErrorType{
+		"SELECT * FROM parse_json(data='[{\"a\": 1}, {')":          TypeError,
+		"SELECT * FROM parse_json(data='1')":                       TypeError,
+		"SELECT * FROM parse_jsonl(data='{\"a\": 1}\nnot json')":   TypeError,
+		"SELECT * FROM parse_csv(data='a,b\n\"1,2')":               TypeError,
+		"SELECT * FROM parse_csv(data='a,b\n1,2', separator='ab')": ArgumentError,
+		"SELECT * FROM parse_jsonl(data=1)":                        ArgumentError,
+	} {
+		scope := NewScope()
+		vql, err := Parse(query)
+		assert.NoError(t, err)
+
+		collector := NewErrorCollector(false)
+		for _ = range vql.EvalWithErrors(context.Background(), scope, collector) {
+		}
+
+		errors := collector.Errors()
+		if assert.Equal(t, 1, len(errors), query) {
+			assert.Equal(t, error_type, errors[0].Type, query)
+		}
+	}
+
+	// In strict mode the first bad line stops the query.
+	scope := NewScope()
+	vql, err := Parse("SELECT * FROM parse_jsonl(data='{\"a\": 1}\nnot json\n{\"a\": 2}')")
+	assert.NoError(t, err)
+
+	collector := NewErrorCollector(true)
+	rows := 0
+	for _ = range vql.EvalWithErrors(context.Background(), scope, collector) {
+		rows++
+	}
+	assert.Equal(t, 1, len(collector.Errors()))
+	assert.True(t, rows < 2)
+}
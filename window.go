@@ -0,0 +1,623 @@
+package vfilter
+
+// Window functions.
+
+// A function call followed by an OVER clause is evaluated over a
+// window of rows rather than just the current row. For example:
+
+// SELECT Name, sum(items=Size) OVER (PARTITION BY Dir ORDER BY Mtime) AS Total
+// FROM glob(globs="/tmp/**")
+
+// The rows which pass the WHERE clause are split into partitions by
+// the PARTITION BY expressions, and each partition is sorted by the
+// window's ORDER BY terms. The function is then evaluated for each
+// row using the rows of its partition.
+
+// Window functions (e.g. row_number(), rank(), lag() and lead())
+// work on the position of the row in its partition. Aggregates
+// (e.g. sum() or count()) summarise the rows in the row's frame. By
+// default the frame is the whole partition, or if the window has an
+// ORDER BY, the rows up to and including the current row (i.e. a
+// running total). The frame may also be given explicitly, counting
+// rows before (PRECEDING) or after (FOLLOWING) the current row:
+
+// ROWS BETWEEN 2 PRECEDING AND CURRENT ROW
+// ROWS BETWEEN UNBOUNDED PRECEDING AND 1 FOLLOWING
+// ROWS 3 PRECEDING
+
+// Rows are emitted in the same order as they would be without the
+// window functions. Window functions may not be used in the WHERE
+// clause or in a query which also has a GROUP BY or aggregates.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+type _Window struct {
+	PartitionBy []*_AndExpression `"OVER" "(" [ PARTITIONBY @@ { "," @@ } ]`
+	OrderBy     []*_OrderByTerm   `[ ORDERBY @@ { "," @@ } ]`
+	Frame       *_WindowFrame     `[ @@ ] ")"`
+}
+
+// Either ROWS BETWEEN start AND end or ROWS start, which ends at the
+// current row.
+type _WindowFrame struct {
+	Start *_FrameBound `"ROWS" ( BETWEEN @@ AND`
+	End   *_FrameBound `  @@`
+	Only  *_FrameBound `| @@ )`
+}
+
+type _FrameBound struct {
+	Unbounded bool   `( @"UNBOUNDED"`
+	Offset    *int64 `| @Number`
+	Current   bool   `| @"CURRENT" "ROW" )`
+	Following bool   `[ "PRECEDING" | @"FOLLOWING" ]`
+}
+
+func (self *_Window) ToString(scope *Scope) string {
+	var terms []string
+	if len(self.PartitionBy) > 0 {
+		var partition_by []string
+		for _, expr := range self.PartitionBy {
+			partition_by = append(partition_by, expr.ToString(scope))
+		}
+		terms = append(terms, "PARTITION BY "+strings.Join(partition_by, ", "))
+	}
+
+	if len(self.OrderBy) > 0 {
+		var order_by []string
+		for _, term := range self.OrderBy {
+			order_by = append(order_by, term.ToString(scope))
+		}
+		terms = append(terms, "ORDER BY "+strings.Join(order_by, ", "))
+	}
+
+	if self.Frame != nil {
+		terms = append(terms, self.Frame.ToString())
+	}
+
+	return "OVER (" + strings.Join(terms, " ") + ")"
+}
+
+func (self *_WindowFrame) ToString() string {
+	if self.Only != nil {
+		return "ROWS " + self.Only.ToString()
+	}
+	return "ROWS BETWEEN " + self.Start.ToString() + " AND " + self.End.ToString()
+}
+
+func (self *_FrameBound) ToString() string {
+	if self.Current {
+		return "CURRENT ROW"
+	}
+
+	result := "UNBOUNDED"
+	if self.Offset != nil {
+		result = fmt.Sprintf("%d", *self.Offset)
+	}
+
+	if self.Following {
+		return result + " FOLLOWING"
+	}
+	return result + " PRECEDING"
+}
+
+// The position of the bound relative to the row at idx in a
+// partition of length rows.
+func (self *_FrameBound) position(idx int, length int) int {
+	switch {
+	case self.Current:
+		return idx
+
+	case self.Offset == nil && self.Following:
+		return length - 1
+
+	case self.Offset == nil:
+		return 0
+
+	case self.Following:
+		return idx + int(*self.Offset)
+	}
+
+	return idx - int(*self.Offset)
+}
+
+// The rows of the frame for the row at idx are [start, end).
+func (self *_Window) frame(idx int, length int) (int, int) {
+	if self.Frame == nil {
+		if len(self.OrderBy) == 0 {
+			return 0, length
+		}
+		return 0, idx + 1
+	}
+
+	start_bound, end_bound := self.Frame.Start, self.Frame.End
+	if self.Frame.Only != nil {
+		start_bound, end_bound = self.Frame.Only, &_FrameBound{Current: true}
+	}
+
+	start := start_bound.position(idx, length)
+	end := end_bound.position(idx, length) + 1
+	if start < 0 {
+		start = 0
+	}
+	if end > length {
+		end = length
+	}
+	if end < start {
+		end = start
+	}
+
+	return start, end
+}
+
+// The rows in a partition in window order, as seen by a window
+// function.
+type WindowPartition struct {
+	ctx  context.Context
+	call *_SymbolRef
+
+	// The scope of each row and its ORDER BY keys.
+	scopes []*Scope
+	keys   [][]Any
+
+	// The position of each row in the query's result.
+	rows []int64
+}
+
+// The number of rows in the partition.
+func (self *WindowPartition) Len() int {
+	return len(self.scopes)
+}
+
+// The args of the window function for the row at idx. Args must be
+// extracted with ExtractArgs().
+func (self *WindowPartition) Args(idx int) *ordereddict.Dict {
+	return self.call.args(self.ctx, self.scopes[idx])
+}
+
+// Are the rows at a and b ordered the same by the window's ORDER BY
+// (i.e. are they peers)? Without an ORDER BY all rows are peers.
+func (self *WindowPartition) Peers(a int, b int) bool {
+	return compareTerms(self.scopes[a], self.call.Window.OrderBy,
+		self.keys[a], self.keys[b]) == 0
+}
+
+// A window function computes its value for each row from the other
+// rows in the row's partition.
+type WindowFunctionInterface interface {
+	Info(scope *Scope, type_map *TypeMap) *FunctionInfo
+
+	// Returns the value of the function for each row in the
+	// partition.
+	Window(ctx context.Context, scope *Scope, partition *WindowPartition) []Any
+}
+
+// Adapts a window function so it may be added to the scope's
+// functions. Without an OVER clause it is an error.
+type _WindowFunction struct {
+	impl WindowFunctionInterface
+}
+
+func (self _WindowFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return self.impl.Info(scope, type_map)
+}
+
+func (self _WindowFunction) Call(
+	ctx context.Context,
+	scope *Scope,
+	args *ordereddict.Dict) Any {
+	scope.Log("%v: Must be called with an OVER clause.",
+		self.impl.Info(scope, NewTypeMap()).Name)
+	return Null{}
+}
+
+// The scope variable holding the value of the window function call
+// for the current row.
+func windowKey(call *_SymbolRef) string {
+	return "__window " + GetID(call)
+}
+
+// Find the window function calls in the node, not including those in
+// subqueries which evaluate their own windows.
+func findWindows(node Any) []*_SymbolRef {
+	var result []*_SymbolRef
+	walkAST(node, func(node Any) bool {
+		switch t := node.(type) {
+		case *_Select:
+			return false
+
+		case *_SymbolRef:
+			if t.Window != nil {
+				result = append(result, t)
+			}
+		}
+		return true
+	})
+
+	return result
+}
+
+// Call visit for every node in the AST below node. The children of a
+// node are skipped if visit returns false.
+func walkAST(node Any, visit func(node Any) bool) {
+	var walk func(value reflect.Value)
+	walk = func(value reflect.Value) {
+		switch value.Kind() {
+		case reflect.Ptr:
+			if value.IsNil() {
+				return
+			}
+
+			if visit(value.Interface()) {
+				walk(value.Elem())
+			}
+
+		case reflect.Interface:
+			walk(value.Elem())
+
+		case reflect.Slice:
+			for i := 0; i < value.Len(); i++ {
+				walk(value.Index(i))
+			}
+
+		case reflect.Struct:
+			for i := 0; i < value.NumField(); i++ {
+				// Only the AST is exported.
+				if value.Type().Field(i).PkgPath == "" {
+					walk(value.Field(i))
+				}
+			}
+		}
+	}
+	walk(reflect.ValueOf(node))
+}
+
+// Window functions are evaluated over the rows which pass the WHERE
+// clause, so they can not be used in the WHERE clause itself, nor
+// with GROUP BY which emits different rows.
+func (self *_Select) validateWindows() error {
+	if len(findWindows(self.Where)) > 0 {
+		return errors.New("Window functions are not allowed in WHERE.")
+	}
+
+	if len(self.GroupBy) > 0 && (len(findWindows(self.SelectExpression)) > 0 ||
+		len(findWindows(self.GroupBy)) > 0) {
+		return errors.New("Window functions are not allowed with GROUP BY.")
+	}
+
+	return nil
+}
+
+// The scope for evaluating the window functions of a row.
+func (self _Select) windowScope(ctx context.Context, scope *Scope, row Row) *Scope {
+	transformed_row := self.SelectExpression.Transform(ctx, scope, row)
+
+	// Order matters - transformed row may mask original row.
+	row_scope := scope.Copy()
+	row_scope.AppendVars(row)
+	row_scope.AppendVars(transformed_row)
+
+	return row_scope
+}
+
+// Evaluate a query whose columns call window functions. All the rows
+// are read first so the window functions can be evaluated, then the
+// columns of each row are evaluated with the values of the window
+// functions for the row.
+
+// The rows are kept in external sorters, so they are spilled to disk
+// when the scope has a memory budget. Only the rows of one partition
+// at a time need to be held in memory.
+func (self _Select) evalWindows(ctx context.Context, scope *Scope,
+	windows []*_SymbolRef, emit func(source Row, row Row) bool) {
+
+	// Sorted by seq (i.e. in query order).
+	by_seq := func(a []Any, b []Any) int { return 0 }
+
+	rows := newExternalSorter(scope, by_seq)
+	defer rows.Close()
+
+	// The rows of each window, sorted by partition and then by the
+	// window's ORDER BY. The keys are the hash of the partition
+	// keys followed by the ORDER BY keys.
+	partitioned := make([]*_ExternalSorter, 0, len(windows))
+	for _, call := range windows {
+		call := call
+		sorter := newExternalSorter(scope, func(a []Any, b []Any) int {
+			a_hash, _ := a[0].(string)
+			b_hash, _ := b[0].(string)
+			if a_hash != b_hash {
+				return strings.Compare(a_hash, b_hash)
+			}
+			return compareTerms(scope, call.Window.OrderBy, a[1:], b[1:])
+		})
+		defer sorter.Close()
+
+		partitioned = append(partitioned, sorter)
+	}
+
+	seq := int64(0)
+	for row := range self.From.Eval(ctx, scope) {
+		row_scope := self.windowScope(ctx, scope, row)
+		if self.Where != nil {
+			expression := self.Where.Reduce(ctx, row_scope)
+			if expression == nil || !scope.Bool(expression) {
+				scope.Trace("Row rejected")
+				continue
+			}
+		}
+
+		rows.Add(ctx, seq, nil, row)
+		for idx, call := range windows {
+			partition_keys := make([]Any, 0, len(call.Window.PartitionBy))
+			for _, expr := range call.Window.PartitionBy {
+				partition_keys = append(partition_keys, expr.Reduce(ctx, row_scope))
+			}
+
+			keys := []Any{scope.Hash(partition_keys)}
+			for _, term := range call.Window.OrderBy {
+				keys = append(keys, term.Expression.Reduce(ctx, row_scope))
+			}
+
+			partitioned[idx].Add(ctx, seq, keys, row)
+		}
+		seq++
+	}
+
+	// The values of each window function, sorted by seq.
+	values := make([]<-chan *_SortItem, 0, len(windows))
+	for idx, call := range windows {
+		sorter := newExternalSorter(scope, by_seq)
+		defer sorter.Close()
+
+		self.evalWindow(ctx, scope, call, partitioned[idx], sorter)
+		partitioned[idx].Close()
+
+		values = append(values, sorter.Items(ctx))
+	}
+
+	for item := range rows.Items(ctx) {
+		window_values := ordereddict.NewDict()
+		for idx, call := range windows {
+			var value Any = Null{}
+			value_item, ok := <-values[idx]
+			if ok {
+				value, _ = value_item.row.(*ordereddict.Dict).Get("value")
+			}
+			window_values.Set(windowKey(call), value)
+		}
+
+		window_scope := scope.Copy()
+		window_scope.AppendVars(window_values)
+
+		if !emit(item.row, MaterializedLazyRow(
+			self.SelectExpression.Transform(ctx, window_scope, item.row),
+			window_scope)) {
+			return
+		}
+	}
+}
+
+// Evaluate the window function call over the rows, which are sorted
+// by partition, and add the value for each row to values.
+func (self _Select) evalWindow(ctx context.Context, scope *Scope,
+	call *_SymbolRef, rows *_ExternalSorter, values *_ExternalSorter) {
+	scope.Lock()
+	function := scope.functions[call.Symbol]
+	scope.Unlock()
+
+	flush := func(partition *WindowPartition) {
+		var result []Any
+		switch t := function.(type) {
+		case _WindowFunction:
+			result = t.impl.Window(ctx, scope, partition)
+
+		case _AggregateFunction:
+			result = windowAggregate(ctx, scope, t.impl, partition)
+
+		default:
+			scope.Log("%v: Not a window function or aggregate.", call.Symbol)
+		}
+
+		for pos, seq := range partition.rows {
+			var value Any = Null{}
+			if pos < len(result) {
+				value = result[pos]
+			}
+			values.Add(ctx, seq, nil, ordereddict.NewDict().Set("value", value))
+		}
+	}
+
+	var partition *WindowPartition
+	partition_hash := ""
+	for item := range rows.Items(ctx) {
+		hash, _ := item.keys[0].(string)
+		if partition == nil || hash != partition_hash {
+			if partition != nil {
+				flush(partition)
+			}
+			partition = &WindowPartition{ctx: ctx, call: call}
+			partition_hash = hash
+		}
+
+		partition.scopes = append(partition.scopes,
+			self.windowScope(ctx, scope, item.row))
+		partition.keys = append(partition.keys, item.keys[1:])
+		partition.rows = append(partition.rows, item.seq)
+	}
+
+	if partition != nil {
+		flush(partition)
+	}
+}
+
+// Evaluate an aggregate over the frame of each row. When consecutive
+// frames start at the same row and grow (e.g. for running totals),
+// the state is reused rather than accumulating the frame again.
+func windowAggregate(ctx context.Context, scope *Scope,
+	impl AggregatorInterface, partition *WindowPartition) []Any {
+	length := partition.Len()
+	values := make([]Any, length)
+
+	var state Any
+	initialized := false
+	state_start, state_end := 0, 0
+
+	for idx := 0; idx < length; idx++ {
+		start, end := partition.call.Window.frame(idx, length)
+		if !initialized || start != state_start || end < state_end {
+			state = impl.Init(scope)
+			initialized = true
+			state_start, state_end = start, start
+		}
+
+		for ; state_end < end; state_end++ {
+			state = impl.Accumulate(ctx, scope, state, partition.Args(state_end))
+		}
+
+		values[idx] = impl.Result(scope, state)
+	}
+
+	return values
+}
+
+type _RowNumberFunction struct{}
+
+func (self _RowNumberFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name: "row_number",
+		Doc:  "The number of the row in its window partition, starting at 1.",
+	}
+}
+
+func (self _RowNumberFunction) Window(
+	ctx context.Context, scope *Scope, partition *WindowPartition) []Any {
+	result := make([]Any, 0, partition.Len())
+	for idx := 0; idx < partition.Len(); idx++ {
+		result = append(result, int64(idx+1))
+	}
+	return result
+}
+
+type _RankFunction struct{}
+
+func (self _RankFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name: "rank",
+		Doc: "The rank of the row in its window partition. Rows which " +
+			"order the same have the same rank, leaving gaps after them.",
+	}
+}
+
+func (self _RankFunction) Window(
+	ctx context.Context, scope *Scope, partition *WindowPartition) []Any {
+	result := make([]Any, 0, partition.Len())
+	rank := int64(0)
+	for idx := 0; idx < partition.Len(); idx++ {
+		if idx == 0 || !partition.Peers(idx-1, idx) {
+			rank = int64(idx + 1)
+		}
+		result = append(result, rank)
+	}
+	return result
+}
+
+type _DenseRankFunction struct{}
+
+func (self _DenseRankFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	return &FunctionInfo{
+		Name: "dense_rank",
+		Doc: "The rank of the row in its window partition. Rows which " +
+			"order the same have the same rank, without gaps after them.",
+	}
+}
+
+func (self _DenseRankFunction) Window(
+	ctx context.Context, scope *Scope, partition *WindowPartition) []Any {
+	result := make([]Any, 0, partition.Len())
+	rank := int64(0)
+	for idx := 0; idx < partition.Len(); idx++ {
+		if idx == 0 || !partition.Peers(idx-1, idx) {
+			rank++
+		}
+		result = append(result, rank)
+	}
+	return result
+}
+
+type _LagFunctionArgs struct {
+	Items   Any `vfilter:"required,field=items"`
+	Offset  Any `vfilter:"optional,field=offset"`
+	Default Any `vfilter:"optional,field=default"`
+}
+
+// lag() and lead() return items from the row offset rows before or
+// after the current row.
+type _LagFunction struct {
+	name      string
+	direction int
+}
+
+func (self _LagFunction) Info(scope *Scope, type_map *TypeMap) *FunctionInfo {
+	where := "before"
+	if self.direction > 0 {
+		where = "after"
+	}
+
+	return &FunctionInfo{
+		Name: self.name,
+		Doc: fmt.Sprintf("Returns items from the row offset rows (default 1) "+
+			"%s the current row in its window partition, or default "+
+			"if there is no such row.", where),
+		ArgType: type_map.AddType(scope, _LagFunctionArgs{}),
+	}
+}
+
+func (self _LagFunction) Window(
+	ctx context.Context, scope *Scope, partition *WindowPartition) []Any {
+	result := make([]Any, 0, partition.Len())
+	for idx := 0; idx < partition.Len(); idx++ {
+		arg := &_LagFunctionArgs{}
+		err := ExtractArgs(scope, partition.Args(idx), arg)
+		if err != nil {
+			scope.Log("%s: %s", self.name, err.Error())
+			return nil
+		}
+
+		offset := int64(1)
+		if !is_null_obj(arg.Offset) {
+			var ok bool
+			offset, ok = to_int64(arg.Offset)
+			if !ok {
+				scope.ReportError(newQueryError(ArgumentError,
+					"%s: offset must be an integer, not %v",
+					self.name, arg.Offset))
+				return nil
+			}
+		}
+
+		var value Any = Null{}
+		if arg.Default != nil {
+			value = arg.Default
+		}
+
+		other := idx + self.direction*int(offset)
+		if other >= 0 && other < partition.Len() {
+			other_arg := &_LagFunctionArgs{}
+			err = ExtractArgs(scope, partition.Args(other), other_arg)
+			if err == nil {
+				value = other_arg.Items
+			}
+		}
+
+		result = append(result, value)
+	}
+	return result
+}